@@ -2,4 +2,8 @@ module maelstrom-echo
 
 go 1.21.5
 
-require github.com/jepsen-io/maelstrom/demo/go v0.0.0-20231231190402-2674df7c1076
+require github.com/jepsen-io/maelstrom/demo/go v0.0.0-20231231190402-2674df7c1076 // indirect
+
+require glomers v0.0.0
+
+replace glomers => ../../glomers
@@ -1,3 +1,7 @@
 module maelstrom-unique-ids
 
 go 1.21.5
+
+require glomers v0.0.0
+
+replace glomers => ../glomers
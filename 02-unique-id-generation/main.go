@@ -1,38 +1,22 @@
 package main
 
 import (
-	"encoding/json"
-	"fmt"
 	"log"
-	"math/rand"
-	"os"
-	"time"
 
-	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+	"glomers/node"
+	"glomers/workload/uniqueids"
 )
 
+// Challenge #2: Unique ID Generation
+//
+// The solution itself lives in glomers/workload/uniqueids, this binary
+// only pins it down so it can be run on its own.
 func main() {
-	rand.Seed(time.Now().UnixNano()) // Seed the random generator
-	log.Println("Inside UniqueID Generation main")
-	n := maelstrom.NewNode()
-	processId := os.Getpid()
-
-	// Register the Unique Id generate handler
-	n.Handle("generate", func(msg maelstrom.Message) error {
-		// Unmarshal the message body as loosely typed map
-		var body map[string]any
-		if err := json.Unmarshal(msg.Body, &body); err != nil {
-			return err
-		}
-
-		// Updating the response message type
-		body["type"] = "generate_ok"
-
-		body["id"] = fmt.Sprintf("%d-%d", rand.Int63(), processId)
-
-		return n.Reply(msg, body)
-	})
-
+	n, err := node.New()
+	if err != nil {
+		log.Fatal(err)
+	}
+	uniqueids.Register(n)
 	if err := n.Run(); err != nil {
 		log.Fatal(err)
 	}
@@ -3,6 +3,10 @@ module maelstrom-multinode-broadcast
 go 1.21.5
 
 require (
-	github.com/jepsen-io/maelstrom/demo/go v0.0.0-20231231190402-2674df7c1076
-	golang.org/x/exp v0.0.0-20240119083558-1b970713d09a
+	github.com/jepsen-io/maelstrom/demo/go v0.0.0-20231231190402-2674df7c1076 // indirect
+	golang.org/x/exp v0.0.0-20240119083558-1b970713d09a // indirect
 )
+
+require glomers v0.0.0
+
+replace glomers => ../glomers
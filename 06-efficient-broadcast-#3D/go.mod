@@ -6,3 +6,7 @@ require (
 	github.com/emirpasic/gods v1.18.1 // indirect
 	github.com/jepsen-io/maelstrom/demo/go v0.0.0-20231231190402-2674df7c1076 // indirect
 )
+
+require glomers v0.0.0
+
+replace glomers => ../glomers
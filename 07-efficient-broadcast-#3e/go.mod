@@ -1,3 +1,7 @@
 module efficient-broadcast-3e
 
 go 1.21.5
+
+require glomers v0.0.0
+
+replace glomers => ../glomers
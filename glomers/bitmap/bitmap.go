@@ -0,0 +1,382 @@
+// Package bitmap is a compressed set of 64-bit integers in the style of
+// roaring bitmaps. Values are split by their high 48 bits into containers of
+// up to 65536 low halves, kept as a sorted array of uint16 while there are at
+// most arrayMax of them and as a 8KB bitset beyond, so a set costs two bytes
+// per value at worst and a bit per value once dense.
+//
+// The binary encoding writes every container in whichever of the two forms,
+// or as runs of consecutive values, is the smallest:
+//
+//	uvarint containers
+//	per container  uvarint key, minus the previous key plus one
+//	               byte kind, then
+//	               kindArray  uvarint count-1, count uint16
+//	               kindBits   1024 uint64
+//	               kindRuns   uvarint runs-1, runs of uint16 start and uint16 length-1
+//
+// all little endian.
+package bitmap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"slices"
+)
+
+const (
+	arrayMax  = 4096
+	bitsWords = 1 << 16 / 64
+)
+
+const (
+	kindArray = iota
+	kindBits
+	kindRuns
+)
+
+// Bitmap is a set of int64. The zero value is empty and ready to use, it is
+// not safe for concurrent use.
+type Bitmap struct {
+	keys       []uint64
+	containers []*container
+	n          int
+}
+
+// container holds the low 16 bits of the values sharing a key.
+type container struct {
+	array []uint16 // Sorted, while bits is nil
+	bits  []uint64
+	n     int
+}
+
+// Of returns a bitmap of values.
+func Of(values ...int64) *Bitmap {
+	b := &Bitmap{}
+	for _, v := range values {
+		b.Add(v)
+	}
+	return b
+}
+
+// split maps v to its key and low half, flipping the sign bit so keys and
+// halves in ascending order are values in ascending order.
+func split(v int64) (uint64, uint16) {
+	u := uint64(v) ^ 1<<63
+	return u >> 16, uint16(u)
+}
+
+func join(key uint64, low uint16) int64 {
+	return int64((key<<16 | uint64(low)) ^ 1<<63)
+}
+
+// Add adds v and tells whether it wasn't there yet.
+func (b *Bitmap) Add(v int64) bool {
+	key, low := split(v)
+	i, ok := slices.BinarySearch(b.keys, key)
+	if !ok {
+		b.keys = slices.Insert(b.keys, i, key)
+		b.containers = slices.Insert(b.containers, i, &container{array: []uint16{low}, n: 1})
+		b.n++
+		return true
+	}
+	if !b.containers[i].add(low) {
+		return false
+	}
+	b.n++
+	return true
+}
+
+// Contains tells whether v is in the set.
+func (b *Bitmap) Contains(v int64) bool {
+	key, low := split(v)
+	i, ok := slices.BinarySearch(b.keys, key)
+	return ok && b.containers[i].contains(low)
+}
+
+// Len returns how many values the set holds.
+func (b *Bitmap) Len() int {
+	return b.n
+}
+
+// Each calls fn with every value in ascending order, until it returns false.
+func (b *Bitmap) Each(fn func(v int64) bool) {
+	for i, c := range b.containers {
+		key := b.keys[i]
+		if !c.each(func(low uint16) bool { return fn(join(key, low)) }) {
+			return
+		}
+	}
+}
+
+// Values returns every value in ascending order.
+func (b *Bitmap) Values() []int64 {
+	out := make([]int64, 0, b.n)
+	b.Each(func(v int64) bool {
+		out = append(out, v)
+		return true
+	})
+	return out
+}
+
+// Size estimates the bytes the set takes in memory.
+func (b *Bitmap) Size() int {
+	size := 8 * (cap(b.keys) + cap(b.containers))
+	for _, c := range b.containers {
+		size += 56 + 2*cap(c.array) + 8*cap(c.bits)
+	}
+	return size
+}
+
+func (c *container) add(low uint16) bool {
+	if c.bits != nil {
+		word, bit := low>>6, uint64(1)<<(low&63)
+		if c.bits[word]&bit != 0 {
+			return false
+		}
+		c.bits[word] |= bit
+		c.n++
+		return true
+	}
+	i, ok := slices.BinarySearch(c.array, low)
+	if ok {
+		return false
+	}
+	c.array = slices.Insert(c.array, i, low)
+	c.n++
+	if c.n > arrayMax {
+		c.bits = make([]uint64, bitsWords)
+		for _, low := range c.array {
+			c.bits[low>>6] |= 1 << (low & 63)
+		}
+		c.array = nil
+	}
+	return true
+}
+
+func (c *container) contains(low uint16) bool {
+	if c.bits != nil {
+		return c.bits[low>>6]&(1<<(low&63)) != 0
+	}
+	_, ok := slices.BinarySearch(c.array, low)
+	return ok
+}
+
+func (c *container) each(fn func(low uint16) bool) bool {
+	if c.bits == nil {
+		for _, low := range c.array {
+			if !fn(low) {
+				return false
+			}
+		}
+		return true
+	}
+	for word, w := range c.bits {
+		for w != 0 {
+			bit := bits.TrailingZeros64(w)
+			if !fn(uint16(word<<6 + bit)) {
+				return false
+			}
+			w &= w - 1
+		}
+	}
+	return true
+}
+
+// runs returns the runs of consecutive values, as start and length-1.
+func (c *container) runs() [][2]uint16 {
+	var runs [][2]uint16
+	c.each(func(low uint16) bool {
+		if last := len(runs) - 1; last >= 0 && uint32(runs[last][0])+uint32(runs[last][1])+1 == uint32(low) {
+			runs[last][1]++
+		} else {
+			runs = append(runs, [2]uint16{low, 0})
+		}
+		return true
+	})
+	return runs
+}
+
+func (b *Bitmap) MarshalBinary() ([]byte, error) {
+	buf := binary.AppendUvarint(nil, uint64(len(b.containers)))
+	var prev uint64
+	for i, c := range b.containers {
+		key := b.keys[i]
+		if i == 0 {
+			buf = binary.AppendUvarint(buf, key)
+		} else {
+			buf = binary.AppendUvarint(buf, key-prev-1)
+		}
+		prev = key
+
+		runs := c.runs()
+		switch {
+		case 4*len(runs) < min(2*c.n, 8*bitsWords):
+			buf = append(buf, kindRuns)
+			buf = binary.AppendUvarint(buf, uint64(len(runs)-1))
+			for _, r := range runs {
+				buf = binary.LittleEndian.AppendUint16(buf, r[0])
+				buf = binary.LittleEndian.AppendUint16(buf, r[1])
+			}
+		case c.n <= arrayMax:
+			buf = append(buf, kindArray)
+			buf = binary.AppendUvarint(buf, uint64(c.n-1))
+			c.each(func(low uint16) bool {
+				buf = binary.LittleEndian.AppendUint16(buf, low)
+				return true
+			})
+		default:
+			buf = append(buf, kindBits)
+			words := c.bits
+			if words == nil {
+				words = make([]uint64, bitsWords)
+				for _, low := range c.array {
+					words[low>>6] |= 1 << (low & 63)
+				}
+			}
+			for _, w := range words {
+				buf = binary.LittleEndian.AppendUint64(buf, w)
+			}
+		}
+	}
+	return buf, nil
+}
+
+var errShort = errors.New("bitmap: truncated")
+
+func (b *Bitmap) UnmarshalBinary(data []byte) error {
+	r := reader{buf: data}
+	count, err := r.uvarint()
+	if err != nil {
+		return err
+	}
+	if count > uint64(len(data)) {
+		return fmt.Errorf("bitmap: %d containers in %d bytes", count, len(data))
+	}
+	out := Bitmap{}
+	var key uint64
+	for i := uint64(0); i < count; i++ {
+		delta, err := r.uvarint()
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			key = delta
+		} else {
+			key += delta + 1
+		}
+		if key >= 1<<48 || (i > 0 && key <= out.keys[len(out.keys)-1]) {
+			return fmt.Errorf("bitmap: key %d out of order", key)
+		}
+		c, err := r.container()
+		if err != nil {
+			return err
+		}
+		out.keys = append(out.keys, key)
+		out.containers = append(out.containers, c)
+		out.n += c.n
+	}
+	if len(r.buf) > 0 {
+		return fmt.Errorf("bitmap: %d bytes left over", len(r.buf))
+	}
+	*b = out
+	return nil
+}
+
+type reader struct {
+	buf []byte
+}
+
+func (r *reader) uvarint() (uint64, error) {
+	v, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		return 0, errShort
+	}
+	r.buf = r.buf[n:]
+	return v, nil
+}
+
+func (r *reader) uint16s(n int) ([]uint16, error) {
+	if len(r.buf) < 2*n {
+		return nil, errShort
+	}
+	out := make([]uint16, n)
+	for i := range out {
+		out[i] = binary.LittleEndian.Uint16(r.buf[2*i:])
+	}
+	r.buf = r.buf[2*n:]
+	return out, nil
+}
+
+func (r *reader) container() (*container, error) {
+	if len(r.buf) == 0 {
+		return nil, errShort
+	}
+	kind := r.buf[0]
+	r.buf = r.buf[1:]
+	switch kind {
+	case kindArray:
+		n, err := r.uvarint()
+		if err != nil {
+			return nil, err
+		}
+		if n >= arrayMax {
+			return nil, fmt.Errorf("bitmap: array of %d values", n+1)
+		}
+		array, err := r.uint16s(int(n) + 1)
+		if err != nil {
+			return nil, err
+		}
+		for i := 1; i < len(array); i++ {
+			if array[i] <= array[i-1] {
+				return nil, errors.New("bitmap: array out of order")
+			}
+		}
+		return &container{array: array, n: len(array)}, nil
+
+	case kindBits:
+		if len(r.buf) < 8*bitsWords {
+			return nil, errShort
+		}
+		c := &container{bits: make([]uint64, bitsWords)}
+		for i := range c.bits {
+			c.bits[i] = binary.LittleEndian.Uint64(r.buf[8*i:])
+			c.n += bits.OnesCount64(c.bits[i])
+		}
+		r.buf = r.buf[8*bitsWords:]
+		if c.n == 0 {
+			return nil, errors.New("bitmap: empty container")
+		}
+		return c, nil
+
+	case kindRuns:
+		n, err := r.uvarint()
+		if err != nil {
+			return nil, err
+		}
+		if n >= 1<<15 {
+			return nil, fmt.Errorf("bitmap: %d runs", n+1)
+		}
+		runs, err := r.uint16s(2 * (int(n) + 1))
+		if err != nil {
+			return nil, err
+		}
+		c := &container{}
+		next := 0 // Where the next run may start
+		for i := 0; i < len(runs); i += 2 {
+			start, end := int(runs[i]), int(runs[i])+int(runs[i+1])
+			if start < next || end >= 1<<16 {
+				return nil, errors.New("bitmap: runs overlap or overflow")
+			}
+			for low := start; low <= end; low++ {
+				c.add(uint16(low))
+			}
+			next = end + 1
+		}
+		return c, nil
+
+	default:
+		return nil, fmt.Errorf("bitmap: unknown container kind %d", kind)
+	}
+}
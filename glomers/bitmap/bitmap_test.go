@@ -0,0 +1,156 @@
+package bitmap
+
+import (
+	"encoding/binary"
+	"math"
+	"slices"
+	"testing"
+)
+
+// seq returns n values from start, step apart.
+func seq(start int64, n int, step int64) []int64 {
+	out := make([]int64, n)
+	for i := range out {
+		out[i] = start + int64(i)*step
+	}
+	return out
+}
+
+// Values go to an array container while there are at most arrayMax of them
+// and a bitset past that, and are encoded in whichever of array, bits or
+// runs is smallest.
+func TestContainerKinds(t *testing.T) {
+	tests := []struct {
+		name     string
+		values   []int64
+		wantBits bool // In memory
+		wantKind byte // On the wire
+	}{
+		{"single", []int64{7}, false, kindArray},
+		{"sparse array", seq(0, 100, 2), false, kindArray},
+		{"consecutive array as runs", seq(0, 1000, 1), false, kindRuns},
+		{"full array", seq(0, arrayMax, 2), false, kindArray},
+		{"array to bits", seq(0, arrayMax+1, 2), true, kindBits},
+		{"bits as runs", seq(0, 10000, 1), true, kindRuns},
+		{"whole container as one run", seq(0, 1<<16, 1), true, kindRuns},
+		{"dense bits", seq(0, 1<<15, 2), true, kindBits},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := Of(tt.values...)
+			if len(b.containers) != 1 {
+				t.Fatalf("got %d containers, want 1", len(b.containers))
+			}
+			if got := b.containers[0].bits != nil; got != tt.wantBits {
+				t.Errorf("bits = %v, want %v", got, tt.wantBits)
+			}
+
+			buf, err := b.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Container count and key come first
+			key, _ := split(tt.values[0])
+			at := len(binary.AppendUvarint(binary.AppendUvarint(nil, 1), key))
+			if buf[at] != tt.wantKind {
+				t.Errorf("encoded as kind %d, want %d", buf[at], tt.wantKind)
+			}
+
+			var got Bitmap
+			if err := got.UnmarshalBinary(buf); err != nil {
+				t.Fatalf("UnmarshalBinary: %v", err)
+			}
+			if !slices.Equal(got.Values(), tt.values) {
+				t.Errorf("round trip lost values, got %d of %d", got.Len(), len(tt.values))
+			}
+			// Adding past arrayMax to a decoded array still switches to bits
+			for _, v := range seq(1, arrayMax+1, 2) {
+				got.Add(v)
+			}
+			if got.containers[0].n > arrayMax && got.containers[0].bits == nil {
+				t.Errorf("%d values left in an array", got.containers[0].n)
+			}
+		})
+	}
+}
+
+func TestExtremes(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []int64
+	}{
+		{"min", []int64{math.MinInt64}},
+		{"max", []int64{math.MaxInt64}},
+		{"min and max", []int64{math.MinInt64, math.MaxInt64}},
+		{"around zero", []int64{-65537, -65536, -1, 0, 1, 65535, 65536}},
+		{"run up to max", seq(math.MaxInt64-999, 1000, 1)},
+		{"run from min", seq(math.MinInt64, 1000, 1)},
+		{"bits up to max", seq(math.MaxInt64-(1<<16)+1, arrayMax+10, 3)},
+		{"both ends", append(seq(math.MinInt64, 5000, 1), seq(math.MaxInt64-4999, 5000, 1)...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &Bitmap{}
+			// Add in reverse so inserts don't just append
+			for i := len(tt.values) - 1; i >= 0; i-- {
+				if !b.Add(tt.values[i]) {
+					t.Fatalf("Add(%d) said it was there already", tt.values[i])
+				}
+			}
+			if b.Add(tt.values[0]) {
+				t.Errorf("Add(%d) twice said it was new", tt.values[0])
+			}
+			if !slices.Equal(b.Values(), tt.values) {
+				t.Fatalf("values out of order or lost, got %d of %d", b.Len(), len(tt.values))
+			}
+			for _, v := range []int64{tt.values[0], tt.values[len(tt.values)-1]} {
+				if !b.Contains(v) {
+					t.Errorf("missing %d", v)
+				}
+			}
+
+			buf, err := b.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got Bitmap
+			if err := got.UnmarshalBinary(buf); err != nil {
+				t.Fatalf("UnmarshalBinary: %v", err)
+			}
+			if !slices.Equal(got.Values(), tt.values) {
+				t.Errorf("round trip lost values, got %d of %d", got.Len(), len(tt.values))
+			}
+		})
+	}
+}
+
+func TestUnmarshalRejects(t *testing.T) {
+	valid, err := Of(1, 2, 3, 100).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"truncated", valid[:len(valid)-1]},
+		{"left over", append(slices.Clone(valid), 0)},
+		{"unknown kind", []byte{1, 0, 9}},
+		{"array out of order", []byte{1, 0, kindArray, 1, 5, 0, 4, 0}},
+		{"array too big", binary.AppendUvarint([]byte{1, 0, kindArray}, arrayMax)},
+		{"runs overlap", []byte{1, 0, kindRuns, 1, 0, 0, 4, 0, 3, 0, 0, 0}},
+		{"run past the container", []byte{1, 0, kindRuns, 0, 0xff, 0xff, 1, 0}},
+		{"key wrapping around", append(binary.AppendUvarint([]byte{2, 5, kindArray, 0, 1, 0}, math.MaxUint64-5), kindArray, 0, 1, 0)},
+		{"key past 48 bits", binary.AppendUvarint([]byte{1}, 1<<48)},
+		{"more containers than bytes", []byte{100, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b Bitmap
+			if err := b.UnmarshalBinary(tt.data); err == nil {
+				t.Errorf("got %v, want an error", b.Values())
+			}
+		})
+	}
+}
@@ -0,0 +1,269 @@
+// Package breaker keeps a circuit breaker per peer around the RPCs a node
+// sends, so a peer that stopped answering costs nothing instead of a timeout
+// per call.
+//
+// A breaker starts closed and lets every call through, remembering how the
+// last BreakerWindow went. Once at least BreakerMinCalls of those failed at
+// BreakerFailureRate or worse it opens and fails calls at once with ErrOpen.
+// After BreakerOpenTimeout it is half-open: a single probe call goes through,
+// closing the breaker if it succeeds and opening it again if it doesn't.
+// Callers with work for an open peer wait on Ready rather than hammering it.
+//
+// Every breaker's state can be asked for with
+//
+//	{"type": "breaker_status"}
+package breaker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+
+	"glomers/clock"
+	"glomers/config"
+	"glomers/logging"
+	"glomers/metrics"
+)
+
+var logger = logging.Component("breaker")
+
+// ErrOpen is returned, without calling, while a peer's breaker is open.
+var ErrOpen = errors.New("circuit breaker open")
+
+type State int
+
+const (
+	Closed State = iota
+	Open
+	HalfOpen
+)
+
+var stateNames = [...]string{Closed: "closed", Open: "open", HalfOpen: "half-open"}
+
+func (s State) String() string {
+	if int(s) < len(stateNames) {
+		return stateNames[s]
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Breakers holds the breaker of every peer called so far.
+type Breakers struct {
+	cfg *config.Store
+
+	mu    sync.Mutex
+	peers map[string]*breaker
+}
+
+type breaker struct {
+	state State
+	// Outcomes of the last calls while closed, true for a failure
+	window []bool
+	// Half-open and the probe is out
+	probing bool
+	opened  time.Time
+	// How often it opened, and calls it failed fast
+	trips    int
+	rejected int
+	// Closed whenever calls may go through again
+	ready chan struct{}
+}
+
+// Register registers breaker_status.
+func Register(n *maelstrom.Node, cfg *config.Store) *Breakers {
+	b := &Breakers{cfg: cfg, peers: make(map[string]*breaker)}
+	n.Handle("breaker_status", func(msg maelstrom.Message) error {
+		return b.statusHandler(n, msg)
+	})
+	return b
+}
+
+// Call runs fn, an RPC to peer, unless peer's breaker is open and returns
+// ErrOpen instead. fn's error counts as a failure.
+func (b *Breakers) Call(peer string, fn func() error) error {
+	if !b.allow(peer) {
+		return ErrOpen
+	}
+	err := fn()
+	b.done(peer, err)
+	return err
+}
+
+// Ready returns a channel closed once a call to peer would go through, at
+// once unless its breaker is open or its probe is out.
+func (b *Breakers) Ready(peer string) <-chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.breaker(peer).ready
+}
+
+// State returns peer's breaker state.
+func (b *Breakers) State(peer string) State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.breaker(peer).state
+}
+
+// breaker returns peer's breaker, b.mu must be held.
+func (b *Breakers) breaker(peer string) *breaker {
+	br, ok := b.peers[peer]
+	if !ok {
+		br = &breaker{ready: make(chan struct{})}
+		close(br.ready)
+		b.peers[peer] = br
+	}
+	return br
+}
+
+func (b *Breakers) allow(peer string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	br := b.breaker(peer)
+	switch {
+	case br.state == Closed:
+		return true
+	case br.state == HalfOpen && !br.probing:
+		// The one call that finds out whether peer is back
+		br.probing = true
+		br.ready = make(chan struct{})
+		return true
+	default:
+		br.rejected++
+		metrics.Inc("breaker_rejected_total", "peer", peer)
+		return false
+	}
+}
+
+func (b *Breakers) done(peer string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	br := b.breaker(peer)
+	c := b.cfg.Get()
+
+	switch br.state {
+	case Closed:
+		br.window = append(br.window, err != nil)
+		if len(br.window) > c.BreakerWindow {
+			br.window = br.window[len(br.window)-c.BreakerWindow:]
+		}
+		failed := 0
+		for _, f := range br.window {
+			if f {
+				failed++
+			}
+		}
+		if failed >= c.BreakerMinCalls && float64(failed)/float64(len(br.window)) >= c.BreakerFailureRate {
+			b.open(peer, br, err)
+		}
+	case HalfOpen:
+		br.probing = false
+		if err != nil {
+			b.open(peer, br, err)
+			return
+		}
+		logger.Info("Probe went through, closing breaker", "peer", peer)
+		br.state = Closed
+		br.window = nil
+		close(br.ready)
+	}
+}
+
+// open fails calls to peer until it is time to probe, b.mu must be held.
+func (b *Breakers) open(peer string, br *breaker, err error) {
+	timeout := b.cfg.Get().BreakerOpenTimeout
+	logger.Warn("Opening breaker", "peer", peer, "for", timeout, "err", err)
+	if br.state == Closed {
+		br.ready = make(chan struct{})
+	}
+	br.state = Open
+	br.window = nil
+	br.opened = clock.Now()
+	br.trips++
+	metrics.Inc("breaker_trips_total", "peer", peer)
+	clock.AfterFunc(timeout, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if br.state == Open {
+			br.state = HalfOpen
+			close(br.ready)
+		}
+	})
+}
+
+// Status is what breaker_status reports for a peer.
+type Status struct {
+	State State `json:"state"`
+	// Calls and failures in the current window, while closed
+	Calls    int `json:"calls"`
+	Failures int `json:"failures"`
+	// When it last opened, RFC 3339
+	Opened   string `json:"opened,omitempty"`
+	Trips    int    `json:"trips"`
+	Rejected int    `json:"rejected"`
+}
+
+// Statuses returns the status of every breaker.
+func (b *Breakers) Statuses() map[string]Status {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	out := make(map[string]Status, len(b.peers))
+	for peer, br := range b.peers {
+		s := Status{State: br.state, Calls: len(br.window), Trips: br.trips, Rejected: br.rejected}
+		for _, f := range br.window {
+			if f {
+				s.Failures++
+			}
+		}
+		if !br.opened.IsZero() {
+			s.Opened = br.opened.UTC().Format(time.RFC3339Nano)
+		}
+		out[peer] = s
+	}
+	return out
+}
+
+// statusHandler reports every breaker, and the peers whose breakers aren't
+// closed.
+//
+//	Request
+//	{
+//	  "type": "breaker_status"
+//	}
+//
+//	Response
+//	{
+//	  "type": "breaker_status_ok",
+//	  "breakers": {
+//	    "n1": {"state": "closed", "calls": 12, "failures": 1, "trips": 0, "rejected": 0},
+//	    "n2": {"state": "open", "calls": 0, "failures": 0, "opened": "2024-01-02T15:04:05.123Z", "trips": 1, "rejected": 7}
+//	  },
+//	  "unavailable": ["n2"]
+//	}
+func (b *Breakers) statusHandler(n *maelstrom.Node, msg maelstrom.Message) error {
+	var body struct{}
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
+	}
+	statuses := b.Statuses()
+	unavailable := []string{}
+	for peer, s := range statuses {
+		if s.State != Closed {
+			unavailable = append(unavailable, peer)
+		}
+	}
+	sort.Strings(unavailable)
+	return n.Reply(msg, map[string]any{
+		"type":        "breaker_status_ok",
+		"breakers":    statuses,
+		"unavailable": unavailable,
+	})
+}
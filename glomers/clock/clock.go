@@ -0,0 +1,94 @@
+// Package clock lets node code read time and schedule work through a
+// swappable clock, so a recorded run can be replayed with virtual time.
+//
+// Node code should call clock.Now, clock.Sleep, clock.NewTicker, ... instead
+// of the time package. By default they are backed by the real clock.
+package clock
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Clock is the subset of the time package used by the nodes.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+	NewTicker(d time.Duration) Ticker
+}
+
+// Timer is a scheduled function call that can be cancelled.
+type Timer interface {
+	Stop() bool
+}
+
+// Ticker delivers ticks on C at every period.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+	Reset(d time.Duration)
+}
+
+var (
+	mu      sync.RWMutex
+	current Clock = Real{}
+)
+
+// Set replaces the clock used by the package level helpers.
+func Set(c Clock) {
+	mu.Lock()
+	current = c
+	mu.Unlock()
+}
+
+// Get returns the clock currently in use.
+func Get() Clock {
+	mu.RLock()
+	defer mu.RUnlock()
+	return current
+}
+
+func Now() time.Time                            { return Get().Now() }
+func Since(t time.Time) time.Duration           { return Get().Now().Sub(t) }
+func After(d time.Duration) <-chan time.Time    { return Get().After(d) }
+func AfterFunc(d time.Duration, f func()) Timer { return Get().AfterFunc(d, f) }
+func NewTicker(d time.Duration) Ticker          { return Get().NewTicker(d) }
+
+// Sleep pauses the calling goroutine for d on the current clock.
+func Sleep(d time.Duration) {
+	<-Get().After(d)
+}
+
+// WithTimeout is context.WithTimeout measured on the current clock.
+func WithTimeout(parent context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	c := Get()
+	if _, ok := c.(Real); ok {
+		return context.WithTimeout(parent, d)
+	}
+	ctx, cancel := context.WithCancel(parent)
+	t := c.AfterFunc(d, cancel)
+	return ctx, func() {
+		t.Stop()
+		cancel()
+	}
+}
+
+// Real is the wall clock.
+type Real struct{}
+
+func (Real) Now() time.Time                         { return time.Now() }
+func (Real) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (Real) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+func (Real) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time { return t.Ticker.C }
@@ -0,0 +1,148 @@
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Virtual is a clock that only moves when Advance is called. Timers and
+// tickers fire in deadline order as time is advanced past them.
+type Virtual struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*virtualTimer
+}
+
+func NewVirtual(start time.Time) *Virtual {
+	return &Virtual{now: start}
+}
+
+type virtualTimer struct {
+	v      *Virtual
+	at     time.Time
+	period time.Duration
+	ch     chan time.Time
+	fn     func()
+}
+
+func (v *Virtual) Now() time.Time {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.now
+}
+
+func (v *Virtual) After(d time.Duration) <-chan time.Time {
+	t := &virtualTimer{v: v, ch: make(chan time.Time, 1)}
+	v.schedule(t, d)
+	return t.ch
+}
+
+func (v *Virtual) AfterFunc(d time.Duration, f func()) Timer {
+	t := &virtualTimer{v: v, fn: f}
+	v.schedule(t, d)
+	return t
+}
+
+func (v *Virtual) NewTicker(d time.Duration) Ticker {
+	t := &virtualTimer{v: v, period: d, ch: make(chan time.Time, 1)}
+	v.schedule(t, d)
+	return virtualTicker{t}
+}
+
+// Advance moves the clock forward to "to", firing every timer due on the
+// way. Moving backwards is a no-op.
+func (v *Virtual) Advance(to time.Time) {
+	for {
+		v.mu.Lock()
+		if len(v.timers) == 0 || v.timers[0].at.After(to) {
+			if to.After(v.now) {
+				v.now = to
+			}
+			v.mu.Unlock()
+			return
+		}
+		t := v.timers[0]
+		v.timers = v.timers[1:]
+		if t.at.After(v.now) {
+			v.now = t.at
+		}
+		now := v.now
+		if t.period > 0 {
+			t.at = t.at.Add(t.period)
+			v.insert(t)
+		}
+		v.mu.Unlock()
+
+		t.fire(now)
+	}
+}
+
+func (v *Virtual) schedule(t *virtualTimer, d time.Duration) {
+	v.mu.Lock()
+	t.at = v.now.Add(d)
+	now := v.now
+	due := d <= 0 && t.period == 0
+	if !due {
+		v.insert(t)
+	}
+	v.mu.Unlock()
+
+	if due {
+		t.fire(now)
+	}
+}
+
+// insert keeps timers sorted by deadline, caller must hold v.mu.
+func (v *Virtual) insert(t *virtualTimer) {
+	i := sort.Search(len(v.timers), func(i int) bool { return v.timers[i].at.After(t.at) })
+	v.timers = append(v.timers, nil)
+	copy(v.timers[i+1:], v.timers[i:])
+	v.timers[i] = t
+}
+
+// remove drops t from the pending timers, caller must hold v.mu.
+func (v *Virtual) remove(t *virtualTimer) bool {
+	for i, pending := range v.timers {
+		if pending == t {
+			v.timers = append(v.timers[:i], v.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (t *virtualTimer) fire(now time.Time) {
+	if t.fn != nil {
+		go t.fn()
+		return
+	}
+	// Like time.Ticker, drop the tick if the reader is behind
+	select {
+	case t.ch <- now:
+	default:
+	}
+}
+
+func (t *virtualTimer) Stop() bool {
+	t.v.mu.Lock()
+	defer t.v.mu.Unlock()
+	return t.v.remove(t)
+}
+
+type virtualTicker struct {
+	t *virtualTimer
+}
+
+func (vt virtualTicker) C() <-chan time.Time { return vt.t.ch }
+func (vt virtualTicker) Stop()               { vt.t.Stop() }
+
+func (vt virtualTicker) Reset(d time.Duration) {
+	v := vt.t.v
+	v.mu.Lock()
+	v.remove(vt.t)
+	vt.t.period = d
+	vt.t.at = v.now.Add(d)
+	v.insert(vt.t)
+	v.mu.Unlock()
+}
@@ -0,0 +1,60 @@
+// Command batchbench prints how many bytes each integer of a batch takes on
+// the wire as a JSON array, the way every batch went before, and in the
+// compact forms a peer can negotiate (see the batch_bitmaps and batch_varints
+// options), for a few ways values can be spread.
+//
+//	batchbench [-n 100] [-seed 1]
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"text/tabwriter"
+
+	"glomers/bitmap"
+	"glomers/delta"
+	"glomers/spread"
+)
+
+func main() {
+	n := flag.Int("n", 100, "values per batch, batch_size")
+	seed := flag.Int64("seed", 1, "random seed")
+	flag.Parse()
+	if *n < 1 {
+		fmt.Fprintln(os.Stderr, "usage: batchbench [-n values] [-seed seed]")
+		os.Exit(2)
+	}
+	r := rand.New(rand.NewSource(*seed))
+
+	fmt.Printf("bytes per value, %d values a batch\n", *n)
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "values\tjson\tbitmap\tvarint\t")
+	for _, s := range spread.All {
+		// Batches go in the order values arrived
+		values, arrived := s.Batch(r, *n)
+		array, err := json.Marshal(arrived)
+		if err != nil {
+			log.Fatal(err)
+		}
+		bits, err := bitmap.Of(values...).MarshalBinary()
+		if err != nil {
+			log.Fatal(err)
+		}
+		perValue := func(size int) string {
+			return fmt.Sprintf("%.2f", float64(size)/float64(len(values)))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t\n", s.Name,
+			perValue(len(array)), perValue(field(bits)), perValue(field(delta.Encode(values))))
+	}
+	w.Flush()
+}
+
+// field is the size of buf as the base64 JSON string it is sent as.
+func field(buf []byte) int {
+	return base64.StdEncoding.EncodedLen(len(buf)) + 2
+}
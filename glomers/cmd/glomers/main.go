@@ -0,0 +1,92 @@
+// Command glomers runs any of the Gossip Glomers workloads from one binary.
+//
+//	glomers echo
+//	glomers unique-ids
+//	glomers broadcast --strategy=tree|batched|flood|gossip|single|plumtree [--config=file.json] [--batch-frequency=1s] [--max-retry=100] ...
+//
+// The workload and every flag can also be given through the environment, e.g.
+// GLOMERS_WORKLOAD=broadcast GLOMERS_STRATEGY=batched, which is handy as
+// Maelstrom's --bin can't take arguments. See the config package for the
+// broadcast tunables.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+
+	"glomers/config"
+	"glomers/node"
+	"glomers/workload/broadcast"
+	"glomers/workload/echo"
+	"glomers/workload/uniqueids"
+)
+
+// A workload parses its own arguments and registers its handlers on n
+type workload func(n *maelstrom.Node, args []string) error
+
+var workloads = map[string]workload{
+	"echo": func(n *maelstrom.Node, args []string) error {
+		if err := flag.NewFlagSet("echo", flag.ExitOnError).Parse(args); err != nil {
+			return err
+		}
+		echo.Register(n)
+		return nil
+	},
+	"unique-ids": func(n *maelstrom.Node, args []string) error {
+		if err := flag.NewFlagSet("unique-ids", flag.ExitOnError).Parse(args); err != nil {
+			return err
+		}
+		uniqueids.Register(n)
+		return nil
+	},
+	"broadcast": func(n *maelstrom.Node, args []string) error {
+		fs := flag.NewFlagSet("broadcast", flag.ExitOnError)
+		strategy := fs.String("strategy", envString("GLOMERS_STRATEGY", "batched"),
+			"one of "+strings.Join(broadcast.Strategies(), "|"))
+		cfg, err := config.Load(fs, args)
+		if err != nil {
+			return err
+		}
+		return broadcast.Register(n, *strategy, cfg)
+	},
+}
+
+func main() {
+	args := os.Args[1:]
+	if len(args) == 0 && os.Getenv("GLOMERS_WORKLOAD") != "" {
+		args = []string{os.Getenv("GLOMERS_WORKLOAD")}
+	}
+	if len(args) == 0 || workloads[args[0]] == nil {
+		names := make([]string, 0, len(workloads))
+		for name := range workloads {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		fmt.Fprintf(os.Stderr, "usage: %s <%s> [flags]\n", os.Args[0], strings.Join(names, "|"))
+		os.Exit(2)
+	}
+
+	n, err := node.New()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := workloads[args[0]](n, args[1:]); err != nil {
+		log.Fatal(err)
+	}
+	if err := n.Run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func envString(key, fallback string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return fallback
+}
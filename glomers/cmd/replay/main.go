@@ -0,0 +1,159 @@
+// Command replay feeds the inputs of a recorded trace into a fresh node and
+// diffs what the node writes back against the recorded outputs.
+//
+//	replay -trace traces/n1.jsonl -- ./broadcast-node
+//
+// The node runs with GLOMERS_REPLAY=1, so it reads the trace records itself and
+// its clock only moves with the recorded timestamps. The exit status is 1 when
+// the outputs differ, which makes it usable with `git bisect run`. Message ids
+// are left out of the comparison by default, both msg_id and the in_reply_to
+// pointing at one, as a node numbers its RPCs as it pleases.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"glomers/record"
+)
+
+func main() {
+	tracePath := flag.String("trace", "", "recorded trace file of a single node")
+	ignore := flag.String("ignore", "msg_id,in_reply_to", "comma separated body fields left out of the comparison")
+	grace := flag.Duration("grace", 5*time.Second, "virtual time to keep running after the last recorded line")
+	flag.Parse()
+
+	if *tracePath == "" || flag.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: replay -trace <file> [-ignore f1,f2] -- <node binary> [args...]")
+		os.Exit(2)
+	}
+
+	records, err := readTrace(*tracePath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var input bytes.Buffer
+	var expected []string
+	var last int64
+	ignored := strings.Split(*ignore, ",")
+	for _, rec := range records {
+		last = max(last, rec.T)
+		switch rec.Dir {
+		case record.In:
+			line, _ := json.Marshal(rec)
+			input.Write(append(line, '\n'))
+		case record.Out:
+			expected = append(expected, normalise(rec.Msg, ignored))
+		}
+	}
+	end, _ := json.Marshal(record.Record{T: last + grace.Nanoseconds(), Dir: record.End})
+	input.Write(append(end, '\n'))
+
+	cmd := exec.Command(flag.Arg(0), flag.Args()[1:]...)
+	cmd.Env = append(os.Environ(), record.EnvReplay+"=1", record.EnvDir+"=")
+	cmd.Stdin = &input
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		log.Printf("Node exited with err=%v", err)
+	}
+
+	var actual []string
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if line := bytes.TrimSpace(scanner.Bytes()); len(line) > 0 {
+			actual = append(actual, normalise(line, ignored))
+		}
+	}
+
+	missing, extra := diff(expected, actual)
+	for _, line := range missing {
+		fmt.Println("-", line)
+	}
+	for _, line := range extra {
+		fmt.Println("+", line)
+	}
+	log.Printf("Replayed %d records: %d outputs expected, %d produced, %d missing, %d extra",
+		len(records), len(expected), len(actual), len(missing), len(extra))
+	if len(missing)+len(extra) > 0 {
+		os.Exit(1)
+	}
+}
+
+func readTrace(path string) ([]record.Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []record.Record
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var rec record.Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		records = append(records, rec)
+	}
+	return records, scanner.Err()
+}
+
+// normalise re-encodes a message with sorted keys and without the ignored
+// body fields, so two runs can be compared line by line.
+func normalise(line []byte, ignored []string) string {
+	var msg map[string]any
+	if err := json.Unmarshal(line, &msg); err != nil {
+		return string(line)
+	}
+	if body, ok := msg["body"].(map[string]any); ok {
+		for _, field := range ignored {
+			delete(body, field)
+		}
+		// Set contents come back in map order, compare them as sets
+		for _, v := range body {
+			if values, ok := v.([]any); ok {
+				sort.Slice(values, func(i, j int) bool {
+					return fmt.Sprint(values[i]) < fmt.Sprint(values[j])
+				})
+			}
+		}
+	}
+	out, _ := json.Marshal(msg)
+	return string(out)
+}
+
+// diff compares two lists of lines as multisets, since the node handles
+// messages concurrently and the order of its outputs isn't deterministic.
+func diff(expected, actual []string) (missing, extra []string) {
+	counts := make(map[string]int)
+	for _, line := range actual {
+		counts[line]++
+	}
+	for _, line := range expected {
+		if counts[line] > 0 {
+			counts[line]--
+			continue
+		}
+		missing = append(missing, line)
+	}
+	for _, line := range actual {
+		if counts[line] > 0 {
+			counts[line]--
+			extra = append(extra, line)
+		}
+	}
+	return missing, extra
+}
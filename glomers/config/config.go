@@ -0,0 +1,520 @@
+// Package config holds the runtime tunables of the workloads.
+//
+// Every field of Config is settable, in increasing order of precedence, from
+// its default, a JSON config file (--config or GLOMERS_CONFIG), the
+// environment (GLOMERS_<FIELD>, e.g. GLOMERS_BATCH_FREQUENCY=500ms) and flags
+// (--batch-frequency=500ms). A running node can be changed with
+//
+//	{"type": "update_config", "config": {"batch_frequency": "200ms"}}
+//
+// and the parts of the node that cache a value, like tickers, are told
+// through Store.Subscribe.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+
+	"glomers/logging"
+	"glomers/node"
+)
+
+const EnvFile = "GLOMERS_CONFIG"
+
+var logger = logging.Component("config")
+
+// Config is every tunable of the broadcast strategies. The json tag is the
+// name used everywhere: in files, update_config, and (dashed or upper cased)
+// in flags and the environment.
+type Config struct {
+	// How often the gossip strategy peer-copies what its peers are missing
+	GossipInterval time.Duration `json:"gossip_interval"`
+	// The batched strategy sends a peer its waiting values once there are
+	// BatchSize of them or the first has waited BatchFrequency, and holds at
+	// most OutboxLimit per peer before making forwards wait
+	BatchFrequency time.Duration `json:"batch_frequency"`
+	BatchSize      int           `json:"batch_size"`
+	OutboxLimit    int           `json:"outbox_limit"`
+	// Send the integers of a batch as a serialised bitmap, or as varint
+	// deltas, rather than a JSON array, to peers that read them. The smaller
+	// goes when both are on.
+	BatchBitmaps bool `json:"batch_bitmaps"`
+	BatchVarints bool `json:"batch_varints"`
+	// How many failed attempts in a row a peer gets before the values waiting
+	// for it are given up on, never when 0
+	MaxRetry int `json:"max_retry"`
+	// Values waiting for a peer held in memory, the rest wait on disk, no
+	// limit when 0
+	RetryQueueLimit int `json:"retry_queue_limit"`
+	// How long a forward waits for its reply
+	RPCTimeout time.Duration `json:"rpc_timeout"`
+	// The first retry to a peer waits about PeerCopyBackoff, or
+	// BatchRetryBackoff for the batched strategy, and every failure after
+	// doubles it up to RetryBackoffMax
+	PeerCopyBackoff   time.Duration `json:"peer_copy_backoff"`
+	BatchRetryBackoff time.Duration `json:"batch_retry_backoff"`
+	RetryBackoffMax   time.Duration `json:"retry_backoff_max"`
+	// The tree strategies run their RPCs on OutboundWorkers goroutines, at
+	// most OutboundInFlight at once and OutboundPerPeer to a single peer, and
+	// hold back new ones while OutboundQueue are waiting. Workers are only
+	// read at startup.
+	OutboundWorkers  int `json:"outbound_workers"`
+	OutboundInFlight int `json:"outbound_in_flight"`
+	OutboundPerPeer  int `json:"outbound_per_peer"`
+	OutboundQueue    int `json:"outbound_queue"`
+	// A peer's breaker opens when BreakerMinCalls or more of its last
+	// BreakerWindow calls failed, at BreakerFailureRate or worse, and lets a
+	// probe through BreakerOpenTimeout later
+	BreakerWindow      int           `json:"breaker_window"`
+	BreakerMinCalls    int           `json:"breaker_min_calls"`
+	BreakerFailureRate float64       `json:"breaker_failure_rate"`
+	BreakerOpenTimeout time.Duration `json:"breaker_open_timeout"`
+	// How often the tree strategies check whether a parent they lost touch
+	// with is back
+	ParentProbeInterval time.Duration `json:"parent_probe_interval"`
+	// Acknowledge every value back to the node it was broadcast to, sent in
+	// batches every DeliveryAckInterval. A broadcast with wait_for gives up
+	// after DeliveryTimeout. Acknowledgements of a value are passed on for
+	// DeliveryAckTTL after taking it.
+	DeliveryAcks        bool          `json:"delivery_acks"`
+	DeliveryAckInterval time.Duration `json:"delivery_ack_interval"`
+	DeliveryTimeout     time.Duration `json:"delivery_timeout"`
+	DeliveryAckTTL      time.Duration `json:"delivery_ack_ttl"`
+	// A client broadcast is only acknowledged once WriteQuorum nodes, this
+	// one included, have stored it, and fails if that takes over
+	// QuorumTimeout. 1 acknowledges once stored here.
+	WriteQuorum   int           `json:"write_quorum"`
+	QuorumTimeout time.Duration `json:"quorum_timeout"`
+
+	// Where each node keeps its write-ahead log and snapshots, in a directory
+	// named after the node. Values are only kept in memory when empty. Only
+	// read at startup.
+	DataDir string `json:"data_dir"`
+	// When the log is synced: always, interval or never
+	Fsync         string        `json:"fsync"`
+	FsyncInterval time.Duration `json:"fsync_interval"`
+	// How often the log is folded into a snapshot
+	SnapshotInterval time.Duration `json:"snapshot_interval"`
+
+	// Anti-entropy with a random peer every RepairInterval, off when empty.
+	// One of: merkle, bloom, iblt
+	Repair         string        `json:"repair"`
+	RepairInterval time.Duration `json:"repair_interval"`
+	// False positive rate bloom filters are sized for, a false positive is a
+	// value the peer wrongly thinks we have
+	BloomFPRate float64 `json:"bloom_fp_rate"`
+
+	// How often the plumtree strategy announces values to its lazy peers
+	IhaveInterval time.Duration `json:"ihave_interval"`
+	// How long an announced value may take to arrive before its announcer is
+	// grafted into the tree
+	GraftTimeout time.Duration `json:"graft_timeout"`
+
+	// Who a node talks to: static (every node) or hyparview. Only read at
+	// startup.
+	Membership string `json:"membership"`
+	// HyParView view sizes, and how often views are checked and shuffled
+	ActiveView      int           `json:"active_view"`
+	PassiveView     int           `json:"passive_view"`
+	ShuffleInterval time.Duration `json:"shuffle_interval"`
+
+	// none, or swim to stop forwarding to nodes that look down. Only read at
+	// startup.
+	FailureDetector string `json:"failure_detector"`
+	// A node is probed every SwimInterval, given SwimTimeout to ack before
+	// SwimIndirect others are asked to try, and declared dead SuspicionTimeout
+	// after it became suspect
+	SwimInterval     time.Duration `json:"swim_interval"`
+	SwimTimeout      time.Duration `json:"swim_timeout"`
+	SwimIndirect     int           `json:"swim_indirect"`
+	SuspicionTimeout time.Duration `json:"suspicion_timeout"`
+}
+
+// Default returns the values the challenge solutions were tuned with.
+func Default() Config {
+	return Config{
+		GossipInterval:      400 * time.Millisecond,
+		BatchFrequency:      1000 * time.Millisecond,
+		BatchSize:           100,
+		OutboxLimit:         10000,
+		MaxRetry:            0,
+		RetryQueueLimit:     10000,
+		RPCTimeout:          time.Second,
+		PeerCopyBackoff:     time.Second,
+		BatchRetryBackoff:   100 * time.Millisecond,
+		RetryBackoffMax:     5 * time.Second,
+		OutboundWorkers:     16,
+		OutboundInFlight:    16,
+		OutboundPerPeer:     2,
+		OutboundQueue:       1024,
+		BreakerWindow:       20,
+		BreakerMinCalls:     3,
+		BreakerFailureRate:  0.5,
+		BreakerOpenTimeout:  time.Second,
+		ParentProbeInterval: time.Second,
+		DeliveryAckInterval: 100 * time.Millisecond,
+		DeliveryTimeout:     5 * time.Second,
+		DeliveryAckTTL:      time.Minute,
+		WriteQuorum:         1,
+		QuorumTimeout:       time.Second,
+		Fsync:               "always",
+		FsyncInterval:       100 * time.Millisecond,
+		SnapshotInterval:    time.Minute,
+		RepairInterval:      500 * time.Millisecond,
+		BloomFPRate:         0.01,
+		IhaveInterval:       100 * time.Millisecond,
+		GraftTimeout:        500 * time.Millisecond,
+		Membership:          "static",
+		ActiveView:          4,
+		PassiveView:         24,
+		ShuffleInterval:     time.Second,
+		FailureDetector:     "none",
+		SwimInterval:        500 * time.Millisecond,
+		SwimTimeout:         200 * time.Millisecond,
+		SwimIndirect:        3,
+		SuspicionTimeout:    2 * time.Second,
+	}
+}
+
+// Validate reports every field that holds an unusable value.
+func (c Config) Validate() error {
+	var errs []error
+	positive := map[string]time.Duration{
+		"gossip_interval":       c.GossipInterval,
+		"batch_frequency":       c.BatchFrequency,
+		"rpc_timeout":           c.RPCTimeout,
+		"retry_backoff_max":     c.RetryBackoffMax,
+		"breaker_open_timeout":  c.BreakerOpenTimeout,
+		"parent_probe_interval": c.ParentProbeInterval,
+		"delivery_ack_interval": c.DeliveryAckInterval,
+		"delivery_timeout":      c.DeliveryTimeout,
+		"delivery_ack_ttl":      c.DeliveryAckTTL,
+		"quorum_timeout":        c.QuorumTimeout,
+		"fsync_interval":        c.FsyncInterval,
+		"snapshot_interval":     c.SnapshotInterval,
+		"repair_interval":       c.RepairInterval,
+		"ihave_interval":        c.IhaveInterval,
+		"graft_timeout":         c.GraftTimeout,
+		"shuffle_interval":      c.ShuffleInterval,
+		"swim_interval":         c.SwimInterval,
+		"swim_timeout":          c.SwimTimeout,
+		"suspicion_timeout":     c.SuspicionTimeout,
+	}
+	for name, d := range positive {
+		if d <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be positive, got %v", name, d))
+		}
+	}
+	if c.BatchSize < 1 || c.OutboxLimit < c.BatchSize {
+		errs = append(errs, fmt.Errorf("batch_size must be at least 1 and outbox_limit at least batch_size, got %d and %d",
+			c.BatchSize, c.OutboxLimit))
+	}
+	for name, v := range map[string]int{
+		"outbound_workers":   c.OutboundWorkers,
+		"outbound_in_flight": c.OutboundInFlight,
+		"outbound_per_peer":  c.OutboundPerPeer,
+		"outbound_queue":     c.OutboundQueue,
+	} {
+		if v < 1 {
+			errs = append(errs, fmt.Errorf("%s must be at least 1, got %d", name, v))
+		}
+	}
+	if c.BreakerWindow < 1 || c.BreakerMinCalls < 1 || c.BreakerMinCalls > c.BreakerWindow {
+		errs = append(errs, fmt.Errorf("breaker_min_calls must be 1 to breaker_window, got %d and %d",
+			c.BreakerMinCalls, c.BreakerWindow))
+	}
+	if c.BreakerFailureRate <= 0 || c.BreakerFailureRate > 1 {
+		errs = append(errs, fmt.Errorf("breaker_failure_rate must be in (0, 1], got %v", c.BreakerFailureRate))
+	}
+	if c.RetryQueueLimit < 0 {
+		errs = append(errs, fmt.Errorf("retry_queue_limit can't be negative, got %d", c.RetryQueueLimit))
+	}
+	if c.WriteQuorum < 1 {
+		errs = append(errs, fmt.Errorf("write_quorum must be at least 1, got %d", c.WriteQuorum))
+	}
+	if c.MaxRetry < 0 {
+		errs = append(errs, fmt.Errorf("max_retry can't be negative, got %d", c.MaxRetry))
+	}
+	if c.PeerCopyBackoff < 0 || c.BatchRetryBackoff < 0 {
+		errs = append(errs, errors.New("backoffs can't be negative"))
+	}
+	switch c.Fsync {
+	case "always", "interval", "never":
+	default:
+		errs = append(errs, fmt.Errorf("fsync must be always, interval or never, got %q", c.Fsync))
+	}
+	switch c.Repair {
+	case "", "merkle", "bloom", "iblt":
+	default:
+		errs = append(errs, fmt.Errorf("repair must be empty, merkle, bloom or iblt, got %q", c.Repair))
+	}
+	switch c.Membership {
+	case "static", "hyparview":
+	default:
+		errs = append(errs, fmt.Errorf("membership must be static or hyparview, got %q", c.Membership))
+	}
+	switch c.FailureDetector {
+	case "none", "swim":
+	default:
+		errs = append(errs, fmt.Errorf("failure_detector must be none or swim, got %q", c.FailureDetector))
+	}
+	if c.SwimIndirect < 0 {
+		errs = append(errs, fmt.Errorf("swim_indirect can't be negative, got %d", c.SwimIndirect))
+	}
+	if c.ActiveView < 1 || c.PassiveView < 1 {
+		errs = append(errs, errors.New("active_view and passive_view must be at least 1"))
+	}
+	if c.BloomFPRate <= 0 || c.BloomFPRate >= 1 {
+		errs = append(errs, fmt.Errorf("bloom_fp_rate must be between 0 and 1, got %v", c.BloomFPRate))
+	}
+	return errors.Join(errs...)
+}
+
+// MarshalJSON writes durations the way they are parsed, e.g. "400ms".
+func (c Config) MarshalJSON() ([]byte, error) {
+	out := make(map[string]any)
+	v := reflect.ValueOf(c)
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if d, ok := field.Interface().(time.Duration); ok {
+			out[name(v.Type().Field(i))] = d.String()
+			continue
+		}
+		out[name(v.Type().Field(i))] = field.Interface()
+	}
+	return json.Marshal(out)
+}
+
+// Set changes one field, by its json name, from its text form.
+func (c *Config) Set(key, text string) error {
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if name(v.Type().Field(i)) != key {
+			continue
+		}
+		field := v.Field(i)
+		switch field.Interface().(type) {
+		case time.Duration:
+			d, err := time.ParseDuration(text)
+			if err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			field.SetInt(int64(d))
+		case int:
+			n, err := strconv.Atoi(text)
+			if err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			field.SetInt(int64(n))
+		case bool:
+			b, err := strconv.ParseBool(text)
+			if err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			field.SetBool(b)
+		case float64:
+			f, err := strconv.ParseFloat(text, 64)
+			if err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+			field.SetFloat(f)
+		case string:
+			field.SetString(text)
+		default:
+			return fmt.Errorf("%s: unsupported type %s", key, field.Type())
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown config key %q", key)
+}
+
+// Patch applies the fields present in a JSON object, like a config file or
+// the body of update_config.
+func (c *Config) Patch(raw map[string]json.RawMessage) error {
+	for key, value := range raw {
+		var text string
+		if err := json.Unmarshal(value, &text); err != nil {
+			// Not a string, use the literal (numbers, booleans)
+			text = string(value)
+		}
+		if err := c.Set(key, text); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Keys lists the json names of all fields.
+func Keys() []string {
+	t := reflect.TypeOf(Config{})
+	keys := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		keys = append(keys, name(t.Field(i)))
+	}
+	return keys
+}
+
+func name(f reflect.StructField) string {
+	tag, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+	return tag
+}
+
+// Store is the live configuration of a node.
+type Store struct {
+	// Held across an update and its subscribers, so they see updates in
+	// the order they were made
+	update      sync.Mutex
+	mu          sync.RWMutex
+	cfg         Config
+	subscribers []func(old, cur Config)
+}
+
+func NewStore(cfg Config) *Store {
+	return &Store{cfg: cfg}
+}
+
+// Get returns the current configuration. Retry loops should call it on every
+// attempt rather than keeping a copy, so updates reach them.
+func (s *Store) Get() Config {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cfg
+}
+
+// Subscribe calls fn after every successful update, one update at a time.
+// fn must not update the configuration itself.
+func (s *Store) Subscribe(fn func(old, cur Config)) {
+	s.mu.Lock()
+	s.subscribers = append(s.subscribers, fn)
+	s.mu.Unlock()
+}
+
+// Update applies a partial configuration, all or nothing, and returns once
+// every subscriber has seen it.
+func (s *Store) Update(raw map[string]json.RawMessage) (Config, error) {
+	s.update.Lock()
+	defer s.update.Unlock()
+	s.mu.Lock()
+	old := s.cfg
+	cur := old
+	if err := cur.Patch(raw); err != nil {
+		s.mu.Unlock()
+		return old, err
+	}
+	if err := cur.Validate(); err != nil {
+		s.mu.Unlock()
+		return old, err
+	}
+	s.cfg = cur
+	subscribers := append([]func(old, cur Config){}, s.subscribers...)
+	s.mu.Unlock()
+
+	for _, fn := range subscribers {
+		fn(old, cur)
+	}
+	return cur, nil
+}
+
+// Load builds the configuration from the defaults, config file, environment
+// and the flags it registers on fs, parsing args.
+func Load(fs *flag.FlagSet, args []string) (*Store, error) {
+	file := fs.String("config", os.Getenv(EnvFile), "JSON config file")
+	flagKeys := make(map[string]string)
+	defaults := reflect.ValueOf(Default())
+	for i, key := range Keys() {
+		text := fmt.Sprint(defaults.Field(i).Interface()) // time.Duration prints as it parses
+		flagName := strings.ReplaceAll(key, "_", "-")
+		fs.String(flagName, text, key)
+		flagKeys[flagName] = key
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := Default()
+	if *file != "" {
+		buf, err := os.ReadFile(*file)
+		if err != nil {
+			return nil, err
+		}
+		var raw map[string]json.RawMessage
+		if err := json.Unmarshal(buf, &raw); err != nil {
+			return nil, fmt.Errorf("%s: %w", *file, err)
+		}
+		if err := cfg.Patch(raw); err != nil {
+			return nil, fmt.Errorf("%s: %w", *file, err)
+		}
+	}
+
+	for _, key := range Keys() {
+		if text, ok := os.LookupEnv("GLOMERS_" + strings.ToUpper(key)); ok {
+			if err := cfg.Set(key, text); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Only the flags given on the command line, the rest are just defaults
+	var err error
+	fs.Visit(func(f *flag.Flag) {
+		key, ok := flagKeys[f.Name]
+		if !ok || err != nil {
+			return // Not one of ours, the caller may have flags of its own
+		}
+		err = cfg.Set(key, f.Value.String())
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return NewStore(cfg), nil
+}
+
+// Handle registers update_config on n.
+//
+//	Request
+//	{
+//	  "type": "update_config",
+//	  "config": {"batch_frequency": "200ms", "max_retry": 10}
+//	}
+//
+//	Response
+//	{
+//	  "type": "update_config_ok",
+//	  "config": {... the whole configuration now in use ...}
+//	}
+func (s *Store) Handle(n *maelstrom.Node) {
+	n.Handle("update_config", func(msg maelstrom.Message) error {
+		var body struct {
+			Config map[string]json.RawMessage `json:"config"`
+		}
+		if err := json.Unmarshal(msg.Body, &body); err != nil {
+			return err
+		}
+
+		cfg, err := s.Update(body.Config)
+		if err != nil {
+			return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
+		}
+		updated, _ := json.Marshal(cfg)
+		logging.WithMsg(logger, msg).Info("Config updated", "config", string(updated))
+
+		return node.Reply(n, msg, map[string]any{
+			"type":   "update_config_ok",
+			"config": cfg,
+		})
+	})
+}
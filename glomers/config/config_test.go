@@ -0,0 +1,155 @@
+package config
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Each source overrides the ones before it: defaults, the file, the
+// environment, then the flags given on the command line.
+func TestLoadPrecedence(t *testing.T) {
+	tests := []struct {
+		name       string
+		file       string // Contents of the config file, none when empty
+		env        map[string]string
+		args       []string
+		wantGossip time.Duration
+		wantBatch  int
+		wantErr    bool
+	}{
+		{name: "defaults", wantGossip: 400 * time.Millisecond, wantBatch: 100},
+		{name: "file", file: `{"gossip_interval": "1s", "batch_size": 50}`,
+			wantGossip: time.Second, wantBatch: 50},
+		{name: "environment over file", file: `{"gossip_interval": "1s", "batch_size": 50}`,
+			env:        map[string]string{"GLOMERS_GOSSIP_INTERVAL": "2s"},
+			wantGossip: 2 * time.Second, wantBatch: 50},
+		{name: "flag over environment", file: `{"gossip_interval": "1s", "batch_size": 50}`,
+			env:        map[string]string{"GLOMERS_GOSSIP_INTERVAL": "2s"},
+			args:       []string{"--gossip-interval=3s"},
+			wantGossip: 3 * time.Second, wantBatch: 50},
+		{name: "flag defaults don't override", env: map[string]string{"GLOMERS_BATCH_SIZE": "7"},
+			args:       []string{"--gossip-interval=3s"},
+			wantGossip: 3 * time.Second, wantBatch: 7},
+		{name: "unreadable file", file: `{"batch_size": 50`, wantErr: true},
+		{name: "unknown key in file", file: `{"batch_sise": 50}`, wantErr: true},
+		{name: "bad environment value", env: map[string]string{"GLOMERS_BATCH_SIZE": "many"}, wantErr: true},
+		{name: "bad flag value", args: []string{"--gossip-interval=soon"}, wantErr: true},
+		{name: "invalid result", file: `{"batch_size": 50}`, args: []string{"--batch-size=0"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(EnvFile, "")
+			if tt.file != "" {
+				path := filepath.Join(t.TempDir(), "config.json")
+				if err := os.WriteFile(path, []byte(tt.file), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				t.Setenv(EnvFile, path)
+			}
+			for key, value := range tt.env {
+				t.Setenv(key, value)
+			}
+
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.SetOutput(io.Discard)
+			s, err := Load(fs, tt.args)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("loaded %+v, want an error", s.Get())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			if got := s.Get(); got.GossipInterval != tt.wantGossip || got.BatchSize != tt.wantBatch {
+				t.Errorf("gossip_interval %v and batch_size %d, want %v and %d",
+					got.GossipInterval, got.BatchSize, tt.wantGossip, tt.wantBatch)
+			}
+		})
+	}
+}
+
+// update_config applies all of a patch or none of it, and only tells
+// subscribers about the former.
+func TestUpdate(t *testing.T) {
+	tests := []struct {
+		name      string
+		patch     string
+		wantBatch int
+		wantErr   bool
+	}{
+		{"number", `{"batch_size": 20}`, 20, false},
+		{"string", `{"batch_size": "30"}`, 30, false},
+		{"other fields kept", `{"gossip_interval": "1s"}`, 100, false},
+		{"unknown key", `{"batch_size": 20, "batch_sise": 20}`, 100, true},
+		{"bad value", `{"batch_size": 20, "gossip_interval": "soon"}`, 100, true},
+		{"invalid result", `{"batch_size": 20, "outbox_limit": 10}`, 100, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewStore(Default())
+			notified := 0
+			s.Subscribe(func(old, cur Config) {
+				notified++
+				if old.BatchSize != 100 || cur.BatchSize != tt.wantBatch {
+					t.Errorf("subscriber got batch_size %d to %d, want 100 to %d", old.BatchSize, cur.BatchSize, tt.wantBatch)
+				}
+			})
+			var raw map[string]json.RawMessage
+			if err := json.Unmarshal([]byte(tt.patch), &raw); err != nil {
+				t.Fatal(err)
+			}
+			_, err := s.Update(raw)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Update: %v, want an error %v", err, tt.wantErr)
+			}
+			if got := s.Get().BatchSize; got != tt.wantBatch {
+				t.Errorf("batch_size %d, want %d", got, tt.wantBatch)
+			}
+			if want := map[bool]int{false: 1, true: 0}[tt.wantErr]; notified != want {
+				t.Errorf("subscriber called %d times, want %d", notified, want)
+			}
+		})
+	}
+}
+
+// Concurrent updates reach a subscriber one at a time, each starting from
+// the configuration the one before left.
+func TestUpdateOrder(t *testing.T) {
+	s := NewStore(Default())
+	var mu sync.Mutex
+	last := s.Get().BatchSize
+	s.Subscribe(func(old, cur Config) {
+		// A slow subscriber, for updates to pile up behind
+		time.Sleep(100 * time.Microsecond)
+		mu.Lock()
+		defer mu.Unlock()
+		if old.BatchSize != last {
+			t.Errorf("update from batch_size %d, the last one seen was %d", old.BatchSize, last)
+		}
+		last = cur.BatchSize
+	})
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 50; i++ {
+		wg.Add(1)
+		go func(size int) {
+			defer wg.Done()
+			if _, err := s.Update(map[string]json.RawMessage{"batch_size": json.RawMessage(fmt.Sprint(size))}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if last != s.Get().BatchSize {
+		t.Errorf("subscriber last saw batch_size %d, the store has %d", last, s.Get().BatchSize)
+	}
+}
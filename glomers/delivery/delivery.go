@@ -0,0 +1,454 @@
+// Package delivery tells the node a client broadcast a value to, its origin,
+// when every node holds the value. With DeliveryAcks on, a node that takes a
+// new value from a peer acknowledges it to that peer, which passes the
+// acknowledgement on to whoever it took the value from in turn, so
+// acknowledgements flow back up the dissemination tree to the origin. They
+// are batched per peer every DeliveryAckInterval
+//
+//	{"type": "delivered", "acks": {"n3": [7, 8], "n4": [7]}}
+//
+// and not replied to, split so each stays under ackBytes. The origin answers
+// delivery_status for its values, and a broadcast carrying "wait_for": "all"
+// or "quorum" is only acknowledged to the client once that many nodes hold
+// the value.
+//
+// Tracking is in memory, an acknowledgement lost to a crash or a partition
+// leaves its node pending. So does one arriving more than DeliveryAckTTL
+// after we took the value, as who we took it from is forgotten by then. A
+// value every node holds is forgotten as soon as no broadcast waits on it,
+// but for the last rememberDelivered of them, and one some node never
+// acknowledges once DeliveryTimeout is up and no broadcast waits on it.
+//
+// A client may broadcast a value this node took from a peer first. That
+// peer, or whichever node it came from, is its origin and tracks it, and a
+// wait_for here reports it delivered rather than failing.
+package delivery
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+
+	"glomers/clock"
+	"glomers/config"
+	"glomers/logging"
+	"glomers/metrics"
+	"glomers/node"
+	"glomers/store"
+)
+
+var logger = logging.Component("delivery")
+
+const (
+	// Bytes of acknowledgements per delivered, Maelstrom's Go node can't read
+	// a line over 64KB
+	ackBytes = 48 << 10
+	// Values every node holds still answered for by delivery_status
+	rememberDelivered = 10000
+)
+
+// Tracker passes on the acknowledgements of a node, and counts those of the
+// values it is the origin of.
+type Tracker struct {
+	n   *maelstrom.Node
+	cfg *config.Store
+
+	mu sync.Mutex
+	// Who each value we took from a peer came from, and the values in the
+	// order we took them, to forget them by
+	from      map[store.Value]string
+	fromOrder []taken
+	// Values that were broadcast to us, and in the order they were, to give
+	// up on them by
+	origins     map[store.Value]*origin
+	originOrder []taken
+	// When the last values every node holds were broadcast to us, and those
+	// values in the order they got everywhere
+	delivered      map[store.Value]time.Time
+	deliveredOrder []store.Value
+	// Acknowledgements to send each peer at the next flush, by the node that
+	// holds the values
+	outbox map[string]map[string][]store.Value
+}
+
+type taken struct {
+	v  store.Value
+	at time.Time
+}
+
+type origin struct {
+	acked map[string]struct{}
+	since time.Time
+	// Closed and replaced whenever a node acknowledges
+	changed chan struct{}
+	// Awaits blocked on it, it isn't forgotten while there are any
+	waiters int
+	// Older than DeliveryTimeout, dropped once no Await waits on it
+	expired bool
+}
+
+// Register registers delivered and delivery_status, and starts sending
+// acknowledgements.
+func Register(n *maelstrom.Node, cfg *config.Store) *Tracker {
+	t := &Tracker{
+		n:         n,
+		cfg:       cfg,
+		from:      make(map[store.Value]string),
+		origins:   make(map[store.Value]*origin),
+		delivered: make(map[store.Value]time.Time),
+		outbox:    make(map[string]map[string][]store.Value),
+	}
+	n.Handle("delivered", t.deliveredHandler)
+	n.Handle("delivery_status", t.statusHandler)
+
+	ticker := clock.NewTicker(cfg.Get().DeliveryAckInterval)
+	cfg.Subscribe(func(old, cur config.Config) {
+		if cur.DeliveryAckInterval != old.DeliveryAckInterval {
+			ticker.Reset(cur.DeliveryAckInterval)
+		}
+	})
+	go func() {
+		for range ticker.C() {
+			t.flush()
+		}
+	}()
+	return t
+}
+
+func (t *Tracker) enabled() bool {
+	return t.cfg.Get().DeliveryAcks
+}
+
+// Originated records values a client broadcast to this node, which holds
+// them already. Those it took from a peer first are tracked by their origin.
+func (t *Tracker) Originated(values ...store.Value) {
+	if !t.enabled() || len(values) == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := clock.Now()
+	for _, v := range values {
+		if _, ok := t.origins[v]; ok {
+			continue
+		}
+		if _, ok := t.from[v]; ok {
+			continue
+		}
+		if _, ok := t.delivered[v]; ok {
+			continue
+		}
+		t.origins[v] = &origin{
+			acked:   map[string]struct{}{t.n.ID(): {}},
+			since:   now,
+			changed: make(chan struct{}),
+		}
+		t.originOrder = append(t.originOrder, taken{v: v, at: now})
+	}
+}
+
+// Received records values this node took from peer, and acknowledges them
+// to it.
+func (t *Tracker) Received(peer string, values []store.Value) {
+	if !t.enabled() || len(values) == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := clock.Now()
+	for _, v := range values {
+		if _, ok := t.from[v]; ok {
+			continue
+		}
+		if _, ok := t.origins[v]; ok {
+			continue
+		}
+		t.from[v] = peer
+		t.fromOrder = append(t.fromOrder, taken{v: v, at: now})
+		t.queue(peer, t.n.ID(), v)
+	}
+}
+
+// expire forgets who we took the values older than DeliveryAckTTL from, and
+// gives up on values broadcast to us longer than DeliveryTimeout ago, t.mu
+// must be held.
+func (t *Tracker) expire() {
+	cfg, now := t.cfg.Get(), clock.Now()
+	cutoff := now.Add(-cfg.DeliveryAckTTL)
+	n := 0
+	for n < len(t.fromOrder) && t.fromOrder[n].at.Before(cutoff) {
+		delete(t.from, t.fromOrder[n].v)
+		n++
+	}
+	t.fromOrder = t.fromOrder[n:]
+
+	cutoff = now.Add(-cfg.DeliveryTimeout)
+	n = 0
+	for n < len(t.originOrder) && t.originOrder[n].at.Before(cutoff) {
+		v := t.originOrder[n].v
+		// Delivered values are gone already, or tracked again since
+		if o, ok := t.origins[v]; ok && o.since.Equal(t.originOrder[n].at) {
+			o.expired = true
+			t.forget(v, o)
+		}
+		n++
+	}
+	t.originOrder = t.originOrder[n:]
+}
+
+// queue adds an acknowledgement that node holds v to the next flush to peer,
+// t.mu must be held.
+func (t *Tracker) queue(peer, node string, v store.Value) {
+	acks, ok := t.outbox[peer]
+	if !ok {
+		acks = make(map[string][]store.Value)
+		t.outbox[peer] = acks
+	}
+	acks[node] = append(acks[node], v)
+}
+
+// ack records that node holds v, or passes it on toward v's origin, t.mu
+// must be held.
+func (t *Tracker) ack(node string, v store.Value) {
+	if o, ok := t.origins[v]; ok {
+		if _, ok := o.acked[node]; ok {
+			return
+		}
+		o.acked[node] = struct{}{}
+		close(o.changed)
+		o.changed = make(chan struct{})
+		if len(o.acked) == len(t.n.NodeIDs()) {
+			metrics.Since("delivery_seconds", o.since)
+			t.forget(v, o)
+		}
+		return
+	}
+	if peer, ok := t.from[v]; ok {
+		t.queue(peer, node, v)
+		return
+	}
+	logger.Debug("Dropping acknowledgement of a value we don't know", "node", node, "message", v)
+}
+
+// forget drops v once no Await waits on it, if every node holds it or it
+// expired, and remembers when it was broadcast if delivered, t.mu must be
+// held.
+func (t *Tracker) forget(v store.Value, o *origin) {
+	if o.waiters > 0 {
+		return
+	}
+	if len(o.acked) < len(t.n.NodeIDs()) {
+		if o.expired {
+			delete(t.origins, v)
+			metrics.Inc("delivery_expired_total")
+		}
+		return
+	}
+	delete(t.origins, v)
+	t.delivered[v] = o.since
+	t.deliveredOrder = append(t.deliveredOrder, v)
+	if len(t.deliveredOrder) > rememberDelivered {
+		delete(t.delivered, t.deliveredOrder[0])
+		t.deliveredOrder = t.deliveredOrder[1:]
+	}
+}
+
+func (t *Tracker) flush() {
+	t.mu.Lock()
+	t.expire()
+	outbox := t.outbox
+	t.outbox = make(map[string]map[string][]store.Value)
+	t.mu.Unlock()
+
+	for peer, acks := range outbox {
+		for _, chunk := range split(acks) {
+			if err := t.n.Send(peer, map[string]any{
+				"type": "delivered",
+				"acks": chunk,
+			}); err != nil {
+				logger.Warn("Error sending acknowledgements", "dst", peer, "err", err)
+			}
+		}
+	}
+}
+
+// split breaks acks up into parts of about ackBytes at most.
+func split(acks map[string][]store.Value) []map[string][]store.Value {
+	nodes := make([]string, 0, len(acks))
+	for node := range acks {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+
+	var parts []map[string][]store.Value
+	part, size := make(map[string][]store.Value), 0
+	for _, node := range nodes {
+		for _, v := range acks[node] {
+			if size > 0 && size+len(node)+len(v)+8 > ackBytes {
+				parts = append(parts, part)
+				part, size = make(map[string][]store.Value), 0
+			}
+			if _, ok := part[node]; !ok {
+				size += len(node) + 6
+			}
+			part[node] = append(part[node], v)
+			size += len(v) + 2
+		}
+	}
+	if size > 0 {
+		parts = append(parts, part)
+	}
+	return parts
+}
+
+func (t *Tracker) deliveredHandler(msg maelstrom.Message) error {
+	var body struct {
+		Acks map[string][]store.Value `json:"acks"`
+	}
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for node, values := range body.Acks {
+		for _, v := range values {
+			t.ack(node, v)
+		}
+	}
+	return nil
+}
+
+// needed is how many nodes must hold a value for waitFor.
+func (t *Tracker) needed(waitFor string) (int, error) {
+	nodes := len(t.n.NodeIDs())
+	switch waitFor {
+	case "all":
+		return nodes, nil
+	case "quorum":
+		return nodes/2 + 1, nil
+	default:
+		return 0, maelstrom.NewRPCError(maelstrom.MalformedRequest,
+			fmt.Sprintf("wait_for must be all or quorum, got %q", waitFor))
+	}
+}
+
+// Await blocks until as many nodes as waitFor asks for hold v, which was
+// broadcast to this node, or fails after DeliveryTimeout. That is a crash
+// error, which is as indefinite as a timeout but keeps its code on the wire.
+// A v this node took from a peer is delivered as far as it can tell, its
+// origin waits for the acknowledgements.
+func (t *Tracker) Await(v store.Value, waitFor string) error {
+	if !t.enabled() {
+		return maelstrom.NewRPCError(maelstrom.NotSupported, "wait_for needs delivery_acks")
+	}
+	need, err := t.needed(waitFor)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	o, ok := t.origins[v]
+	if !ok {
+		_, delivered := t.delivered[v]
+		_, relayed := t.from[v]
+		t.mu.Unlock()
+		if delivered || relayed {
+			return nil
+		}
+		return maelstrom.NewRPCError(maelstrom.PreconditionFailed,
+			fmt.Sprintf("%s wasn't broadcast to this node", v))
+	}
+	o.waiters++
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		o.waiters--
+		t.forget(v, o)
+	}()
+
+	timeout := clock.After(t.cfg.Get().DeliveryTimeout)
+	for {
+		t.mu.Lock()
+		acked, changed := len(o.acked), o.changed
+		t.mu.Unlock()
+		if acked >= need {
+			return nil
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			return maelstrom.NewRPCError(maelstrom.Crash,
+				fmt.Sprintf("%s reached %d of the %d nodes %s needs", v, acked, need, waitFor))
+		}
+	}
+}
+
+// statusHandler tells which nodes hold a value broadcast to this node, and
+// which are still pending.
+//
+//	Request
+//	{
+//	  "type": "delivery_status",
+//	  "message": 7
+//	}
+//
+//	Response
+//	{
+//	  "type": "delivery_status_ok",
+//	  "message": 7,
+//	  "delivered": false,
+//	  "quorum": true,
+//	  "acked": ["n0", "n1", "n3"],
+//	  "pending": ["n2", "n4"],
+//	  "age_seconds": 0.42
+//	}
+func (t *Tracker) statusHandler(msg maelstrom.Message) error {
+	var body struct {
+		Message store.Value `json:"message"`
+	}
+	if err := json.Unmarshal(msg.Body, &body); err != nil || body.Message == "" {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, "delivery_status needs a message")
+	}
+	if !t.enabled() {
+		return maelstrom.NewRPCError(maelstrom.NotSupported, "delivery_status needs delivery_acks")
+	}
+
+	t.mu.Lock()
+	acked, pending := []string{}, []string{}
+	var age float64
+	if o, ok := t.origins[body.Message]; ok {
+		for _, node := range t.n.NodeIDs() {
+			if _, ok := o.acked[node]; ok {
+				acked = append(acked, node)
+			} else {
+				pending = append(pending, node)
+			}
+		}
+		age = clock.Since(o.since).Seconds()
+	} else if since, ok := t.delivered[body.Message]; ok {
+		acked = append(acked, t.n.NodeIDs()...)
+		age = clock.Since(since).Seconds()
+	} else {
+		t.mu.Unlock()
+		return maelstrom.NewRPCError(maelstrom.KeyDoesNotExist,
+			fmt.Sprintf("%s wasn't broadcast to this node, was given up on, or was delivered long ago", body.Message))
+	}
+	t.mu.Unlock()
+	sort.Strings(acked)
+	sort.Strings(pending)
+
+	quorum, _ := t.needed("quorum")
+	return node.Reply(t.n, msg, map[string]any{
+		"type":        "delivery_status_ok",
+		"message":     body.Message,
+		"delivered":   len(pending) == 0,
+		"quorum":      len(acked) >= quorum,
+		"acked":       acked,
+		"pending":     pending,
+		"age_seconds": age,
+	})
+}
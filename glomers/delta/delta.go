@@ -0,0 +1,56 @@
+// Package delta packs sorted integers as the gaps between them, each a
+// varint, which takes a byte per value while they are less than 128 apart:
+//
+//	varint     the first value, zigzag encoded
+//	uvarint    every next value, minus the one before minus one
+package delta
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var errShort = errors.New("delta: truncated")
+
+// Encode packs values, which must be sorted ascending without duplicates.
+func Encode(values []int64) []byte {
+	buf := make([]byte, 0, len(values)+binary.MaxVarintLen64)
+	for i, v := range values {
+		if i == 0 {
+			buf = binary.AppendVarint(buf, v)
+			continue
+		}
+		buf = binary.AppendUvarint(buf, uint64(v)-uint64(values[i-1])-1)
+	}
+	return buf
+}
+
+// Decode unpacks what Encode packed.
+func Decode(data []byte) ([]int64, error) {
+	var values []int64
+	if len(data) == 0 {
+		return values, nil
+	}
+	first, n := binary.Varint(data)
+	if n <= 0 {
+		return nil, errShort
+	}
+	values = append(values, first)
+	data = data[n:]
+	for len(data) > 0 {
+		gap, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, errShort
+		}
+		data = data[n:]
+		// Flipping the sign bit orders values as unsigned, the next one
+		// must stay below the largest
+		prev := uint64(values[len(values)-1]) ^ 1<<63
+		if gap >= ^prev {
+			return nil, fmt.Errorf("delta: gap %d past the largest value", gap)
+		}
+		values = append(values, int64((prev+gap+1)^1<<63))
+	}
+	return values, nil
+}
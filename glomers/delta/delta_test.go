@@ -0,0 +1,97 @@
+package delta
+
+import (
+	"encoding/binary"
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []int64
+	}{
+		{"empty", []int64{}},
+		{"zero", []int64{0}},
+		{"min", []int64{math.MinInt64}},
+		{"max", []int64{math.MaxInt64}},
+		{"min and max", []int64{math.MinInt64, math.MaxInt64}},
+		{"around zero", []int64{-2, -1, 0, 1, 2}},
+		{"up to max", []int64{math.MaxInt64 - 2, math.MaxInt64 - 1, math.MaxInt64}},
+		{"from min", []int64{math.MinInt64, math.MinInt64 + 1, math.MinInt64 + 1000}},
+		{"wide gaps", []int64{math.MinInt64 / 2, -1, 1 << 40, math.MaxInt64 / 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Decode(Encode(tt.values))
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			if !slices.Equal(got, tt.values) {
+				t.Errorf("got %v, want %v", got, tt.values)
+			}
+		})
+	}
+}
+
+// The gap guard keeps a decoded value from wrapping past MaxInt64 back to
+// negatives, which would break the ascending order Encode promises.
+func TestDecodeGapOverflow(t *testing.T) {
+	after := func(first int64, gaps ...uint64) []byte {
+		buf := binary.AppendVarint(nil, first)
+		for _, gap := range gaps {
+			buf = binary.AppendUvarint(buf, gap)
+		}
+		return buf
+	}
+	tests := []struct {
+		name string
+		data []byte
+		want []int64 // nil when it must fail
+	}{
+		{"gap reaching max", after(math.MaxInt64-1, 0), []int64{math.MaxInt64 - 1, math.MaxInt64}},
+		{"gap past max", after(math.MaxInt64-1, 1), nil},
+		{"anything after max", after(math.MaxInt64, 0), nil},
+		{"min to max in one gap", after(math.MinInt64, math.MaxUint64-1), []int64{math.MinInt64, math.MaxInt64}},
+		{"min past max in one gap", after(math.MinInt64, math.MaxUint64), nil},
+		{"negative to max", after(-1, math.MaxInt64), []int64{-1, math.MaxInt64}},
+		{"negative past max", after(-1, 1<<63), nil},
+		{"overflow after a few", after(0, 0, 0, math.MaxInt64), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Decode(tt.data)
+			if tt.want == nil {
+				if err == nil {
+					t.Fatalf("got %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"first value", []byte{0x80}},
+		{"gap", append(Encode([]int64{1, 2}), 0x80)},
+		{"varint too long", []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := Decode(tt.data); err == nil {
+				t.Errorf("got %v, want an error", got)
+			}
+		})
+	}
+}
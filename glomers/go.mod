@@ -0,0 +1,9 @@
+module glomers
+
+go 1.21.5
+
+require (
+	github.com/emirpasic/gods v1.18.1
+	github.com/jepsen-io/maelstrom/demo/go v0.0.0-20231231190402-2674df7c1076
+	golang.org/x/exp v0.0.0-20240119083558-1b970713d09a
+)
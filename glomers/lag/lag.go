@@ -0,0 +1,265 @@
+// Package lag tracks how far behind each peer is: how many of the values this
+// node knows the peer hasn't acknowledged yet, and how long the oldest of them
+// has been waiting. A peer acknowledges a value by taking it from us or by
+// sending it to us, however the strategy does that. Asked with
+//
+//	{"type": "lag"}
+//
+// every neighbour's lag is reported.
+package lag
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+
+	"glomers/clock"
+	"glomers/metrics"
+	"glomers/store"
+)
+
+// Peers is who lag reports on unless told the neighbours, like a
+// membership.Membership.
+type Peers interface {
+	Peers() []string
+}
+
+// Tracker holds the lag of every peer.
+type Tracker struct {
+	n     *maelstrom.Node
+	peers Peers
+
+	mu         sync.Mutex
+	neighbours func() []string
+	// Every value we know, in the order we learnt of it, and where it is
+	known []value
+	index map[store.Value]int
+	lags  map[string]*peer
+}
+
+type value struct {
+	v  store.Value
+	at time.Time
+}
+
+type peer struct {
+	// Every value before cursor in known is acknowledged
+	cursor int
+	// Acknowledged values at or after cursor, or not known to us yet
+	acked map[store.Value]struct{}
+	// Acknowledged values among known, wherever they are
+	count int
+	last  time.Time
+}
+
+// Lag is how far behind a peer is.
+type Lag struct {
+	Unacked int `json:"unacked"`
+	// Since the oldest unacknowledged value became known, 0 when there is none
+	OldestAge float64 `json:"oldest_age_seconds"`
+	// When the peer last acknowledged anything, RFC 3339
+	LastAck string `json:"last_ack,omitempty"`
+}
+
+// Register registers lag.
+func Register(n *maelstrom.Node, peers Peers) *Tracker {
+	t := &Tracker{n: n, peers: peers, index: make(map[store.Value]int), lags: make(map[string]*peer)}
+	n.Handle("lag", t.lagHandler)
+	return t
+}
+
+// Neighbours makes lag report on whoever fn returns, the peers a strategy
+// sends values to, rather than on every peer.
+func (t *Tracker) Neighbours(fn func() []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.neighbours = fn
+}
+
+// Known records values this node has, skipping those it already had.
+func (t *Tracker) Known(values []store.Value) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := clock.Now()
+	for _, v := range values {
+		if _, ok := t.index[v]; ok {
+			continue
+		}
+		t.index[v] = len(t.known)
+		t.known = append(t.known, value{v: v, at: now})
+		for _, p := range t.lags {
+			if _, ok := p.acked[v]; ok {
+				p.count++
+			}
+		}
+	}
+	for _, p := range t.lags {
+		t.advance(p)
+	}
+}
+
+// Acked records that peer has values.
+func (t *Tracker) Acked(peer string, values []store.Value) {
+	if len(values) == 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p := t.peer(peer)
+	for _, v := range values {
+		if _, ok := p.acked[v]; ok {
+			continue
+		}
+		i, known := t.index[v]
+		if known && i < p.cursor {
+			continue
+		}
+		p.acked[v] = struct{}{}
+		if known {
+			p.count++
+		}
+	}
+	p.last = clock.Now()
+	t.advance(p)
+}
+
+// Pending returns up to limit of the values peer hasn't acknowledged that
+// we have known for at least age, oldest first.
+func (t *Tracker) Pending(peer string, age time.Duration, limit int) []store.Value {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p := t.peer(peer)
+	cutoff := clock.Now().Add(-age)
+	var out []store.Value
+	for _, v := range t.known[p.cursor:] {
+		if len(out) == limit || v.at.After(cutoff) {
+			break
+		}
+		if _, ok := p.acked[v.v]; !ok {
+			out = append(out, v.v)
+		}
+	}
+	return out
+}
+
+// Lag returns how far behind peer is.
+func (t *Tracker) Lag(peer string) Lag {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.lag(t.peer(peer))
+}
+
+// Unacked returns how many values peer hasn't acknowledged.
+func (t *Tracker) Unacked(peer string) int {
+	return t.Lag(peer).Unacked
+}
+
+// Lags returns the lag of every neighbour.
+func (t *Tracker) Lags() map[string]Lag {
+	t.mu.Lock()
+	neighbours := t.neighbours
+	t.mu.Unlock()
+	var peers []string
+	if neighbours != nil {
+		peers = neighbours()
+	} else {
+		peers = t.peers.Peers()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make(map[string]Lag, len(peers))
+	for _, peer := range peers {
+		out[peer] = t.lag(t.peer(peer))
+	}
+	return out
+}
+
+// peer returns peer's lag, creating it, t.mu must be held.
+func (t *Tracker) peer(name string) *peer {
+	p, ok := t.lags[name]
+	if !ok {
+		p = &peer{acked: make(map[store.Value]struct{})}
+		t.lags[name] = p
+		metrics.Gauge("replication_lag_values", func() float64 {
+			return float64(t.Unacked(name))
+		}, "peer", name)
+		metrics.Gauge("replication_lag_seconds", func() float64 {
+			return t.Lag(name).OldestAge
+		}, "peer", name)
+	}
+	return p
+}
+
+// advance moves p's cursor past the values it acknowledged, t.mu must be
+// held.
+func (t *Tracker) advance(p *peer) {
+	for p.cursor < len(t.known) {
+		v := t.known[p.cursor].v
+		if _, ok := p.acked[v]; !ok {
+			return
+		}
+		delete(p.acked, v)
+		p.cursor++
+	}
+}
+
+// lag works out p's lag, t.mu must be held.
+func (t *Tracker) lag(p *peer) Lag {
+	l := Lag{Unacked: len(t.known) - p.count}
+	if p.cursor < len(t.known) {
+		l.OldestAge = clock.Since(t.known[p.cursor].at).Seconds()
+	}
+	if !p.last.IsZero() {
+		l.LastAck = p.last.UTC().Format(time.RFC3339Nano)
+	}
+	return l
+}
+
+// lagHandler reports every neighbour's lag, most lagging first in order.
+//
+//	Request
+//	{
+//	  "type": "lag"
+//	}
+//
+//	Response
+//	{
+//	  "type": "lag_ok",
+//	  "known": 120,
+//	  "peers": {
+//	    "n1": {"unacked": 0, "oldest_age_seconds": 0, "last_ack": "2024-01-02T15:04:05.123Z"},
+//	    "n2": {"unacked": 37, "oldest_age_seconds": 4.2, "last_ack": "2024-01-02T15:04:01.002Z"}
+//	  },
+//	  "order": ["n2", "n1"]
+//	}
+func (t *Tracker) lagHandler(msg maelstrom.Message) error {
+	var body struct{}
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
+	}
+	lags := t.Lags()
+	order := make([]string, 0, len(lags))
+	for peer := range lags {
+		order = append(order, peer)
+	}
+	sort.Slice(order, func(i, j int) bool {
+		a, b := lags[order[i]], lags[order[j]]
+		if a.Unacked != b.Unacked {
+			return a.Unacked > b.Unacked
+		}
+		return order[i] < order[j]
+	})
+	t.mu.Lock()
+	known := len(t.known)
+	t.mu.Unlock()
+	return t.n.Reply(msg, map[string]any{
+		"type":  "lag_ok",
+		"known": known,
+		"peers": lags,
+		"order": order,
+	})
+}
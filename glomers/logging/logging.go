@@ -0,0 +1,245 @@
+// Package logging is the structured, levelled logger shared by all the
+// challenge binaries.
+//
+// Every component gets its own logger and level:
+//
+//	var logger = logging.Component("broadcast")
+//
+// Records always carry the node id, and logging.WithMsg adds the source,
+// type and msg_id of the message being handled. The output is configured
+// through the environment:
+//
+//	GLOMERS_LOG_FORMAT=text|json
+//	GLOMERS_LOG_LEVEL=info,broadcast=debug,maelstrom=warn
+//
+// and levels can be changed at runtime with a set_log_level message.
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+const (
+	EnvFormat = "GLOMERS_LOG_FORMAT"
+	EnvLevel  = "GLOMERS_LOG_LEVEL"
+)
+
+var (
+	mu           sync.RWMutex
+	base         slog.Handler = slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})
+	defaultLevel              = new(slog.LevelVar)
+	levels                    = make(map[string]*slog.LevelVar)
+
+	node atomic.Pointer[maelstrom.Node]
+)
+
+// Init configures the output from the environment, routes the standard log
+// package through the "maelstrom" component and registers the
+// set_log_level handler on n.
+func Init(n *maelstrom.Node) error {
+	node.Store(n)
+
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug} // Filtering is done per component
+	var h slog.Handler
+	switch format := os.Getenv(EnvFormat); format {
+	case "", "text":
+		h = slog.NewTextHandler(os.Stderr, opts)
+	case "json":
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("unknown %s %q", EnvFormat, format)
+	}
+	mu.Lock()
+	base = h
+	mu.Unlock()
+
+	if err := ParseLevels(os.Getenv(EnvLevel)); err != nil {
+		return err
+	}
+
+	// Maelstrom itself logs every message it sends or receives through log
+	slog.SetDefault(Component("maelstrom"))
+
+	n.Handle("set_log_level", setLogLevelHandler)
+	return nil
+}
+
+// ParseLevels applies a spec like "info,broadcast=debug". A bare level sets
+// the default for components without their own.
+func ParseLevels(spec string) error {
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		component, levelText, found := strings.Cut(part, "=")
+		if !found {
+			component, levelText = "", component
+		}
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(levelText)); err != nil {
+			return fmt.Errorf("bad log level %q: %w", part, err)
+		}
+		SetLevel(component, level)
+	}
+	return nil
+}
+
+// SetLevel changes the level of a component, or the default level when
+// component is empty.
+func SetLevel(component string, level slog.Level) {
+	if component == "" {
+		defaultLevel.Set(level)
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	lv, ok := levels[component]
+	if !ok {
+		lv = new(slog.LevelVar)
+		levels[component] = lv
+	}
+	lv.Set(level)
+}
+
+// Level returns the level a component currently logs at.
+func Level(component string) slog.Level {
+	mu.RLock()
+	defer mu.RUnlock()
+	if lv, ok := levels[component]; ok {
+		return lv.Level()
+	}
+	return defaultLevel.Level()
+}
+
+// Component returns the logger of a component. It is cheap, and safe to call
+// from package level variable declarations before Init.
+func Component(name string) *slog.Logger {
+	return slog.New(&handler{component: name})
+}
+
+// WithMsg attaches the source, type and msg_id of msg to the logger.
+func WithMsg(l *slog.Logger, msg maelstrom.Message) *slog.Logger {
+	var body maelstrom.MessageBody
+	_ = json.Unmarshal(msg.Body, &body)
+	return l.With("src", msg.Src, "type", body.Type, "msg_id", body.MsgID)
+}
+
+// Sampled only lets through one in every "every" records below Warn, for
+// logging on hot paths.
+func Sampled(l *slog.Logger, every int) *slog.Logger {
+	if every <= 1 {
+		return l
+	}
+	return slog.New(&sampler{inner: l.Handler(), every: uint64(every), seen: new(atomic.Uint64)})
+}
+
+// handler filters by the component level and adds the node id, resolving the
+// shared base handler on every record so Init can swap it out.
+type handler struct {
+	component string
+	// Applied on top of the base handler in order
+	ops []func(slog.Handler) slog.Handler
+}
+
+func (h *handler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= Level(h.component)
+}
+
+func (h *handler) Handle(ctx context.Context, r slog.Record) error {
+	mu.RLock()
+	inner := base
+	mu.RUnlock()
+
+	attrs := []slog.Attr{slog.String("component", h.component)}
+	if n := node.Load(); n != nil && n.ID() != "" {
+		attrs = append(attrs, slog.String("node", n.ID()))
+	}
+	inner = inner.WithAttrs(attrs)
+	for _, op := range h.ops {
+		inner = op(inner)
+	}
+	return inner.Handle(ctx, r)
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(inner slog.Handler) slog.Handler { return inner.WithAttrs(attrs) })
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	return h.with(func(inner slog.Handler) slog.Handler { return inner.WithGroup(name) })
+}
+
+func (h *handler) with(op func(slog.Handler) slog.Handler) *handler {
+	ops := make([]func(slog.Handler) slog.Handler, 0, len(h.ops)+1)
+	ops = append(ops, h.ops...)
+	return &handler{component: h.component, ops: append(ops, op)}
+}
+
+type sampler struct {
+	inner slog.Handler
+	every uint64
+	seen  *atomic.Uint64
+}
+
+func (s *sampler) Enabled(ctx context.Context, level slog.Level) bool {
+	return s.inner.Enabled(ctx, level)
+}
+
+func (s *sampler) Handle(ctx context.Context, r slog.Record) error {
+	if r.Level < slog.LevelWarn && s.seen.Add(1)%s.every != 1 {
+		return nil
+	}
+	return s.inner.Handle(ctx, r)
+}
+
+func (s *sampler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &sampler{inner: s.inner.WithAttrs(attrs), every: s.every, seen: s.seen}
+}
+
+func (s *sampler) WithGroup(name string) slog.Handler {
+	return &sampler{inner: s.inner.WithGroup(name), every: s.every, seen: s.seen}
+}
+
+// Sample
+//
+//	Request
+//	{
+//	  "type": "set_log_level",
+//	  "component": "broadcast",  --> optional, the default level when missing
+//	  "level": "debug"
+//	}
+//
+//	Response
+//	{
+//	  "type": "set_log_level_ok"
+//	}
+func setLogLevelHandler(msg maelstrom.Message) error {
+	var body struct {
+		Component string `json:"component"`
+		Level     string `json:"level"`
+	}
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(body.Level)); err != nil {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
+	}
+	SetLevel(body.Component, level)
+	Component("logging").Info("Log level changed", "for", body.Component, "level", level)
+
+	return node.Load().Reply(msg, map[string]any{
+		"type": "set_log_level_ok",
+	})
+}
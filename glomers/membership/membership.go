@@ -0,0 +1,527 @@
+// Package membership decides which nodes a node talks to.
+//
+// With config "membership" set to static (the default) every other node in
+// n.NodeIDs() is a peer, as the challenges assume. With hyparview each node
+// only keeps a small active view of peers, kept symmetric and repaired as
+// nodes fail, and a larger passive view of candidates to repair it from
+// (Leitão et al., "HyParView: a membership protocol for reliable
+// gossip-based broadcast").
+//
+//	{"type": "join"}                                  ask the contact node to let us in
+//	{"type": "forward_join", "node": "n3", "ttl": 6}  random walk of a new node
+//	{"type": "neighbor", "priority": "high"}          add me to your active view
+//	{"type": "disconnect"}                            I dropped you from mine
+//	{"type": "shuffle", "origin": "n3", "ttl": 6, "nodes": [...]}
+//	{"type": "shuffle_reply", "nodes": [...]}         passive view exchange
+//	{"type": "hpv_ping"}                              liveness of active peers
+//
+// Only neighbor and hpv_ping, when sent as RPCs, are replied to.
+package membership
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"sort"
+	"sync"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+
+	"glomers/clock"
+	"glomers/config"
+	"glomers/logging"
+)
+
+const (
+	Static    = "static"
+	HyParView = "hyparview"
+)
+
+// Random walk lengths: a forward_join is taken into an active view after
+// activeWalk hops at the latest and into passive views at passiveWalk hops
+// left. Shuffles walk as far as joins.
+const (
+	activeWalk  = 6
+	passiveWalk = 3
+	// How many active and passive peers a shuffle carries besides its origin
+	shuffleActive  = 2
+	shufflePassive = 4
+)
+
+var logger = logging.Component("membership")
+
+type Membership struct {
+	n   *maelstrom.Node
+	cfg *config.Store
+	// Read once, at startup
+	mode string
+
+	mu       sync.Mutex
+	active   map[string]struct{}
+	passive  map[string]struct{}
+	watchers []func(peer string, up bool)
+}
+
+// Register installs the handlers of the configured protocol on n. Nothing is
+// sent until Start.
+func Register(n *maelstrom.Node, cfg *config.Store) *Membership {
+	m := &Membership{
+		n:       n,
+		cfg:     cfg,
+		mode:    cfg.Get().Membership,
+		active:  make(map[string]struct{}),
+		passive: make(map[string]struct{}),
+	}
+	if m.mode == HyParView {
+		n.Handle("join", m.joinHandler)
+		n.Handle("forward_join", m.forwardJoinHandler)
+		n.Handle("neighbor", m.neighborHandler)
+		n.Handle("disconnect", m.disconnectHandler)
+		n.Handle("shuffle", m.shuffleHandler)
+		n.Handle("shuffle_reply", m.shuffleReplyHandler)
+		n.Handle("hpv_ping", m.pingHandler)
+	}
+	return m
+}
+
+// Start joins through the first node of the cluster and starts keeping the
+// views up to date. It has to run once the node knows its ID.
+func (m *Membership) Start() {
+	if m.mode != HyParView {
+		return
+	}
+	logger.Info("Joining", "mode", m.mode, "active_view", m.cfg.Get().ActiveView, "passive_view", m.cfg.Get().PassiveView)
+	m.join()
+
+	ticker := clock.NewTicker(m.cfg.Get().ShuffleInterval)
+	m.cfg.Subscribe(func(old, cur config.Config) {
+		if cur.ShuffleInterval != old.ShuffleInterval {
+			ticker.Reset(cur.ShuffleInterval)
+		}
+	})
+	go func() {
+		for range ticker.C() {
+			m.maintain()
+		}
+	}()
+}
+
+// Peers returns who to talk to: every other node, or the active view.
+func (m *Membership) Peers() []string {
+	if m.mode != HyParView {
+		var peers []string
+		for _, id := range m.n.NodeIDs() {
+			if id != m.n.ID() {
+				peers = append(peers, id)
+			}
+		}
+		return peers
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return sorted(m.active)
+}
+
+// Dynamic tells whether Peers changes over time, in which case Watch reports
+// every change.
+func (m *Membership) Dynamic() bool {
+	return m.mode == HyParView
+}
+
+// Watch calls fn every time a peer joins or leaves the active view.
+func (m *Membership) Watch(fn func(peer string, up bool)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.watchers = append(m.watchers, fn)
+}
+
+// changes collects what happened under m.mu, to be acted on once it is
+// released: watchers told and peers we dropped disconnected.
+type changes struct {
+	up, down, dropped []string
+}
+
+func (m *Membership) apply(c changes) {
+	m.mu.Lock()
+	watchers := append([]func(string, bool){}, m.watchers...)
+	m.mu.Unlock()
+	for _, peer := range c.up {
+		logger.Debug("Peer up", "peer", peer)
+		for _, fn := range watchers {
+			fn(peer, true)
+		}
+	}
+	for _, peer := range c.down {
+		logger.Debug("Peer down", "peer", peer)
+		for _, fn := range watchers {
+			fn(peer, false)
+		}
+	}
+	for _, peer := range c.dropped {
+		m.send(peer, map[string]any{"type": "disconnect"})
+	}
+}
+
+// addActive must be called with m.mu held, a full view makes room by moving
+// a random peer to the passive view.
+func (m *Membership) addActive(peer string, c *changes) {
+	if _, ok := m.active[peer]; ok || peer == m.n.ID() {
+		return
+	}
+	if len(m.active) >= m.cfg.Get().ActiveView {
+		drop := pick(m.active, "")
+		m.removeActive(drop, c)
+		m.addPassive(drop)
+		c.dropped = append(c.dropped, drop)
+	}
+	delete(m.passive, peer)
+	m.active[peer] = struct{}{}
+	c.up = append(c.up, peer)
+}
+
+// removeActive must be called with m.mu held.
+func (m *Membership) removeActive(peer string, c *changes) {
+	if _, ok := m.active[peer]; !ok {
+		return
+	}
+	delete(m.active, peer)
+	c.down = append(c.down, peer)
+}
+
+// addPassive must be called with m.mu held.
+func (m *Membership) addPassive(peer string) {
+	if _, ok := m.active[peer]; ok || peer == m.n.ID() {
+		return
+	}
+	if _, ok := m.passive[peer]; ok {
+		return
+	}
+	if len(m.passive) >= m.cfg.Get().PassiveView {
+		delete(m.passive, pick(m.passive, ""))
+	}
+	m.passive[peer] = struct{}{}
+}
+
+// join asks the first node, or a random one once we have been cut off, to
+// let us in. The first node itself waits for the others to join it.
+func (m *Membership) join() {
+	m.mu.Lock()
+	rejoin := len(m.passive) > 0
+	m.mu.Unlock()
+	ids := m.n.NodeIDs()
+	contact := ids[0]
+	if m.n.ID() == contact || rejoin {
+		contact = ids[rand.Intn(len(ids))]
+	}
+	if contact == m.n.ID() {
+		return
+	}
+	m.send(contact, map[string]any{"type": "join"})
+}
+
+// maintain runs every ShuffleInterval: drop active peers that don't answer,
+// fill the active view from the passive one, and shuffle.
+func (m *Membership) maintain() {
+	var wg sync.WaitGroup
+	for _, peer := range m.Peers() {
+		peer := peer
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var reply struct {
+				Active bool `json:"active"`
+			}
+			err := m.rpc(peer, map[string]any{"type": "hpv_ping"}, &reply)
+			if err == nil && reply.Active {
+				return
+			}
+			// Dead, or it dropped us without the disconnect getting here
+			var c changes
+			m.mu.Lock()
+			m.removeActive(peer, &c)
+			if err == nil {
+				m.addPassive(peer)
+			}
+			m.mu.Unlock()
+			logger.Info("Dropped active peer", "peer", peer, "err", err)
+			m.apply(c)
+		}()
+	}
+	wg.Wait()
+
+	m.promote()
+
+	m.mu.Lock()
+	empty := len(m.active) == 0
+	target := pick(m.active, "")
+	nodes := append(sample(m.active, shuffleActive, target), sample(m.passive, shufflePassive, "")...)
+	m.mu.Unlock()
+	if empty {
+		m.join()
+		return
+	}
+	m.send(target, map[string]any{
+		"type":   "shuffle",
+		"origin": m.n.ID(),
+		"ttl":    activeWalk,
+		"nodes":  append(nodes, m.n.ID()),
+	})
+}
+
+// promote asks passive peers, each at most once, to become active until the
+// view is full. Those that don't answer are forgotten.
+func (m *Membership) promote() {
+	tried := make(map[string]bool)
+	for {
+		m.mu.Lock()
+		full := len(m.active) >= m.cfg.Get().ActiveView
+		var candidate string
+		for peer := range m.passive {
+			if !tried[peer] {
+				candidate = peer
+				break
+			}
+		}
+		priority := "low"
+		if len(m.active) == 0 {
+			// Nobody to talk to, the candidate has to make room for us
+			priority = "high"
+		}
+		m.mu.Unlock()
+		if full || candidate == "" {
+			return
+		}
+		tried[candidate] = true
+
+		var reply struct {
+			Accepted bool `json:"accepted"`
+		}
+		err := m.rpc(candidate, map[string]any{"type": "neighbor", "priority": priority}, &reply)
+		var c changes
+		m.mu.Lock()
+		switch {
+		case err != nil:
+			delete(m.passive, candidate)
+		case reply.Accepted:
+			m.addActive(candidate, &c)
+		}
+		m.mu.Unlock()
+		m.apply(c)
+	}
+}
+
+func (m *Membership) joinHandler(msg maelstrom.Message) error {
+	var c changes
+	m.mu.Lock()
+	m.addActive(msg.Src, &c)
+	var others []string
+	for peer := range m.active {
+		if peer != msg.Src {
+			others = append(others, peer)
+		}
+	}
+	m.mu.Unlock()
+	m.apply(c)
+
+	logging.WithMsg(logger, msg).Info("Node joined", "node", msg.Src)
+	m.send(msg.Src, map[string]any{"type": "neighbor", "priority": "high"})
+	for _, peer := range others {
+		m.send(peer, map[string]any{"type": "forward_join", "node": msg.Src, "ttl": activeWalk})
+	}
+	return nil
+}
+
+func (m *Membership) forwardJoinHandler(msg maelstrom.Message) error {
+	var body struct {
+		Node string `json:"node"`
+		TTL  int    `json:"ttl"`
+	}
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+	if body.Node == m.n.ID() {
+		return nil
+	}
+
+	var c changes
+	m.mu.Lock()
+	next := ""
+	if body.TTL > 0 && len(m.active) > 1 {
+		if body.TTL == passiveWalk {
+			m.addPassive(body.Node)
+		}
+		next = pick(m.active, msg.Src, body.Node)
+	}
+	if next == "" {
+		// End of the walk
+		m.addActive(body.Node, &c)
+	}
+	m.mu.Unlock()
+	m.apply(c)
+
+	if next != "" {
+		m.send(next, map[string]any{"type": "forward_join", "node": body.Node, "ttl": body.TTL - 1})
+		return nil
+	}
+	m.send(body.Node, map[string]any{"type": "neighbor", "priority": "high"})
+	return nil
+}
+
+func (m *Membership) neighborHandler(msg maelstrom.Message) error {
+	var body struct {
+		maelstrom.MessageBody
+		Priority string `json:"priority"`
+	}
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+
+	var c changes
+	m.mu.Lock()
+	_, already := m.active[msg.Src]
+	accepted := already || body.Priority == "high" || len(m.active) < m.cfg.Get().ActiveView
+	if accepted {
+		m.addActive(msg.Src, &c)
+	} else {
+		m.addPassive(msg.Src)
+	}
+	m.mu.Unlock()
+	m.apply(c)
+
+	if body.MsgID == 0 {
+		return nil // Just telling us
+	}
+	return m.n.Reply(msg, map[string]any{
+		"type":     "neighbor_ok",
+		"accepted": accepted,
+	})
+}
+
+func (m *Membership) disconnectHandler(msg maelstrom.Message) error {
+	var c changes
+	m.mu.Lock()
+	m.removeActive(msg.Src, &c)
+	m.addPassive(msg.Src)
+	m.mu.Unlock()
+	m.apply(c)
+	return nil
+}
+
+func (m *Membership) shuffleHandler(msg maelstrom.Message) error {
+	var body struct {
+		Origin string   `json:"origin"`
+		TTL    int      `json:"ttl"`
+		Nodes  []string `json:"nodes"`
+	}
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+	if body.Origin == m.n.ID() {
+		return nil
+	}
+
+	m.mu.Lock()
+	if body.TTL > 0 && len(m.active) > 1 {
+		if next := pick(m.active, msg.Src, body.Origin); next != "" {
+			m.mu.Unlock()
+			m.send(next, map[string]any{"type": "shuffle", "origin": body.Origin, "ttl": body.TTL - 1, "nodes": body.Nodes})
+			return nil
+		}
+	}
+	reply := sample(m.passive, len(body.Nodes), "")
+	for _, peer := range body.Nodes {
+		m.addPassive(peer)
+	}
+	m.mu.Unlock()
+
+	m.send(body.Origin, map[string]any{"type": "shuffle_reply", "nodes": reply})
+	return nil
+}
+
+func (m *Membership) shuffleReplyHandler(msg maelstrom.Message) error {
+	var body struct {
+		Nodes []string `json:"nodes"`
+	}
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	for _, peer := range body.Nodes {
+		m.addPassive(peer)
+	}
+	m.mu.Unlock()
+	return nil
+}
+
+// pingHandler also tells the sender whether it is in our active view, so a
+// view that went one sided gets noticed.
+func (m *Membership) pingHandler(msg maelstrom.Message) error {
+	m.mu.Lock()
+	_, active := m.active[msg.Src]
+	m.mu.Unlock()
+	return m.n.Reply(msg, map[string]any{
+		"type":   "hpv_ping_ok",
+		"active": active,
+	})
+}
+
+func (m *Membership) send(peer string, body map[string]any) {
+	if err := m.n.Send(peer, body); err != nil {
+		logger.Warn("Error sending", "type", body["type"], "dst", peer, "err", err)
+	}
+}
+
+func (m *Membership) rpc(peer string, body map[string]any, reply any) error {
+	ctx, cancel := clock.WithTimeout(context.Background(), m.cfg.Get().RPCTimeout)
+	defer cancel()
+	msg, err := m.n.SyncRPC(ctx, peer, body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(msg.Body, reply)
+}
+
+// pick returns a random member of set that isn't excluded, or "".
+func pick(set map[string]struct{}, exclude ...string) string {
+	var candidates []string
+	for peer := range set {
+		if !contains(exclude, peer) {
+			candidates = append(candidates, peer)
+		}
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+	sort.Strings(candidates) // Map order isn't random enough to rely on
+	return candidates[rand.Intn(len(candidates))]
+}
+
+// sample returns up to k random members of set other than exclude.
+func sample(set map[string]struct{}, k int, exclude string) []string {
+	var out []string
+	for _, peer := range sorted(set) {
+		if peer != exclude {
+			out = append(out, peer)
+		}
+	}
+	rand.Shuffle(len(out), func(i, j int) { out[i], out[j] = out[j], out[i] })
+	return out[:min(k, len(out))]
+}
+
+func sorted(set map[string]struct{}) []string {
+	out := make([]string, 0, len(set))
+	for peer := range set {
+		out = append(out, peer)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func contains(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,406 @@
+// Package metrics keeps a node's counters, gauges and histograms, answers
+//
+//	{"type": "stats"}
+//
+// with a snapshot of all of them, and with GLOMERS_METRICS_DIR set writes them
+// in Prometheus text format to <dir>/<node-id>.prom every
+// GLOMERS_METRICS_INTERVAL (10s by default).
+//
+// A series is named like Prometheus does, the metric name followed by its
+// labels: messages_received_total{type="broadcast"}.
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+
+	"glomers/clock"
+	"glomers/logging"
+)
+
+const (
+	EnvDir      = "GLOMERS_METRICS_DIR"
+	EnvInterval = "GLOMERS_METRICS_INTERVAL"
+)
+
+var logger = logging.Component("metrics")
+
+// Histogram buckets are powers of two from about a millisecond, for
+// durations in seconds, up to 4096, for sizes
+var buckets = func() []float64 {
+	var b []float64
+	for e := -10; e <= 12; e++ {
+		b = append(b, math.Ldexp(1, e))
+	}
+	return b
+}()
+
+var registry = struct {
+	mu         sync.Mutex
+	counters   map[string]*counter
+	gauges     map[string]*gauge
+	histograms map[string]*histogram
+}{
+	counters:   make(map[string]*counter),
+	gauges:     make(map[string]*gauge),
+	histograms: make(map[string]*histogram),
+}
+
+type counter struct {
+	name  string
+	value float64
+}
+
+type gauge struct {
+	name string
+	fn   func() float64
+}
+
+type histogram struct {
+	name   string
+	counts []uint64 // One per bucket, the last for everything above
+	count  uint64
+	sum    float64
+	max    float64
+}
+
+// series names a metric with its labels, given as key, value pairs.
+func series(name string, labels []string) string {
+	if len(labels) < 2 {
+		return name
+	}
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=%q", labels[i], labels[i+1])
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// Inc adds one to a counter.
+func Inc(name string, labels ...string) {
+	Add(name, 1, labels...)
+}
+
+// Add adds v to a counter.
+func Add(name string, v float64, labels ...string) {
+	key := series(name, labels)
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	c, ok := registry.counters[key]
+	if !ok {
+		c = &counter{name: name}
+		registry.counters[key] = c
+	}
+	c.value += v
+}
+
+// Gauge reports whatever fn returns at the time of every snapshot. Registering
+// the same series again replaces fn.
+func Gauge(name string, fn func() float64, labels ...string) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	registry.gauges[series(name, labels)] = &gauge{name: name, fn: fn}
+}
+
+// Observe adds v to a histogram.
+func Observe(name string, v float64, labels ...string) {
+	key := series(name, labels)
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	h, ok := registry.histograms[key]
+	if !ok {
+		h = &histogram{name: name, counts: make([]uint64, len(buckets)+1)}
+		registry.histograms[key] = h
+	}
+	i := sort.SearchFloat64s(buckets, v)
+	h.counts[i]++
+	h.count++
+	h.sum += v
+	h.max = max(h.max, v)
+}
+
+// Since observes the seconds elapsed since start.
+func Since(name string, start time.Time, labels ...string) {
+	Observe(name, clock.Since(start).Seconds(), labels...)
+}
+
+// RPC records a call of the given type that started at start and ended with
+// err: its duration, and whether it timed out or failed otherwise.
+func RPC(typ string, start time.Time, err error) {
+	Since("rpc_duration_seconds", start, "type", typ)
+	switch {
+	case err == nil:
+	case errors.Is(err, context.DeadlineExceeded):
+		Inc("rpc_timeouts_total", "type", typ)
+	default:
+		Inc("rpc_errors_total", "type", typ)
+	}
+}
+
+// Summary is how a histogram shows in a snapshot, quantiles are the upper
+// bound of the bucket they fall in.
+type Summary struct {
+	Count uint64  `json:"count"`
+	Sum   float64 `json:"sum"`
+	Mean  float64 `json:"mean"`
+	P50   float64 `json:"p50"`
+	P90   float64 `json:"p90"`
+	P99   float64 `json:"p99"`
+	Max   float64 `json:"max"`
+}
+
+type Snapshot struct {
+	Counters   map[string]float64 `json:"counters"`
+	Gauges     map[string]float64 `json:"gauges"`
+	Histograms map[string]Summary `json:"histograms"`
+}
+
+// Take returns the current value of every series.
+func Take() Snapshot {
+	registry.mu.Lock()
+	s := Snapshot{
+		Counters:   make(map[string]float64, len(registry.counters)),
+		Gauges:     make(map[string]float64, len(registry.gauges)),
+		Histograms: make(map[string]Summary, len(registry.histograms)),
+	}
+	for key, c := range registry.counters {
+		s.Counters[key] = c.value
+	}
+	for key, h := range registry.histograms {
+		s.Histograms[key] = h.summary()
+	}
+	gauges := make(map[string]*gauge, len(registry.gauges))
+	for key, g := range registry.gauges {
+		gauges[key] = g
+	}
+	registry.mu.Unlock()
+
+	// Gauges read other packages' state, never under our lock
+	for key, g := range gauges {
+		s.Gauges[key] = g.fn()
+	}
+	return s
+}
+
+func (h *histogram) summary() Summary {
+	s := Summary{Count: h.count, Sum: h.sum, Max: h.max}
+	if h.count == 0 {
+		return s
+	}
+	s.Mean = h.sum / float64(h.count)
+	s.P50, s.P90, s.P99 = h.quantile(0.5), h.quantile(0.9), h.quantile(0.99)
+	return s
+}
+
+func (h *histogram) quantile(q float64) float64 {
+	rank := uint64(math.Ceil(q * float64(h.count)))
+	var seen uint64
+	for i, c := range h.counts {
+		seen += c
+		if seen >= rank {
+			if i < len(buckets) {
+				return min(buckets[i], h.max)
+			}
+			break
+		}
+	}
+	return h.max
+}
+
+// WritePrometheus writes every series in Prometheus text format.
+func WritePrometheus(w io.Writer) error {
+	s := Take()
+	registry.mu.Lock()
+	names := make(map[string]string) // series to metric name
+	for key, c := range registry.counters {
+		names[key] = c.name
+	}
+	for key, g := range registry.gauges {
+		names[key] = g.name
+	}
+	histograms := make(map[string]histogram, len(registry.histograms))
+	for key, h := range registry.histograms {
+		h := *h
+		h.counts = append([]uint64(nil), h.counts...)
+		histograms[key] = h
+	}
+	registry.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	typed := make(map[string]bool)
+	header := func(name, kind string) {
+		if !typed[name] {
+			typed[name] = true
+			fmt.Fprintf(bw, "# TYPE %s %s\n", name, kind)
+		}
+	}
+	for _, key := range sortedKeys(s.Counters) {
+		header(names[key], "counter")
+		fmt.Fprintf(bw, "%s %v\n", key, s.Counters[key])
+	}
+	for _, key := range sortedKeys(s.Gauges) {
+		header(names[key], "gauge")
+		fmt.Fprintf(bw, "%s %v\n", key, s.Gauges[key])
+	}
+	for _, key := range sortedKeys(s.Histograms) {
+		h := histograms[key]
+		header(h.name, "histogram")
+		labels := strings.TrimSuffix(strings.TrimPrefix(key, h.name), "}")
+		if labels == "" {
+			labels = "{"
+		} else {
+			labels += ","
+		}
+		var cumulative uint64
+		for i, c := range h.counts {
+			cumulative += c
+			le := "+Inf"
+			if i < len(buckets) {
+				le = fmt.Sprint(buckets[i])
+			}
+			fmt.Fprintf(bw, "%s_bucket%sle=%q} %d\n", h.name, labels, le, cumulative)
+		}
+		rest := strings.TrimPrefix(key, h.name)
+		fmt.Fprintf(bw, "%s_sum%s %v\n", h.name, rest, h.sum)
+		fmt.Fprintf(bw, "%s_count%s %d\n", h.name, rest, h.count)
+	}
+	return bw.Flush()
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Attach counts the messages n reads and writes by type, registers stats,
+// and starts the Prometheus dump when GLOMERS_METRICS_DIR is set. It must be
+// called before n.Run.
+func Attach(n *maelstrom.Node) {
+	n.Stdin = io.TeeReader(n.Stdin, &lineCounter{metric: "messages_received_total"})
+	n.Stdout = io.MultiWriter(n.Stdout, &lineCounter{metric: "messages_sent_total"})
+	n.Handle("stats", func(msg maelstrom.Message) error {
+		return statsHandler(n, msg)
+	})
+
+	if dir := os.Getenv(EnvDir); dir != "" {
+		interval := 10 * time.Second
+		if v := os.Getenv(EnvInterval); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d <= 0 {
+				logger.Warn("Ignoring bad metrics interval", "value", v, "err", err)
+			} else {
+				interval = d
+			}
+		}
+		go dump(n, dir, interval)
+	}
+}
+
+// statsHandler answers with a snapshot of every series.
+//
+//	Request
+//	{
+//	  "type": "stats"
+//	}
+//
+//	Response
+//	{
+//	  "type": "stats_ok",
+//	  "counters": {"messages_received_total{type=\"broadcast\"}": 120, ...},
+//	  "gauges": {"messages_stored": 100, ...},
+//	  "histograms": {
+//	    "rpc_duration_seconds{type=\"broadcast\"}":
+//	      {"count": 80, "sum": 8.2, "mean": 0.1, "p50": 0.125, "p90": 0.125, "p99": 0.25, "max": 0.2}
+//	  }
+//	}
+func statsHandler(n *maelstrom.Node, msg maelstrom.Message) error {
+	s := Take()
+	return n.Reply(msg, map[string]any{
+		"type":       "stats_ok",
+		"counters":   s.Counters,
+		"gauges":     s.Gauges,
+		"histograms": s.Histograms,
+	})
+}
+
+func dump(n *maelstrom.Node, dir string, interval time.Duration) {
+	ticker := clock.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C() {
+		if n.ID() == "" {
+			continue // Not initialised yet, we don't know our file
+		}
+		if err := writeFile(filepath.Join(dir, n.ID()+".prom")); err != nil {
+			logger.Error("Error dumping metrics", "err", err)
+		}
+	}
+}
+
+// writeFile replaces path, so readers never see half a dump.
+func writeFile(path string) error {
+	var buf bytes.Buffer
+	if err := WritePrometheus(&buf); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// lineCounter counts the messages written to it, one per line, by type.
+type lineCounter struct {
+	metric string
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (w *lineCounter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		var msg struct {
+			Body struct {
+				Type string `json:"type"`
+			} `json:"body"`
+		}
+		if line := bytes.TrimSpace(w.buf[:i]); len(line) > 0 && json.Unmarshal(line, &msg) == nil {
+			Inc(w.metric, "type", msg.Body.Type)
+			Add(strings.TrimSuffix(w.metric, "_total")+"_bytes_total", float64(len(line)))
+		}
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
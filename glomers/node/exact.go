@@ -0,0 +1,160 @@
+package node
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"maps"
+	"sync"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+)
+
+// Maelstrom's Node.RPC and Node.Reply add msg_id and in_reply_to to a body by
+// decoding it into a map[string]any and encoding it again, which turns every
+// number into a float64, so integers past 2^53 lose their low bits. RPC,
+// SyncRPC and Reply here add them to the body as it is. Their msg_ids start at
+// exactMsgIDs, far above the node's own, and New filters the replies to them
+// out of stdin before the node sees them.
+const exactMsgIDs = 1 << 40
+
+type exact struct {
+	mu        sync.Mutex
+	next      int
+	callbacks map[int]maelstrom.HandlerFunc
+}
+
+// The exact RPCs of every node built by New
+var exacts sync.Map
+
+func attachExact(n *maelstrom.Node) {
+	e := &exact{next: exactMsgIDs, callbacks: make(map[int]maelstrom.HandlerFunc)}
+	exacts.Store(n, e)
+	n.Stdin = e.filter(n.Stdin)
+}
+
+// filter passes every line of in on but the replies to our RPCs, which go to
+// their callbacks.
+func (e *exact) filter(in io.Reader) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		r := bufio.NewReader(in)
+		for {
+			line, err := r.ReadBytes('\n')
+			if len(line) > 0 && !e.dispatch(line) {
+				if _, err := pw.Write(line); err != nil {
+					return
+				}
+			}
+			if err != nil {
+				if errors.Is(err, io.EOF) {
+					err = nil
+				}
+				pw.CloseWithError(err)
+				return
+			}
+		}
+	}()
+	return pr
+}
+
+// dispatch hands line to the callback of the RPC it replies to, if it is one
+// of ours.
+func (e *exact) dispatch(line []byte) bool {
+	var msg maelstrom.Message
+	if err := json.Unmarshal(line, &msg); err != nil {
+		return false
+	}
+	var body maelstrom.MessageBody
+	if err := json.Unmarshal(msg.Body, &body); err != nil || body.InReplyTo < exactMsgIDs {
+		return false
+	}
+	e.mu.Lock()
+	h, ok := e.callbacks[body.InReplyTo]
+	delete(e.callbacks, body.InReplyTo)
+	e.mu.Unlock()
+	if !ok {
+		return false // The node logs and drops it
+	}
+
+	log.Printf("Received %s", msg)
+	go func() {
+		if err := h(msg); err != nil {
+			log.Printf("callback error: %s", err)
+		}
+	}()
+	return true
+}
+
+// rpc sends body to dest with a msg_id of ours, and returns the msg_id.
+func (e *exact) rpc(n *maelstrom.Node, dest string, body map[string]any, handler maelstrom.HandlerFunc) (int, error) {
+	e.mu.Lock()
+	e.next++
+	id := e.next
+	e.callbacks[id] = handler
+	e.mu.Unlock()
+
+	body = maps.Clone(body)
+	body["msg_id"] = id
+	if err := n.Send(dest, body); err != nil {
+		e.forget(id)
+		return 0, err
+	}
+	return id, nil
+}
+
+func (e *exact) forget(id int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.callbacks, id)
+}
+
+// RPC is n.RPC keeping the numbers of body exact.
+func RPC(n *maelstrom.Node, dest string, body map[string]any, handler maelstrom.HandlerFunc) error {
+	e, ok := exacts.Load(n)
+	if !ok {
+		return n.RPC(dest, body, handler)
+	}
+	_, err := e.(*exact).rpc(n, dest, body, handler)
+	return err
+}
+
+// SyncRPC is n.SyncRPC keeping the numbers of body exact.
+func SyncRPC(ctx context.Context, n *maelstrom.Node, dest string, body map[string]any) (maelstrom.Message, error) {
+	e, ok := exacts.Load(n)
+	if !ok {
+		return n.SyncRPC(ctx, dest, body)
+	}
+	replies := make(chan maelstrom.Message, 1)
+	id, err := e.(*exact).rpc(n, dest, body, func(m maelstrom.Message) error {
+		replies <- m
+		return nil
+	})
+	if err != nil {
+		return maelstrom.Message{}, err
+	}
+
+	select {
+	case <-ctx.Done():
+		e.(*exact).forget(id)
+		return maelstrom.Message{}, ctx.Err()
+	case m := <-replies:
+		if err := m.RPCError(); err != nil {
+			return m, err
+		}
+		return m, nil
+	}
+}
+
+// Reply is n.Reply keeping the numbers of body exact.
+func Reply(n *maelstrom.Node, req maelstrom.Message, body map[string]any) error {
+	var reqBody maelstrom.MessageBody
+	if err := json.Unmarshal(req.Body, &reqBody); err != nil {
+		return err
+	}
+	body["in_reply_to"] = reqBody.MsgID
+	return n.Send(req.Src, body)
+}
@@ -0,0 +1,36 @@
+// Package node builds a maelstrom node with everything every workload shares:
+// trace recording, metrics, structured logging, span export and RPCs that
+// keep numbers exact.
+package node
+
+import (
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+
+	"glomers/logging"
+	"glomers/metrics"
+	"glomers/record"
+	"glomers/tracing"
+)
+
+var logger = logging.Component("node")
+
+// New returns a node ready for workloads to register their handlers on.
+func New() (*maelstrom.Node, error) {
+	n := maelstrom.NewNode()
+	record.Attach(n)
+	metrics.Attach(n)
+	if err := logging.Init(n); err != nil {
+		return nil, err
+	}
+	tracing.Init(n)
+	attachExact(n)
+
+	// A peer failing to handle something we only sent, with no msg_id to
+	// reply to, still answers with an error, which Maelstrom's node stops on
+	// when nothing handles it
+	n.Handle("error", func(msg maelstrom.Message) error {
+		logging.WithMsg(logger, msg).Warn("Peer failed to handle a message", "body", string(msg.Body))
+		return nil
+	})
+	return n, nil
+}
@@ -0,0 +1,199 @@
+// Package outbound schedules the RPCs a node sends to its peers, so a burst
+// of broadcasts queues up instead of starting a goroutine per peer per value.
+//
+// A fixed pool of workers runs the calls, at most InFlight of them at once
+// and PerPeer at once to any one peer, taking turns between the peers that
+// have calls waiting. Once Queue calls are waiting, submitting one blocks
+// until there is room.
+package outbound
+
+import (
+	"sync"
+	"time"
+
+	"glomers/clock"
+	"glomers/logging"
+	"glomers/metrics"
+)
+
+var logger = logging.Component("outbound")
+
+type Options struct {
+	// Goroutines running calls, only read by New
+	Workers int
+	// Calls running at once, at most Workers take effect
+	InFlight int
+	// Calls running at once to a single peer
+	PerPeer int
+	// Calls waiting before Go and Call block
+	Queue int
+}
+
+// Stats is a snapshot of the scheduler's queues.
+type Stats struct {
+	// Calls waiting and running now
+	Queued  int `json:"queued"`
+	Running int `json:"running"`
+	// Most calls ever waiting at once
+	MaxQueued int `json:"max_queued"`
+	// Calls ever submitted and finished
+	Submitted int64 `json:"submitted"`
+	Completed int64 `json:"completed"`
+	// Times a submitter blocked on a full queue
+	Blocked int64 `json:"blocked"`
+	// Average and longest time calls waited for a worker
+	AvgWait time.Duration `json:"avg_wait"`
+	MaxWait time.Duration `json:"max_wait"`
+}
+
+type Scheduler struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	opts Options
+
+	peers map[string]*peer
+	// Peers with calls waiting, served round robin from next
+	order []string
+	next  int
+
+	queued, running int
+	stats           Stats
+	totalWait       time.Duration
+}
+
+type peer struct {
+	calls   []*call
+	running int
+}
+
+type call struct {
+	fn     func()
+	queued time.Time
+}
+
+// New starts opts.Workers workers.
+func New(opts Options) *Scheduler {
+	s := &Scheduler{opts: opts, peers: make(map[string]*peer)}
+	s.cond = sync.NewCond(&s.mu)
+	for i := 0; i < max(opts.Workers, 1); i++ {
+		go s.work()
+	}
+	metrics.Gauge("outbound_queued", func() float64 { return float64(s.Stats().Queued) })
+	metrics.Gauge("outbound_running", func() float64 { return float64(s.Stats().Running) })
+	metrics.Gauge("outbound_blocked", func() float64 { return float64(s.Stats().Blocked) })
+	return s
+}
+
+// Reconfigure applies new limits, the number of workers can't be changed.
+func (s *Scheduler) Reconfigure(opts Options) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	opts.Workers = s.opts.Workers
+	s.opts = opts
+	s.cond.Broadcast()
+}
+
+// Go queues fn to run on a worker as a call to dst.
+func (s *Scheduler) Go(dst string, fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.queued >= max(s.opts.Queue, 1) {
+		s.stats.Blocked++
+		logger.Debug("Outbound queue full, holding back", "dst", dst, "queued", s.queued)
+		for s.queued >= max(s.opts.Queue, 1) {
+			s.cond.Wait()
+		}
+	}
+
+	p, ok := s.peers[dst]
+	if !ok {
+		p = &peer{}
+		s.peers[dst] = p
+	}
+	if len(p.calls) == 0 {
+		s.order = append(s.order, dst)
+	}
+	p.calls = append(p.calls, &call{fn: fn, queued: clock.Now()})
+	s.queued++
+	s.stats.Submitted++
+	s.stats.MaxQueued = max(s.stats.MaxQueued, s.queued)
+	s.cond.Broadcast()
+}
+
+// Call runs fn on a worker as a call to dst and returns its error.
+func (s *Scheduler) Call(dst string, fn func() error) error {
+	done := make(chan error, 1)
+	s.Go(dst, func() { done <- fn() })
+	return <-done
+}
+
+func (s *Scheduler) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := s.stats
+	stats.Queued, stats.Running = s.queued, s.running
+	if stats.Completed > 0 {
+		stats.AvgWait = s.totalWait / time.Duration(stats.Completed)
+	}
+	return stats
+}
+
+func (s *Scheduler) work() {
+	s.mu.Lock()
+	for {
+		dst, c := s.take()
+		if c == nil {
+			s.cond.Wait()
+			continue
+		}
+		wait := clock.Since(c.queued)
+		s.mu.Unlock()
+		metrics.Observe("outbound_wait_seconds", wait.Seconds())
+
+		c.fn()
+
+		s.mu.Lock()
+		s.peers[dst].running--
+		s.running--
+		s.stats.Completed++
+		s.totalWait += wait
+		s.stats.MaxWait = max(s.stats.MaxWait, wait)
+		s.cond.Broadcast()
+	}
+}
+
+// take returns the next call allowed to run, from the first peer in turn
+// that is under its limit, or nil. s.mu must be held.
+func (s *Scheduler) take() (string, *call) {
+	if s.running >= max(s.opts.InFlight, 1) {
+		return "", nil
+	}
+	for i := range s.order {
+		at := (s.next + i) % len(s.order)
+		dst := s.order[at]
+		p := s.peers[dst]
+		if p.running >= max(s.opts.PerPeer, 1) {
+			continue
+		}
+
+		c := p.calls[0]
+		p.calls = p.calls[1:]
+		if len(p.calls) == 0 {
+			s.order = append(s.order[:at], s.order[at+1:]...)
+			s.next = at
+		} else {
+			s.next = at + 1
+		}
+		if len(s.order) > 0 {
+			s.next %= len(s.order)
+		} else {
+			s.next = 0
+		}
+		p.running++
+		s.running++
+		s.queued--
+		return dst, c
+	}
+	return "", nil
+}
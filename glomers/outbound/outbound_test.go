@@ -0,0 +1,121 @@
+package outbound
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Calls never run more at once than InFlight and the workers allow, nor more
+// than PerPeer to one peer, and every one of them runs.
+func TestLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    Options
+		peers   int
+		perPeer int // Calls submitted
+	}{
+		{"one at a time", Options{Workers: 4, InFlight: 1, PerPeer: 4, Queue: 100}, 3, 10},
+		{"fewer workers than in flight", Options{Workers: 2, InFlight: 8, PerPeer: 8, Queue: 100}, 3, 10},
+		{"per peer", Options{Workers: 8, InFlight: 8, PerPeer: 2, Queue: 100}, 2, 20},
+		{"small queue", Options{Workers: 4, InFlight: 4, PerPeer: 1, Queue: 1}, 5, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(tt.opts)
+			var mu sync.Mutex
+			running, maxRunning := 0, 0
+			byPeer, maxByPeer := make(map[string]int), 0
+			var wg sync.WaitGroup
+			for i := 0; i < tt.perPeer; i++ {
+				for p := 0; p < tt.peers; p++ {
+					dst := fmt.Sprintf("n%d", p)
+					wg.Add(1)
+					s.Go(dst, func() {
+						defer wg.Done()
+						mu.Lock()
+						running++
+						byPeer[dst]++
+						maxRunning, maxByPeer = max(maxRunning, running), max(maxByPeer, byPeer[dst])
+						mu.Unlock()
+						time.Sleep(time.Millisecond)
+						mu.Lock()
+						running--
+						byPeer[dst]--
+						mu.Unlock()
+					})
+				}
+			}
+			wg.Wait()
+
+			if want := min(tt.opts.InFlight, tt.opts.Workers); maxRunning > want {
+				t.Errorf("%d calls ran at once, want at most %d", maxRunning, want)
+			}
+			if maxByPeer > tt.opts.PerPeer {
+				t.Errorf("%d calls ran at once to a peer, want at most %d", maxByPeer, tt.opts.PerPeer)
+			}
+			if got, want := s.Stats().Submitted, int64(tt.peers*tt.perPeer); got != want {
+				t.Errorf("%d calls submitted, want %d", got, want)
+			}
+		})
+	}
+}
+
+// Peers with calls waiting take turns, however many each has queued.
+func TestRoundRobin(t *testing.T) {
+	s := New(Options{Workers: 1, InFlight: 1, PerPeer: 1, Queue: 100})
+	gate := make(chan struct{})
+	s.Go("n0", func() { <-gate })
+	for s.Stats().Running == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	var mu sync.Mutex
+	var ran []string
+	var wg sync.WaitGroup
+	for _, dst := range []string{"n1", "n1", "n1", "n2", "n2", "n3"} {
+		dst := dst
+		wg.Add(1)
+		s.Go(dst, func() {
+			defer wg.Done()
+			mu.Lock()
+			ran = append(ran, dst)
+			mu.Unlock()
+		})
+	}
+	close(gate)
+	wg.Wait()
+	if want := []string{"n1", "n2", "n3", "n1", "n2", "n1"}; !slices.Equal(ran, want) {
+		t.Errorf("ran %v, want %v", ran, want)
+	}
+}
+
+// Submitting to a full queue blocks until a call leaves it.
+func TestQueueFullBlocks(t *testing.T) {
+	s := New(Options{Workers: 1, InFlight: 1, PerPeer: 1, Queue: 2})
+	gate := make(chan struct{})
+	s.Go("n1", func() { <-gate })
+	// Wait for the worker to take it off the queue
+	for s.Stats().Running == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	s.Go("n1", func() {})
+	s.Go("n2", func() {})
+
+	done := make(chan error)
+	go func() { done <- s.Call("n3", func() error { return nil }) }()
+	select {
+	case <-done:
+		t.Fatal("submitted past a full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if blocked := s.Stats().Blocked; blocked != 1 {
+		t.Errorf("%d submitters blocked, want 1", blocked)
+	}
+	close(gate)
+	if err := <-done; err != nil {
+		t.Errorf("Call: %v", err)
+	}
+}
@@ -0,0 +1,164 @@
+// Package record tees the raw JSON lines a node reads and writes into a trace
+// file, and feeds such a trace back into a node with virtual time.
+//
+// Recording is enabled by pointing GLOMERS_RECORD_DIR at a directory, every
+// node then writes <dir>/<node-id>.jsonl. A node started with GLOMERS_REPLAY=1
+// expects trace records on stdin instead of plain messages, see cmd/replay.
+package record
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+
+	"glomers/clock"
+	"glomers/logging"
+)
+
+const (
+	EnvDir    = "GLOMERS_RECORD_DIR"
+	EnvReplay = "GLOMERS_REPLAY"
+)
+
+// Directions of a Record
+const (
+	In  = "in"
+	Out = "out"
+	End = "end" // Marks the time the recording stopped, carries no message
+)
+
+var logger = logging.Component("record")
+
+// Epoch is where the virtual clock starts when replaying.
+var Epoch = time.Unix(0, 0).UTC()
+
+// Record is one line of a trace file.
+type Record struct {
+	// Nanoseconds since the node started
+	T   int64           `json:"t"`
+	Dir string          `json:"dir"`
+	Msg json.RawMessage `json:"msg,omitempty"`
+}
+
+// Attach wires recording or replay into n based on the environment. It must
+// be called before n.Run.
+func Attach(n *maelstrom.Node) {
+	if os.Getenv(EnvReplay) != "" {
+		vc := clock.NewVirtual(Epoch)
+		clock.Set(vc)
+		n.Stdin = Replay(n.Stdin, vc)
+		return
+	}
+
+	if dir := os.Getenv(EnvDir); dir != "" {
+		r := &recorder{dir: dir, start: time.Now()}
+		n.Stdin = io.TeeReader(n.Stdin, &lineWriter{dir: In, r: r})
+		n.Stdout = io.MultiWriter(n.Stdout, &lineWriter{dir: Out, r: r})
+	}
+}
+
+// Replay turns a stream of trace records into the plain messages a node
+// expects, advancing vc to each record's timestamp before handing it over.
+func Replay(trace io.Reader, vc *clock.Virtual) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		scanner := bufio.NewScanner(trace)
+		scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+		for scanner.Scan() {
+			var rec Record
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				pw.CloseWithError(fmt.Errorf("bad trace record: %w", err))
+				return
+			}
+			vc.Advance(Epoch.Add(time.Duration(rec.T)))
+			if rec.Dir != In {
+				continue // Outputs are only there to be compared against
+			}
+			if _, err := pw.Write(append(rec.Msg, '\n')); err != nil {
+				return
+			}
+		}
+		pw.CloseWithError(scanner.Err())
+	}()
+	return pr
+}
+
+type recorder struct {
+	mu    sync.Mutex
+	dir   string
+	start time.Time
+	file  *os.File
+	// Set once opening the trace file failed, so we stop trying
+	broken bool
+}
+
+func (r *recorder) write(dir string, line []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.broken {
+		return
+	}
+	if r.file == nil {
+		// We only learn who we are from the first inbound message (init)
+		var msg maelstrom.Message
+		if err := json.Unmarshal(line, &msg); err != nil || msg.Dest == "" {
+			return
+		}
+		f, err := os.Create(filepath.Join(r.dir, msg.Dest+".jsonl"))
+		if err != nil {
+			logger.Error("Disabling recording", "err", err)
+			r.broken = true
+			return
+		}
+		r.file = f
+	}
+
+	buf, err := json.Marshal(Record{
+		T:   time.Since(r.start).Nanoseconds(),
+		Dir: dir,
+		Msg: json.RawMessage(line),
+	})
+	if err != nil {
+		logger.Warn("Skipping unrecordable line", "line", line, "err", err)
+		return
+	}
+	if _, err := r.file.Write(append(buf, '\n')); err != nil {
+		logger.Warn("Error writing trace record", "err", err)
+	}
+}
+
+// lineWriter splits whatever is written to it into lines and records them.
+type lineWriter struct {
+	dir string
+	r   *recorder
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if line := bytes.TrimSpace(w.buf[:i]); len(line) > 0 {
+			w.r.write(w.dir, append([]byte(nil), line...))
+		}
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
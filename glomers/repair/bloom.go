@@ -0,0 +1,247 @@
+package repair
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/bits"
+	"math/rand"
+	"strconv"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+
+	"glomers/logging"
+	"glomers/node"
+	"glomers/store"
+)
+
+const (
+	// After this many pulls in a row leaving a peer with more values than us,
+	// our filter keeps matching something we lack and the next round is an
+	// exact merkle sync instead
+	bloomStallRounds = 3
+	// Values per answer, and maxValueBytes of them, the rest comes with the
+	// next pull
+	bloomMaxValues = 4096
+	// Bytes of a filter, half of maxValueBytes to leave room for base64 and
+	// parts that get more than their share of values
+	bloomMaxFilterBytes = maxValueBytes / 2
+)
+
+// bloomFilter is sized for the number of values it holds and the configured
+// false positive rate. Every filter gets a fresh seed, so a value that
+// collides once is unlikely to collide again next round.
+type bloomFilter struct {
+	Bits []byte `json:"bits"` // base64 on the wire
+	K    int    `json:"k"`
+	Seed uint64 `json:"seed,string"`
+}
+
+// bloomBits returns the bits of a filter of n values.
+func bloomBits(n int, fpRate float64) int {
+	return max(int(math.Ceil(-float64(max(n, 1))*math.Log(fpRate)/(math.Ln2*math.Ln2))), 64)
+}
+
+func newBloomFilter(values []store.Value, fpRate float64) *bloomFilter {
+	n := float64(max(len(values), 1))
+	m := bloomBits(len(values), fpRate)
+	f := &bloomFilter{
+		Bits: make([]byte, (m+7)/8),
+		K:    max(int(math.Round(float64(m)/n*math.Ln2)), 1),
+		Seed: rand.Uint64(),
+	}
+	for _, v := range values {
+		f.locate(v, func(bit uint64) bool {
+			f.Bits[bit/8] |= 1 << (bit % 8)
+			return true
+		})
+	}
+	return f
+}
+
+func (f *bloomFilter) has(v store.Value) bool {
+	return f.locate(v, func(bit uint64) bool {
+		return f.Bits[bit/8]&(1<<(bit%8)) != 0
+	})
+}
+
+// locate calls fn with the K bits of v until it returns false, by double
+// hashing.
+func (f *bloomFilter) locate(v store.Value, fn func(bit uint64) bool) bool {
+	m := uint64(len(f.Bits)) * 8
+	h1 := mix(hashValue(v) ^ f.Seed)
+	h2 := mix(h1) | 1
+	for i := 0; i < f.K; i++ {
+		if !fn((h1 + uint64(i)*h2) % m) {
+			return false
+		}
+	}
+	return true
+}
+
+// bloomSync pulls from peer whatever isn't in a filter of our values. It only
+// ever pulls, peer catches up on our values when it pulls from us. Filters
+// over bloomMaxFilterBytes are split: values are partitioned by hash, and each
+// part gets a filter and a pull of its own.
+func (r *Repairer) bloomSync(peer string) (pulled, pushed int, err error) {
+	s, err := r.started()
+	if err != nil {
+		return 0, 0, err
+	}
+	if r.bloomStalls[peer] >= bloomStallRounds {
+		logger.Debug("Bloom pulls stalled, syncing exactly", "peer", peer)
+		delete(r.bloomStalls, peer)
+		return r.merkleSync(peer)
+	}
+
+	fpRate := r.cfg.Get().BloomFPRate
+	all := s.messages.View()
+	parts := bloomParts(all.Len(), fpRate)
+	values := make([][]store.Value, parts)
+	ours := make([]bloomSummary, parts)
+	all.Each(0, func(v store.Value) {
+		h := hashValue(v)
+		part := partOf(h, parts)
+		values[part] = append(values[part], v)
+		ours[part].add(h)
+	})
+
+	settled, differ := true, false
+	for part := range values {
+		var reply struct {
+			Messages []store.Value `json:"messages"`
+			Count    int           `json:"count"`
+			Hash     uint64        `json:"hash,string"`
+			More     bool          `json:"more"`
+		}
+		if err := r.rpc(peer, map[string]any{
+			"type":   "bloom_pull",
+			"filter": newBloomFilter(values[part], fpRate),
+			"part":   part,
+			"parts":  parts,
+		}, &reply); err != nil {
+			return pulled, 0, err
+		}
+		added, err := s.messages.Add(reply.Messages...)
+		if err != nil {
+			return pulled, 0, err
+		}
+		r.received(peer, added)
+		pulled += len(added)
+		for _, v := range added {
+			if h := hashValue(v); partOf(h, parts) == part {
+				ours[part].add(h)
+			}
+		}
+		settled = settled && !reply.More
+		differ = differ || ours[part] != bloomSummary{reply.Count, reply.Hash}
+	}
+
+	// Once peer had nothing more for us, the parts should be the same unless
+	// false positives hid some of its values, or we have some it doesn't.
+	// Either way an exact sync settles it.
+	switch {
+	case settled && differ:
+		r.bloomStalls[peer]++
+		logger.Debug("Bloom pull left us apart", "peer", peer, "rounds", r.bloomStalls[peer])
+	case settled:
+		delete(r.bloomStalls, peer)
+	}
+	return pulled, 0, nil
+}
+
+// bloomSummary is the count and XOR of the hashes of a part's values.
+type bloomSummary struct {
+	count int
+	hash  uint64
+}
+
+func (b *bloomSummary) add(h uint64) {
+	b.count++
+	b.hash ^= h
+}
+
+// bloomParts returns how many parts n values need for their filters to fit in
+// bloomMaxFilterBytes.
+func bloomParts(n int, fpRate float64) int {
+	return max((bloomBits(n, fpRate)/8+bloomMaxFilterBytes-1)/bloomMaxFilterBytes, 1)
+}
+
+// partOf spreads hashes evenly over parts.
+func partOf(h uint64, parts int) int {
+	hi, _ := bits.Mul64(h, uint64(parts))
+	return int(hi)
+}
+
+// bloomPullHandler answers with our values of the requested part the
+// sender's filter doesn't hold, at most bloomMaxValues or maxValueBytes of
+// them, along with the count and XOR of the hashes of all our values in the
+// part. A pull without part and parts is for every value.
+//
+//	Request
+//	{
+//	  "type": "bloom_pull",
+//	  "filter": {"bits": "base64...", "k": 7, "seed": "8811027341"},
+//	  "part": 0,
+//	  "parts": 2
+//	}
+//
+//	Response
+//	{
+//	  "type": "bloom_pull_ok",
+//	  "messages": [25],
+//	  "count": 4,
+//	  "hash": "1311768467463790320",
+//	  "more": false
+//	}
+func (r *Repairer) bloomPullHandler(msg maelstrom.Message) error {
+	s, err := r.started()
+	if err != nil {
+		return err
+	}
+	body := struct {
+		Filter *bloomFilter `json:"filter"`
+		Part   int          `json:"part"`
+		Parts  int          `json:"parts"`
+	}{Parts: 1}
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
+	}
+	if f := body.Filter; f == nil || len(f.Bits) == 0 || f.K < 1 || f.K > 64 {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, "bloom filter needs bits and 1 to 64 hashes")
+	}
+	if body.Parts < 1 || body.Part < 0 || body.Part >= body.Parts {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest,
+			fmt.Sprintf("no part %d of %d", body.Part, body.Parts))
+	}
+
+	out := []store.Value{}
+	var summary bloomSummary
+	more, size := false, 0
+	s.messages.View().Each(0, func(v store.Value) {
+		h := hashValue(v)
+		if partOf(h, body.Parts) != body.Part {
+			return
+		}
+		summary.add(h)
+		if more || body.Filter.has(v) {
+			return
+		}
+		if len(out) == bloomMaxValues || (len(out) > 0 && size+len(v) > maxValueBytes) {
+			more = true
+			return
+		}
+		out = append(out, v)
+		size += len(v) + 1
+	})
+
+	logging.WithMsg(logger, msg).Debug("Answered bloom pull", "part", body.Part, "parts", body.Parts,
+		"count", len(out), "more", more)
+	return node.Reply(r.n, msg, map[string]any{
+		"type":     "bloom_pull_ok",
+		"messages": out,
+		"count":    summary.count,
+		"hash":     strconv.FormatUint(summary.hash, 10),
+		"more":     more,
+	})
+}
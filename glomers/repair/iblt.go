@@ -0,0 +1,370 @@
+package repair
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/bits"
+	"sync"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+
+	"glomers/logging"
+	"glomers/node"
+	"glomers/store"
+)
+
+// An invertible Bloom lookup table keeps, in each cell, how many values hash
+// there along with the XOR of their hashes and of the checksums of those.
+// Subtracting one node's table from another's cancels every value they share,
+// and what is left peels apart into the hashes of the symmetric difference as
+// long as the table has comfortably more cells than the difference has values.
+// Each side then looks up its own values by hash.
+const (
+	// Each value goes to one cell of each of ibltHashes equal parts
+	ibltHashes = 3
+	ibltMin    = 30
+	// Maelstrom's Go node can't read a line over 64KB, base64 makes a cell
+	// 32 bytes so this leaves room for the envelope
+	ibltMax = 1800
+	// Bytes per cell on the wire: count, key sum and check sum
+	ibltCellSize = 24
+
+	// The estimator is one small table per stratum, a value lands in stratum
+	// i with probability 2^-(i+1)
+	strataLevels = 16
+	strataCells  = 30
+)
+
+type iblt struct {
+	count  []int64
+	keys   []uint64
+	checks []uint64
+}
+
+func newIBLT(cells int) *iblt {
+	cells = (cells + ibltHashes - 1) / ibltHashes * ibltHashes
+	return &iblt{
+		count:  make([]int64, cells),
+		keys:   make([]uint64, cells),
+		checks: make([]uint64, cells),
+	}
+}
+
+// ibltFor returns a table of cells cells holding values.
+func ibltFor(values store.View, cells int) *iblt {
+	t := newIBLT(cells)
+	values.Each(0, func(v store.Value) {
+		t.insert(hashValue(v), 1)
+	})
+	return t
+}
+
+// ibltCells is how big a table needs to be to decode a difference of d most of
+// the time.
+func ibltCells(d int) int {
+	return min(max(2*d, ibltMin), ibltMax)
+}
+
+// ibltRetryCells is how many cells to ask for once a table of cells didn't
+// decode, ok is false when none we can send is any bigger.
+func ibltRetryCells(cells int) (next int, ok bool) {
+	return min(2*cells, ibltMax), cells < ibltMax
+}
+
+// cell returns where the j-th cell of the value hashing to key is.
+func (t *iblt) cell(key uint64, j int) int {
+	part := len(t.count) / ibltHashes
+	return j*part + int(mix(key+uint64(j)*0x9e3779b97f4a7c15)%uint64(part))
+}
+
+func (t *iblt) insert(key uint64, sign int64) {
+	for j := 0; j < ibltHashes; j++ {
+		i := t.cell(key, j)
+		t.count[i] += sign
+		t.keys[i] ^= key
+		t.checks[i] ^= checksum(key)
+	}
+}
+
+// checksum tells a cell holding a single value from one where several XOR
+// into something that only looks like a value's hash.
+func checksum(key uint64) uint64 {
+	return mix(key ^ 0x5bd1e9955bd1e995)
+}
+
+// subtract returns t minus o, both must have the same size.
+func (t *iblt) subtract(o *iblt) *iblt {
+	out := newIBLT(len(t.count))
+	for i := range t.count {
+		out.count[i] = t.count[i] - o.count[i]
+		out.keys[i] = t.keys[i] ^ o.keys[i]
+		out.checks[i] = t.checks[i] ^ o.checks[i]
+	}
+	return out
+}
+
+func (t *iblt) pure(i int) bool {
+	return (t.count[i] == 1 || t.count[i] == -1) && t.checks[i] == checksum(t.keys[i])
+}
+
+// decode peels a difference table, which it empties, into the hashes of the
+// values only the first side had and of the ones only the second had. ok is
+// false when it got stuck with cells left, the table was too small.
+func (t *iblt) decode() (first, second []uint64, ok bool) {
+	var queue []int
+	for i := range t.count {
+		if t.pure(i) {
+			queue = append(queue, i)
+		}
+	}
+	for len(queue) > 0 {
+		i := queue[0]
+		queue = queue[1:]
+		if !t.pure(i) {
+			continue // Peeled through another cell already
+		}
+		key, sign := t.keys[i], t.count[i]
+		if sign > 0 {
+			first = append(first, key)
+		} else {
+			second = append(second, key)
+		}
+		t.insert(key, -sign)
+		for j := 0; j < ibltHashes; j++ {
+			if k := t.cell(key, j); t.pure(k) {
+				queue = append(queue, k)
+			}
+		}
+	}
+	for i := range t.count {
+		if t.count[i] != 0 || t.keys[i] != 0 || t.checks[i] != 0 {
+			return first, second, false
+		}
+	}
+	return first, second, true
+}
+
+func (t *iblt) MarshalJSON() ([]byte, error) {
+	buf := make([]byte, 0, len(t.count)*ibltCellSize)
+	for i := range t.count {
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(t.count[i]))
+		buf = binary.LittleEndian.AppendUint64(buf, t.keys[i])
+		buf = binary.LittleEndian.AppendUint64(buf, t.checks[i])
+	}
+	return json.Marshal(buf) // base64
+}
+
+func (t *iblt) UnmarshalJSON(data []byte) error {
+	var buf []byte
+	if err := json.Unmarshal(data, &buf); err != nil {
+		return err
+	}
+	cells := len(buf) / ibltCellSize
+	if len(buf)%ibltCellSize != 0 || cells == 0 || cells%ibltHashes != 0 || cells > ibltMax {
+		return fmt.Errorf("bad iblt of %d bytes", len(buf))
+	}
+	*t = *newIBLT(cells)
+	for i := range t.count {
+		cell := buf[i*ibltCellSize:]
+		t.count[i] = int64(binary.LittleEndian.Uint64(cell))
+		t.keys[i] = binary.LittleEndian.Uint64(cell[8:])
+		t.checks[i] = binary.LittleEndian.Uint64(cell[16:])
+	}
+	return nil
+}
+
+// strataEstimator guesses the size of the difference between two sets from a
+// fixed few kilobytes, so the table sent back can be sized for it. It is kept
+// up to date as values are added.
+type strataEstimator struct {
+	mu     sync.Mutex
+	levels [strataLevels]*iblt
+}
+
+func newStrataEstimator() *strataEstimator {
+	s := &strataEstimator{}
+	for i := range s.levels {
+		s.levels[i] = newIBLT(strataCells)
+	}
+	return s
+}
+
+func (s *strataEstimator) add(values []store.Value) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, v := range values {
+		key := hashValue(v)
+		// A different hash from the tables', or every stratum would collide
+		// the same way
+		level := min(bits.TrailingZeros64(mix(key^0x2545f4914f6cdd1d)), strataLevels-1)
+		s.levels[level].insert(key, 1)
+	}
+}
+
+// estimate decodes the strata from the sparsest down, once one fails the
+// ones decoded so far stand for that fraction of the difference.
+func (s *strataEstimator) estimate(theirs [strataLevels]*iblt) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count := 0
+	for i := strataLevels - 1; i >= 0; i-- {
+		first, second, ok := s.levels[i].subtract(theirs[i]).decode()
+		if !ok {
+			return max(count, 1) << (i + 1)
+		}
+		count += len(first) + len(second)
+	}
+	return count
+}
+
+func (s *strataEstimator) MarshalJSON() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return json.Marshal(s.levels)
+}
+
+type ibltSyncReply struct {
+	Estimate int   `json:"estimate"`
+	Table    *iblt `json:"table"`
+}
+
+// ibltSync sends our estimator and gets back peer's table sized for the
+// estimated difference, subtracting ours leaves the hashes of the difference.
+// The values only we have are pushed to peer, which answers with the ones
+// only it has. When the
+// estimate was too low to decode it asks again for a table twice the size,
+// and a difference too big for any table we can send is left to a merkle
+// sync.
+func (r *Repairer) ibltSync(peer string) (pulled, pushed int, err error) {
+	s, err := r.started()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var reply ibltSyncReply
+	if err := r.rpc(peer, map[string]any{
+		"type":   "iblt_sync",
+		"strata": s.strata,
+	}, &reply); err != nil {
+		return 0, 0, err
+	}
+	estimate := reply.Estimate
+	for {
+		if reply.Table == nil {
+			return 0, 0, nil // Nothing to reconcile
+		}
+		cells := len(reply.Table.count)
+		all := s.messages.View()
+		ours, theirs, ok := ibltFor(all, cells).subtract(reply.Table).decode()
+		if ok {
+			push := byHash(all, ours)
+			pulled, err := r.exchange(peer, push, theirs)
+			if err != nil {
+				return 0, 0, err
+			}
+			added, err := s.messages.Add(pulled...)
+			if err != nil {
+				return 0, 0, err
+			}
+			r.received(peer, added)
+			return len(added), len(push), nil
+		}
+		next, ok := ibltRetryCells(cells)
+		if !ok {
+			logger.Debug("Difference too big for an IBLT, falling back to merkle", "peer", peer, "estimate", estimate)
+			return r.merkleSync(peer)
+		}
+
+		logger.Debug("IBLT didn't decode, asking for a bigger one", "peer", peer, "estimate", estimate, "cells", cells)
+		reply = ibltSyncReply{}
+		if err := r.rpc(peer, map[string]any{
+			"type":  "iblt_sync",
+			"cells": next,
+		}, &reply); err != nil {
+			return 0, 0, err
+		}
+	}
+}
+
+// ibltSyncHandler answers with a table of our values, sized for the difference
+// the sender's estimator suggests, or as many cells as it asks for. No table
+// means the estimators were identical.
+//
+//	Request
+//	{
+//	  "type": "iblt_sync",
+//	  "strata": ["base64...", ... 16 tables]
+//	}
+//	or
+//	{
+//	  "type": "iblt_sync",
+//	  "cells": 120
+//	}
+//
+//	Response
+//	{
+//	  "type": "iblt_sync_ok",
+//	  "estimate": 12,
+//	  "table": "base64..."
+//	}
+func (r *Repairer) ibltSyncHandler(msg maelstrom.Message) error {
+	s, err := r.started()
+	if err != nil {
+		return err
+	}
+	var body struct {
+		Strata []*iblt `json:"strata"`
+		Cells  int     `json:"cells"`
+	}
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
+	}
+
+	reply := map[string]any{"type": "iblt_sync_ok"}
+	cells := body.Cells
+	if body.Strata != nil {
+		var theirs [strataLevels]*iblt
+		if len(body.Strata) != strataLevels {
+			return maelstrom.NewRPCError(maelstrom.MalformedRequest, fmt.Sprintf("strata needs %d levels", strataLevels))
+		}
+		for i, t := range body.Strata {
+			if t == nil || len(t.count) != len(s.strata.levels[i].count) {
+				return maelstrom.NewRPCError(maelstrom.MalformedRequest, fmt.Sprintf("strata level %d has the wrong size", i))
+			}
+			theirs[i] = t
+		}
+		estimate := s.strata.estimate(theirs)
+		reply["estimate"] = estimate
+		if estimate == 0 {
+			return node.Reply(r.n, msg, reply)
+		}
+		cells = ibltCells(estimate)
+	}
+	if cells < 1 || cells > ibltMax {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, fmt.Sprintf("cells must be 1 to %d", ibltMax))
+	}
+
+	table := ibltFor(s.messages.View(), cells)
+	logging.WithMsg(logger, msg).Debug("Answered iblt sync", "estimate", reply["estimate"], "cells", len(table.count))
+	reply["table"] = table
+	return node.Reply(r.n, msg, reply)
+}
+
+// byHash returns the values whose hashes are in keys.
+func byHash(values store.View, keys []uint64) []store.Value {
+	if len(keys) == 0 {
+		return nil
+	}
+	want := make(map[uint64]struct{}, len(keys))
+	for _, key := range keys {
+		want[key] = struct{}{}
+	}
+	var out []store.Value
+	values.Each(0, func(v store.Value) {
+		if _, ok := want[hashValue(v)]; ok {
+			out = append(out, v)
+		}
+	})
+	return out
+}
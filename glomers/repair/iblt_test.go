@@ -0,0 +1,167 @@
+package repair
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	"glomers/store"
+)
+
+// values returns n distinct values named after prefix.
+func values(prefix string, n int) []store.Value {
+	out := make([]store.Value, n)
+	for i := range out {
+		out[i] = store.Value(fmt.Sprintf("%q", fmt.Sprint(prefix, i)))
+	}
+	return out
+}
+
+// viewOf returns a view of a store holding vs.
+func viewOf(t *testing.T, vs []store.Value) store.View {
+	s := store.NewMemory()
+	if _, err := s.Add(vs...); err != nil {
+		t.Fatal(err)
+	}
+	return s.View()
+}
+
+// hashes returns the hashes of vs in order.
+func hashes(vs []store.Value) []uint64 {
+	out := make([]uint64, len(vs))
+	for i, v := range vs {
+		out[i] = hashValue(v)
+	}
+	slices.Sort(out)
+	return out
+}
+
+type decodes string
+
+const (
+	firstTry decodes = "first time"
+	retried  decodes = "after retrying"
+	never    decodes = "never"
+)
+
+// A table too small for the difference fails to peel, and ibltSync then asks
+// for one twice as big until it decodes or none we can send is bigger. Each
+// attempt starts from fresh tables, as decode empties the one it peels.
+func TestIBLTDecodeRetries(t *testing.T) {
+	tests := []struct {
+		name       string
+		shared     int
+		onlyOurs   int
+		onlyTheirs int
+		cells      int // The first table, from the estimate
+		want       decodes
+	}{
+		{"no difference", 500, 0, 0, ibltMin, firstTry},
+		{"estimate right", 500, 10, 10, ibltCells(20), firstTry},
+		{"one side only", 500, 0, 25, ibltCells(25), firstTry},
+		{"estimate low", 500, 60, 60, ibltCells(5), retried},
+		{"estimate far off", 1000, 200, 200, ibltMin, retried},
+		{"too big for any table", 100, 1500, 1500, ibltCells(3000), never},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			shared := values("shared", tt.shared)
+			onlyOurs, onlyTheirs := values("ours", tt.onlyOurs), values("theirs", tt.onlyTheirs)
+			ours := viewOf(t, append(slices.Clone(shared), onlyOurs...))
+			theirs := viewOf(t, append(slices.Clone(shared), onlyTheirs...))
+
+			attempts, cells := 0, tt.cells
+			for {
+				attempts++
+				first, second, ok := ibltFor(ours, cells).subtract(ibltFor(theirs, cells)).decode()
+				if ok {
+					if tt.want == never {
+						t.Fatalf("decoded with %d cells, want no table to", cells)
+					}
+					slices.Sort(first)
+					slices.Sort(second)
+					if !slices.Equal(first, hashes(onlyOurs)) || !slices.Equal(second, hashes(onlyTheirs)) {
+						t.Fatalf("decoded %d and %d hashes, want %d and %d", len(first), len(second), tt.onlyOurs, tt.onlyTheirs)
+					}
+					if got := byHash(ours, first); len(got) != tt.onlyOurs {
+						t.Errorf("looked up %d of our values, want %d", len(got), tt.onlyOurs)
+					}
+					break
+				}
+				next, ok := ibltRetryCells(cells)
+				if !ok {
+					if tt.want != never {
+						t.Fatalf("no table up to %d cells decoded", cells)
+					}
+					if cells != ibltMax {
+						t.Errorf("gave up at %d cells, want %d", cells, ibltMax)
+					}
+					return
+				}
+				if next <= cells {
+					t.Fatalf("retry with %d cells after %d", next, cells)
+				}
+				cells = next
+			}
+			if (attempts == 1) != (tt.want == firstTry) {
+				t.Errorf("decoded after %d attempts with %d cells, want %s", attempts, cells, tt.want)
+			}
+		})
+	}
+}
+
+// decode reports a table it couldn't peel entirely, rather than the part it
+// got out of it as if it were the whole difference.
+func TestIBLTDecodeStuck(t *testing.T) {
+	tests := []struct {
+		name  string
+		diff  int
+		cells int
+	}{
+		{"minimum table", 100, ibltMin},
+		{"half the difference", 400, 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table := ibltFor(viewOf(t, values("only", tt.diff)), tt.cells)
+			first, _, ok := table.decode()
+			if ok {
+				t.Fatalf("decoded %d values from %d cells", len(first), tt.cells)
+			}
+			if len(first) >= tt.diff {
+				t.Errorf("peeled %d of %d values and still failed", len(first), tt.diff)
+			}
+		})
+	}
+}
+
+func TestIBLTRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		n     int
+		cells int
+	}{
+		{"empty", 0, ibltMin},
+		{"small", 10, ibltMin},
+		{"largest", 1000, ibltMax},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table := ibltFor(viewOf(t, values("v", tt.n)), tt.cells)
+			buf, err := table.MarshalJSON()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(buf) > 64<<10 {
+				t.Errorf("%d bytes encoded, over Maelstrom's line limit", len(buf))
+			}
+			var got iblt
+			if err := got.UnmarshalJSON(buf); err != nil {
+				t.Fatalf("UnmarshalJSON: %v", err)
+			}
+			if !slices.Equal(got.count, table.count) || !slices.Equal(got.keys, table.keys) || !slices.Equal(got.checks, table.checks) {
+				t.Error("round trip changed the table")
+			}
+		})
+	}
+}
@@ -0,0 +1,265 @@
+package repair
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/bits"
+	"sync"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+
+	"glomers/logging"
+	"glomers/node"
+	"glomers/store"
+)
+
+// Values are spread over 1<<merkleDepth leaves by their hash, and each node of
+// the tree summarises its range with a count and the XOR of the hashes in it,
+// so adding a value only touches the path to its leaf.
+//
+// Nodes are numbered like a heap: the root is 1 and the children of i are 2i
+// and 2i+1, leaves are 1<<merkleDepth onwards.
+const (
+	merkleDepth = 12
+	// How many levels a compare descends per round trip, the whole tree takes
+	// merkleDepth/merkleExpand rounds plus one for the leaves
+	merkleExpand = 4
+	merkleNodes  = 2 << merkleDepth
+	// Nodes per compare, each can come back as 1<<merkleExpand summaries and
+	// Maelstrom's Go node can't read a line over 64KB
+	merkleBatch = 32
+)
+
+type merkleTree struct {
+	mu     sync.RWMutex
+	count  [merkleNodes]int
+	hash   [merkleNodes]uint64
+	leaves [1 << merkleDepth][]store.Value
+}
+
+// merkleNode is the summary of one range as sent on the wire.
+type merkleNode struct {
+	ID    int    `json:"id"`
+	Count int    `json:"count"`
+	Hash  uint64 `json:"hash,string"`
+}
+
+func (a merkleNode) same(b merkleNode) bool {
+	return a.Count == b.Count && a.Hash == b.Hash
+}
+
+func newMerkleTree() *merkleTree {
+	return &merkleTree{}
+}
+
+func (t *merkleTree) add(values []store.Value) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, v := range values {
+		h := hashValue(v)
+		id := 1<<merkleDepth + int(h>>(64-merkleDepth))
+		t.leaves[id-1<<merkleDepth] = append(t.leaves[id-1<<merkleDepth], v)
+		for ; id > 0; id >>= 1 {
+			t.count[id]++
+			t.hash[id] ^= h
+		}
+	}
+}
+
+// node must be called with t.mu held.
+func (t *merkleTree) node(id int) merkleNode {
+	return merkleNode{ID: id, Count: t.count[id], Hash: t.hash[id]}
+}
+
+// values must be called with t.mu held.
+func (t *merkleTree) values(id int) []store.Value {
+	return append([]store.Value{}, t.leaves[id-1<<merkleDepth]...)
+}
+
+func isLeaf(id int) bool {
+	return id >= 1<<merkleDepth
+}
+
+// expansion returns the first and last+1 descendants a compare of id reports.
+func expansion(id int) (int, int) {
+	levels := min(merkleExpand, merkleDepth-(bits.Len(uint(id))-1))
+	return id << levels, (id + 1) << levels
+}
+
+type merkleCompareReply struct {
+	// Which of the requested nodes differ and were expanded
+	Expanded []int `json:"expanded"`
+	// Their non-empty descendants, an absent one is empty
+	Nodes []merkleNode `json:"nodes"`
+	// Every value in the requested leaves that differ, as many leaves as fit
+	// in maxValueBytes
+	Values map[int][]store.Value `json:"values"`
+	// The differing leaves left out to stay under it, to compare again
+	Deferred []int `json:"deferred"`
+}
+
+// merkleSync walks down both trees from the root, a round trip per
+// merkleExpand levels, only following ranges that differ. At the leaves both
+// sides' values are known, we keep what we lack and push what peer lacks.
+func (r *Repairer) merkleSync(peer string) (pulled, pushed int, err error) {
+	s, err := r.started()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var pull, push []store.Value
+	pending := []int{1}
+	for level := 0; len(pending) > 0; level++ {
+		if level > merkleDepth {
+			return 0, 0, fmt.Errorf("no agreement with %s after %d levels", peer, level)
+		}
+		var next []int
+		for len(pending) > 0 {
+			batch := pending[:min(len(pending), merkleBatch)]
+			pending = pending[len(batch):]
+			differ, deferred, lacked, extra, err := r.merkleCompare(peer, s.merkle, batch)
+			if err != nil {
+				return 0, 0, err
+			}
+			pending = append(pending, deferred...)
+			next = append(next, differ...)
+			pull = append(pull, lacked...)
+			push = append(push, extra...)
+		}
+		pending = next
+	}
+
+	added, err := s.messages.Add(pull...)
+	if err != nil {
+		return 0, 0, err
+	}
+	r.received(peer, added)
+	if err := r.push(peer, push); err != nil {
+		return len(pull), 0, err
+	}
+	return len(pull), len(push), nil
+}
+
+// merkleCompare sends peer our summaries of ids, returning the descendants
+// that still differ, the leaves peer had no room to answer, and for the ones
+// it answered the values we lack and the ones peer lacks.
+func (r *Repairer) merkleCompare(peer string, tree *merkleTree, ids []int) (differ, deferred []int, pull, push []store.Value, err error) {
+	nodes := make([]merkleNode, 0, len(ids))
+	tree.mu.RLock()
+	for _, id := range ids {
+		nodes = append(nodes, tree.node(id))
+	}
+	tree.mu.RUnlock()
+
+	var reply merkleCompareReply
+	if err := r.rpc(peer, map[string]any{
+		"type":  "merkle_compare",
+		"nodes": nodes,
+	}, &reply); err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	theirs := make(map[int]merkleNode, len(reply.Nodes))
+	for _, node := range reply.Nodes {
+		theirs[node.ID] = node
+	}
+	tree.mu.RLock()
+	defer tree.mu.RUnlock()
+	for _, id := range reply.Expanded {
+		from, to := expansion(id)
+		for child := from; child < to; child++ {
+			if !tree.node(child).same(theirs[child]) {
+				differ = append(differ, child)
+			}
+		}
+	}
+	for leaf, values := range reply.Values {
+		if !isLeaf(leaf) {
+			continue
+		}
+		mine := tree.values(leaf)
+		pull = append(pull, missing(values, mine)...)
+		push = append(push, missing(mine, values)...)
+	}
+	for _, leaf := range reply.Deferred {
+		if isLeaf(leaf) && leaf < merkleNodes {
+			deferred = append(deferred, leaf)
+		}
+	}
+	return differ, deferred, pull, push, nil
+}
+
+// merkleCompareHandler compares the sender's summaries with ours. Differing
+// inner nodes are answered with our summaries a few levels further down,
+// differing leaves with our values, until they would take more than
+// maxValueBytes. The leaves past that are deferred, at least one is always
+// answered so the sender makes progress.
+//
+//	Request
+//	{
+//	  "type": "merkle_compare",
+//	  "nodes": [{"id": 1, "count": 120, "hash": "1311768467463790320"}]
+//	}
+//
+//	Response
+//	{
+//	  "type": "merkle_compare_ok",
+//	  "expanded": [1],
+//	  "nodes": [{"id": 16, "count": 7, "hash": "..."}, ...],
+//	  "values": {"4097": [12, 800]},
+//	  "deferred": [4100]
+//	}
+func (r *Repairer) merkleCompareHandler(msg maelstrom.Message) error {
+	s, err := r.started()
+	if err != nil {
+		return err
+	}
+	tree := s.merkle
+	var body struct {
+		Nodes []merkleNode `json:"nodes"`
+	}
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
+	}
+
+	reply := merkleCompareReply{Expanded: []int{}, Nodes: []merkleNode{}, Values: map[int][]store.Value{}, Deferred: []int{}}
+	size := 0
+	tree.mu.RLock()
+	for _, theirs := range body.Nodes {
+		if theirs.ID < 1 || theirs.ID >= merkleNodes {
+			tree.mu.RUnlock()
+			return maelstrom.NewRPCError(maelstrom.MalformedRequest, fmt.Sprintf("no merkle node %d", theirs.ID))
+		}
+		if tree.node(theirs.ID).same(theirs) {
+			continue
+		}
+		if isLeaf(theirs.ID) {
+			values := tree.values(theirs.ID)
+			if len(reply.Values) > 0 && size+valueBytes(values) > maxValueBytes {
+				reply.Deferred = append(reply.Deferred, theirs.ID)
+				continue
+			}
+			reply.Values[theirs.ID] = values
+			size += valueBytes(values)
+			continue
+		}
+		reply.Expanded = append(reply.Expanded, theirs.ID)
+		from, to := expansion(theirs.ID)
+		for child := from; child < to; child++ {
+			if tree.count[child] > 0 {
+				reply.Nodes = append(reply.Nodes, tree.node(child))
+			}
+		}
+	}
+	tree.mu.RUnlock()
+
+	logging.WithMsg(logger, msg).Debug("Compared merkle nodes",
+		"nodes", len(body.Nodes), "expanded", len(reply.Expanded), "leaves", len(reply.Values), "deferred", len(reply.Deferred))
+	return node.Reply(r.n, msg, map[string]any{
+		"type":     "merkle_compare_ok",
+		"expanded": reply.Expanded,
+		"nodes":    reply.Nodes,
+		"values":   reply.Values,
+		"deferred": reply.Deferred,
+	})
+}
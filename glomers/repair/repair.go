@@ -0,0 +1,401 @@
+// Package repair runs anti-entropy between broadcast nodes: every
+// RepairInterval a node picks a random peer, works out which values one of
+// them has and the other doesn't, and copies them over. It heals whatever the
+// broadcast strategy lost to partitions, crashes or give-ups, whatever order
+// values arrived in.
+//
+// How the difference is found is the repair mode (config "repair"):
+//
+//	merkle  compare hash-range summaries top down, only descending where they differ
+//	bloom   send a Bloom filter of our values, the peer answers with the ones not in it
+//	iblt    send a Strata estimator, the peer answers with an invertible Bloom lookup
+//	        table sized for the difference, which decodes to the difference itself
+//
+// Every node answers every mode, the config only picks what a node initiates.
+package repair
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"slices"
+	"strconv"
+	"sync"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+
+	"glomers/clock"
+	"glomers/config"
+	"glomers/logging"
+	"glomers/metrics"
+	"glomers/node"
+	"glomers/store"
+)
+
+var logger = logging.Component("repair")
+
+// Bytes of values a message between nodes carries at most, Maelstrom's Go node
+// can't read a line over 64KB
+const maxValueBytes = 48 << 10
+
+// A mode reconciles our values with peer's, returning how many values it
+// pulled in and pushed out.
+type mode func(r *Repairer, peer string) (pulled, pushed int, err error)
+
+var modes = map[string]mode{
+	"merkle": (*Repairer).merkleSync,
+	"bloom":  (*Repairer).bloomSync,
+	"iblt":   (*Repairer).ibltSync,
+}
+
+// Peers is who a repair may pick, like a membership.Membership.
+type Peers interface {
+	Peers() []string
+}
+
+// Lagging is implemented by Peers that know how many of our values each peer
+// hasn't acknowledged, like a lag.Tracker. Repairs then favour the peers
+// furthest behind, and tell it what a peer has once repaired.
+type Lagging interface {
+	Unacked(peer string) int
+	Acked(peer string, values []store.Value)
+}
+
+// Deliveries is implemented by Peers that acknowledge values to the peer they
+// came from, like a delivery.Tracker. Repairs tell it what they pulled in.
+type Deliveries interface {
+	Received(peer string, values []store.Value)
+}
+
+// Repairer is the anti-entropy of one node.
+type Repairer struct {
+	n     *maelstrom.Node
+	cfg   *config.Store
+	peers Peers
+	// Set when peers is Lagging or Deliveries
+	lag        Lagging
+	deliveries Deliveries
+
+	// Set by Start, handlers refuse to answer until then
+	mu    sync.RWMutex
+	state *state
+
+	// Rounds in a row each peer looked ahead of us after a bloom pull, only
+	// touched by the repair goroutine
+	bloomStalls map[string]int
+}
+
+// Register installs the repair handlers on n. Maelstrom handlers can't be
+// added once the node runs, so this happens up front and Start, from the init
+// handler, hands over the store.
+func Register(n *maelstrom.Node, cfg *config.Store, peers Peers) *Repairer {
+	r := &Repairer{n: n, cfg: cfg, peers: peers, bloomStalls: make(map[string]int)}
+	r.lag, _ = peers.(Lagging)
+	r.deliveries, _ = peers.(Deliveries)
+	n.Handle("merkle_compare", r.merkleCompareHandler)
+	n.Handle("bloom_pull", r.bloomPullHandler)
+	n.Handle("iblt_sync", r.ibltSyncHandler)
+	n.Handle("repair_push", r.pushHandler)
+	return r
+}
+
+// state is the values being repaired, along with the summaries the modes
+// keep up to date as values are added.
+type state struct {
+	messages *store.Messages
+	merkle   *merkleTree
+	strata   *strataEstimator
+}
+
+// Start keeps the summaries of messages up to date and starts initiating
+// repairs.
+func (r *Repairer) Start(messages *store.Messages) {
+	s := &state{messages: messages, merkle: newMerkleTree(), strata: newStrataEstimator()}
+	track := func(values []store.Value) {
+		s.merkle.add(values)
+		s.strata.add(values)
+	}
+	track(messages.Watch(track))
+
+	r.mu.Lock()
+	r.state = s
+	r.mu.Unlock()
+
+	ticker := clock.NewTicker(r.cfg.Get().RepairInterval)
+	r.cfg.Subscribe(func(old, cur config.Config) {
+		if cur.RepairInterval != old.RepairInterval {
+			ticker.Reset(cur.RepairInterval)
+		}
+	})
+	go func() {
+		for range ticker.C() {
+			r.repair()
+		}
+	}()
+}
+
+// started returns what Start set, or an error for the peer to retry later.
+func (r *Repairer) started() (*state, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.state == nil {
+		return nil, maelstrom.NewRPCError(maelstrom.TemporarilyUnavailable, "not initialised yet")
+	}
+	return r.state, nil
+}
+
+// repair runs one round with a random peer, if a mode is configured. Rounds
+// never overlap, a slow one just delays the next tick.
+func (r *Repairer) repair() {
+	name := r.cfg.Get().Repair
+	if name == "" {
+		return
+	}
+	peer := r.randomPeer()
+	if peer == "" {
+		return
+	}
+	s, err := r.started()
+	if err != nil {
+		return
+	}
+	before := s.messages.All()
+	pulled, pushed, err := modes[name](r, peer)
+	if err != nil {
+		logger.Warn("Repair failed", "mode", name, "peer", peer, "err", err)
+		return
+	}
+	// Merkle and IBLT rounds leave peer with everything we had, a Bloom
+	// filter's false positives may not have been pushed
+	if r.lag != nil && name != "bloom" {
+		r.lag.Acked(peer, before)
+	}
+	if pulled > 0 || pushed > 0 {
+		logger.Info("Repaired", "mode", name, "peer", peer, "pulled", pulled, "pushed", pushed)
+	}
+}
+
+// randomPeer picks a peer at random, in proportion to how many values it
+// hasn't acknowledged, plus one, when that is known.
+func (r *Repairer) randomPeer() string {
+	peers := r.peers.Peers()
+	if len(peers) == 0 {
+		return ""
+	}
+	if r.lag == nil {
+		return peers[rand.Intn(len(peers))]
+	}
+	weights := make([]int, len(peers))
+	total := 0
+	for i, peer := range peers {
+		weights[i] = r.lag.Unacked(peer) + 1
+		total += weights[i]
+	}
+	pick := rand.Intn(total)
+	for i, w := range weights {
+		if pick < w {
+			return peers[i]
+		}
+		pick -= w
+	}
+	return peers[len(peers)-1]
+}
+
+// rpc sends body to peer and decodes the reply into reply.
+func (r *Repairer) rpc(peer string, body map[string]any, reply any) error {
+	ctx, cancel := clock.WithTimeout(context.Background(), r.cfg.Get().RPCTimeout)
+	defer cancel()
+	typ, _ := body["type"].(string)
+	start := clock.Now()
+	msg, err := node.SyncRPC(ctx, r.n, peer, body)
+	metrics.RPC(typ, start, err)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(msg.Body, reply); err != nil {
+		return fmt.Errorf("bad reply from %s: %w", peer, err)
+	}
+	return nil
+}
+
+// Hashes a repair_push asks for at most, each takes about 23 bytes
+const maxWant = 1500
+
+// push sends peer the values it told us it is missing, in as many pushes as
+// it takes to keep each under maxValueBytes.
+func (r *Repairer) push(peer string, values []store.Value) error {
+	for len(values) > 0 {
+		n, size := 0, 0
+		for n < len(values) && (n == 0 || size+len(values[n])+1 <= maxValueBytes) {
+			size += len(values[n]) + 1
+			n++
+		}
+		if _, err := r.pushRPC(peer, values[:n], nil); err != nil {
+			return err
+		}
+		values = values[n:]
+	}
+	return nil
+}
+
+// valueBytes is about how much values take in a JSON array.
+func valueBytes(values []store.Value) int {
+	size := 0
+	for _, v := range values {
+		size += len(v) + 1
+	}
+	return size
+}
+
+// exchange sends peer the values it is missing, and returns the ones of its
+// values that hash to want. Both go in as many messages as they need.
+func (r *Repairer) exchange(peer string, values []store.Value, want []uint64) ([]store.Value, error) {
+	if err := r.push(peer, values); err != nil {
+		return nil, err
+	}
+	var out []store.Value
+	for len(want) > 0 {
+		got, err := r.pushRPC(peer, nil, want[:min(len(want), maxWant)])
+		if err != nil {
+			return out, err
+		}
+		if len(got) == 0 {
+			break // peer doesn't have them anymore
+		}
+		out = append(out, got...)
+		// What didn't fit in the answer is asked for again
+		answered := make(map[uint64]bool, len(got))
+		for _, v := range got {
+			answered[hashValue(v)] = true
+		}
+		want = slices.DeleteFunc(want, func(key uint64) bool { return answered[key] })
+	}
+	return out, nil
+}
+
+// pushRPC is a single repair_push.
+func (r *Repairer) pushRPC(peer string, values []store.Value, want []uint64) ([]store.Value, error) {
+	if values == nil {
+		values = []store.Value{}
+	}
+	body := map[string]any{
+		"type":     "repair_push",
+		"messages": values,
+	}
+	if len(want) > 0 {
+		hashes := make([]string, len(want))
+		for i, key := range want {
+			hashes[i] = strconv.FormatUint(key, 10)
+		}
+		body["want"] = hashes
+	}
+	var reply struct {
+		Messages []store.Value `json:"messages"`
+	}
+	if err := r.rpc(peer, body, &reply); err != nil {
+		return nil, err
+	}
+	return reply.Messages, nil
+}
+
+// pushHandler stores values a repairing peer found we were missing, and
+// answers with those of ours it wants, by hash, as many as fit in
+// maxValueBytes.
+//
+//	Request
+//	{
+//	  "type": "repair_push",
+//	  "messages": [4, 8],
+//	  "want": ["1311768467463790320"]
+//	}
+//
+//	Response
+//	{
+//	  "type": "repair_push_ok",
+//	  "messages": ["fifteen"]
+//	}
+func (r *Repairer) pushHandler(msg maelstrom.Message) error {
+	s, err := r.started()
+	if err != nil {
+		return err
+	}
+	var body struct {
+		Messages []store.Value `json:"messages"`
+		Want     []string      `json:"want"`
+	}
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
+	}
+	want := make([]uint64, len(body.Want))
+	for i, hash := range body.Want {
+		if want[i], err = strconv.ParseUint(hash, 10, 64); err != nil {
+			return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
+		}
+	}
+	added, err := s.messages.Add(body.Messages...)
+	if err != nil {
+		return err
+	}
+	if r.lag != nil {
+		r.lag.Acked(msg.Src, body.Messages)
+	}
+	r.received(msg.Src, added)
+	out := []store.Value{}
+	size := 0
+	for _, v := range byHash(s.messages.View(), want) {
+		if len(out) > 0 && size+len(v)+1 > maxValueBytes {
+			break
+		}
+		out = append(out, v)
+		size += len(v) + 1
+	}
+	logging.WithMsg(logger, msg).Debug("Received repair", "count", len(body.Messages), "added", len(added),
+		"wanted", len(want))
+	return node.Reply(r.n, msg, map[string]any{
+		"type":     "repair_push_ok",
+		"messages": out,
+	})
+}
+
+// received tells delivery tracking about values we took from peer.
+func (r *Repairer) received(peer string, values []store.Value) {
+	if r.deliveries != nil {
+		r.deliveries.Received(peer, values)
+	}
+}
+
+// hashValue is FNV-1a of v's encoding, finished with mix so values that
+// only differ at the end still spread over every bit.
+func hashValue(v store.Value) uint64 {
+	h := uint64(0xcbf29ce484222325)
+	for i := 0; i < len(v); i++ {
+		h ^= uint64(v[i])
+		h *= 0x100000001b3
+	}
+	return mix(h)
+}
+
+// mix is the splitmix64 finaliser, cheap and well spread even for sequential
+// inputs.
+func mix(x uint64) uint64 {
+	z := x + 0x9e3779b97f4a7c15
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+// missing returns the values of want that aren't in have.
+func missing(want, have []store.Value) []store.Value {
+	set := make(map[store.Value]struct{}, len(have))
+	for _, v := range have {
+		set[v] = struct{}{}
+	}
+	var out []store.Value
+	for _, v := range want {
+		if _, ok := set[v]; !ok {
+			out = append(out, v)
+		}
+	}
+	return out
+}
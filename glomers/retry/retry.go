@@ -0,0 +1,617 @@
+// Package retry delivers values to peers until they take them. Every peer has
+// a queue of the values it hasn't acknowledged yet, drained by a single
+// goroutine that sends whatever is waiting in one message and, while the peer
+// doesn't answer, backs off exponentially with jitter. However long a peer is
+// away, it costs one goroutine and at most MaxQueued values in memory, the
+// values added past that are spilled to a file and read back as the queue
+// drains.
+//
+// With a directory the queues are journaled, two files per peer
+//
+//	<peer>.jsonl    {"add": [1, 2]}, {"done": [1]} or {"spill": 120} per line
+//	<peer>.spill    {"add": [3, 4]} per line
+//
+// so a restarted node resumes the deliveries it had pending, the spill
+// offset telling how much of the spill file is already back in the queue. A
+// journal is emptied whenever its queue drains, and rewritten to what is
+// pending when it grows long. Without a directory the spill files go to a
+// temporary one.
+package retry
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"glomers/clock"
+	"glomers/logging"
+	"glomers/metrics"
+	"glomers/store"
+	"glomers/tracing"
+)
+
+// A journal longer than this many lines, and than twice its pending values,
+// is rewritten
+const compactLines = 1024
+
+var logger = logging.Component("retry")
+
+type Options struct {
+	// Where the journals go, the queues are memory only when empty. Can't be
+	// changed by Reconfigure.
+	Dir string
+	// Sync the journal before Add returns
+	Sync bool
+	// The first retry waits about Backoff, every failure after doubles it up
+	// to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Failures in a row before a peer's pending values are given up on, never
+	// when 0
+	MaxRetry int
+	// Values per message, Maelstrom's Go node can't read a line over 64KB
+	MaxBatch int
+	// Values of a peer held in memory, no limit when 0
+	MaxQueued int
+}
+
+// Send delivers values, with the span context of each, to peer and returns
+// once peer has them or the attempt failed.
+type Send func(peer string, values []store.Value, traces []tracing.SpanContext) error
+
+// Queues holds a retry queue per peer.
+type Queues struct {
+	send Send
+	stop chan struct{}
+
+	mu     sync.Mutex
+	opts   Options
+	queues map[string]*queue
+	// Where spill files go without a directory, made on the first spill
+	tmp string
+}
+
+type queue struct {
+	peer   string
+	values []store.Value
+	// Span context of every value, index for index, lost on restart
+	traces  []tracing.SpanContext
+	pending map[store.Value]struct{}
+	// Signalled when values are added to an empty queue
+	wake chan struct{}
+
+	// Only set for durable queues
+	journal *os.File
+	lines   int
+
+	// Values added past MaxQueued, in order. Those from spillRead on haven't
+	// been read back yet, spilled of them. Only set once a queue spills.
+	spill     *os.File
+	spillRead int64
+	spilled   int
+}
+
+type entry struct {
+	Add   []store.Value `json:"add,omitempty"`
+	Done  []store.Value `json:"done,omitempty"`
+	Spill *int64        `json:"spill,omitempty"`
+}
+
+// Open recovers the queues journaled in opts.Dir, if any, and starts
+// delivering what they hold.
+func Open(opts Options, send Send) (*Queues, error) {
+	q := &Queues{
+		send:   send,
+		stop:   make(chan struct{}),
+		opts:   opts,
+		queues: make(map[string]*queue),
+	}
+	metrics.Gauge("retry_pending", func() float64 {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		pending := 0
+		for _, p := range q.queues {
+			pending += len(p.values) + p.spilled
+		}
+		return float64(pending)
+	})
+	metrics.Gauge("retry_spilled", func() float64 {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		spilled := 0
+		for _, p := range q.queues {
+			spilled += p.spilled
+		}
+		return float64(spilled)
+	})
+	if opts.Dir == "" {
+		return q, nil
+	}
+	if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(opts.Dir, "*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, file := range files {
+		peer := strings.TrimSuffix(filepath.Base(file), ".jsonl")
+		p, err := q.queue(peer)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.recover(file); err != nil {
+			return nil, err
+		}
+		if err := q.recoverSpill(p); err != nil {
+			return nil, err
+		}
+		q.refill(p)
+		if len(p.values) > 0 {
+			logger.Info("Recovered pending deliveries", "peer", peer, "values", len(p.values), "spilled", p.spilled)
+			p.signal()
+		}
+	}
+	return q, nil
+}
+
+func (p *queue) recover(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var e entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// Only the last write can be torn
+			logger.Warn("Stopping recovery at unreadable journal entry", "peer", p.peer, "line", line, "err", err)
+			break
+		}
+		p.insert(e.Add, nil)
+		p.remove(e.Done)
+		if e.Spill != nil {
+			p.spillRead = *e.Spill
+		}
+		p.lines++
+	}
+	return scanner.Err()
+}
+
+// recoverSpill counts the values of p's spill file not read back yet, and
+// drops a torn last line.
+func (q *Queues) recoverSpill(p *queue) error {
+	f, err := os.OpenFile(q.spillPath(p), os.O_RDWR|os.O_APPEND, 0o644)
+	if errors.Is(err, os.ErrNotExist) {
+		p.spillRead = 0
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	p.spill = f
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	end := p.spillRead
+	if end >= info.Size() {
+		// Read back entirely before the file was emptied
+		end = 0
+	} else {
+		r := bufio.NewReader(io.NewSectionReader(f, end, info.Size()-end))
+		for {
+			line, err := r.ReadBytes('\n')
+			if err != nil {
+				break
+			}
+			var e entry
+			if err := json.Unmarshal(line, &e); err != nil {
+				logger.Warn("Stopping recovery at unreadable spill entry", "peer", p.peer, "offset", end, "err", err)
+				break
+			}
+			p.spilled += len(e.Add)
+			end += int64(len(line))
+		}
+	}
+	if p.spilled == 0 {
+		p.spillRead, end = 0, 0
+	}
+	return f.Truncate(end)
+}
+
+// Reconfigure applies new options, except for the directory.
+func (q *Queues) Reconfigure(opts Options) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	opts.Dir = q.opts.Dir
+	q.opts = opts
+}
+
+// Add queues values for peer, skipping those still pending in memory, and
+// returns once they are journaled. Those past MaxQueued, or behind values
+// already spilled, are spilled.
+func (q *Queues) Add(peer string, values []store.Value, traces []tracing.SpanContext) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	p, err := q.queue(peer)
+	if err != nil {
+		return err
+	}
+	values, traces = p.unseen(values, traces)
+	if len(values) == 0 {
+		return nil
+	}
+	room := len(values)
+	if q.opts.MaxQueued > 0 {
+		room = 0
+		if p.spilled == 0 {
+			room = min(len(values), max(q.opts.MaxQueued-len(p.values), 0))
+		}
+	}
+	if room > 0 {
+		added := p.insert(values[:room], traces[:room])
+		if err := q.log(p, entry{Add: added}); err != nil {
+			return err
+		}
+	}
+	if room < len(values) {
+		if err := q.spillOut(p, values[room:]); err != nil {
+			return err
+		}
+	}
+	p.signal()
+	return nil
+}
+
+// Pending returns how many values peer hasn't taken yet.
+func (q *Queues) Pending(peer string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if p, ok := q.queues[peer]; ok {
+		return len(p.values) + p.spilled
+	}
+	return 0
+}
+
+// Close stops delivering and closes the journals.
+func (q *Queues) Close() error {
+	close(q.stop)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var errs []error
+	for _, p := range q.queues {
+		if p.journal != nil {
+			errs = append(errs, p.journal.Close())
+		}
+		if p.spill != nil {
+			errs = append(errs, p.spill.Close())
+		}
+	}
+	if q.tmp != "" {
+		errs = append(errs, os.RemoveAll(q.tmp))
+	}
+	return errors.Join(errs...)
+}
+
+// queue returns peer's queue, creating it and its goroutine, q.mu must be
+// held.
+func (q *Queues) queue(peer string) (*queue, error) {
+	if p, ok := q.queues[peer]; ok {
+		return p, nil
+	}
+	p := &queue{
+		peer:    peer,
+		pending: make(map[store.Value]struct{}),
+		wake:    make(chan struct{}, 1),
+	}
+	if q.opts.Dir != "" {
+		journal, err := os.OpenFile(filepath.Join(q.opts.Dir, peer+".jsonl"), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		p.journal = journal
+	}
+	q.queues[peer] = p
+	go q.drain(p)
+	return p, nil
+}
+
+// drain delivers p's values, oldest first, until the queues are closed.
+func (q *Queues) drain(p *queue) {
+	failures := 0
+	for {
+		q.mu.Lock()
+		n := min(len(p.values), max(q.opts.MaxBatch, 1))
+		values, traces := slices.Clone(p.values[:n]), slices.Clone(p.traces[:n])
+		opts := q.opts
+		q.mu.Unlock()
+
+		if n == 0 {
+			select {
+			case <-q.stop:
+				return
+			case <-p.wake:
+				continue
+			}
+		}
+		select {
+		case <-q.stop:
+			return
+		default:
+		}
+
+		err := q.send(p.peer, values, traces)
+		if err == nil {
+			failures = 0
+			q.done(p, values)
+			continue
+		}
+
+		failures++
+		metrics.Inc("retries_total", "peer", p.peer)
+		if opts.MaxRetry > 0 && failures >= opts.MaxRetry {
+			metrics.Add("retry_given_up_total", float64(len(values)), "peer", p.peer)
+			logger.Error("Giving up on deliveries", "peer", p.peer, "values", len(values), "failures", failures, "err", err)
+			failures = 0
+			q.done(p, values)
+			continue
+		}
+		wait := backoff(opts, failures)
+		logger.Debug("Delivery failed, backing off", "peer", p.peer, "values", len(values), "failures", failures,
+			"wait", wait, "err", err)
+		select {
+		case <-q.stop:
+			return
+		case <-clock.After(wait):
+		}
+	}
+}
+
+// done drops values, the head of p, once delivered or given up on, and
+// reads spilled values back in their place.
+func (q *Queues) done(p *queue, values []store.Value) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	p.remove(values)
+	if err := q.log(p, entry{Done: values}); err != nil {
+		logger.Error("Error journaling deliveries", "peer", p.peer, "err", err)
+	}
+	q.refill(p)
+}
+
+// spillPath is where p's spilled values go.
+func (q *Queues) spillPath(p *queue) string {
+	dir := q.opts.Dir
+	if dir == "" {
+		dir = q.tmp
+	}
+	return filepath.Join(dir, p.peer+".spill")
+}
+
+// spillOut appends values to p's spill file, q.mu must be held.
+func (q *Queues) spillOut(p *queue, values []store.Value) error {
+	if p.spill == nil {
+		if q.opts.Dir == "" && q.tmp == "" {
+			tmp, err := os.MkdirTemp("", "glomers-retry-")
+			if err != nil {
+				return err
+			}
+			q.tmp = tmp
+		}
+		f, err := os.OpenFile(q.spillPath(p), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+		if err != nil {
+			return err
+		}
+		p.spill = f
+	}
+	if p.spilled == 0 {
+		logger.Info("Queue full, spilling values to disk", "peer", p.peer, "queued", len(p.values))
+	}
+	buf, err := json.Marshal(entry{Add: values})
+	if err != nil {
+		return err
+	}
+	if _, err := p.spill.Write(append(buf, '\n')); err != nil {
+		return err
+	}
+	p.spilled += len(values)
+	metrics.Add("retry_spilled_total", float64(len(values)), "peer", p.peer)
+	if q.opts.Sync && q.opts.Dir != "" {
+		return p.spill.Sync()
+	}
+	return nil
+}
+
+// refill reads spilled values back into p while it has room for them, and
+// journals how far it got, q.mu must be held.
+func (q *Queues) refill(p *queue) {
+	if p.spilled == 0 || (q.opts.MaxQueued > 0 && len(p.values) >= q.opts.MaxQueued) {
+		return
+	}
+	info, err := p.spill.Stat()
+	if err != nil {
+		logger.Error("Error reading back spilled values", "peer", p.peer, "err", err)
+		return
+	}
+	var added []store.Value
+	read := p.spillRead
+	r := bufio.NewReader(io.NewSectionReader(p.spill, read, info.Size()-read))
+	for p.spilled > 0 && (q.opts.MaxQueued == 0 || len(p.values) < q.opts.MaxQueued) {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			logger.Error("Error reading back spilled values", "peer", p.peer, "offset", read, "err", err)
+			break
+		}
+		var e entry
+		if err := json.Unmarshal(line, &e); err != nil {
+			logger.Error("Error reading back spilled values", "peer", p.peer, "offset", read, "err", err)
+			break
+		}
+		added = append(added, p.insert(e.Add, nil)...)
+		p.spilled = max(p.spilled-len(e.Add), 0)
+		read += int64(len(line))
+	}
+	if read == p.spillRead {
+		return
+	}
+	drained := p.spilled == 0
+	if drained {
+		read = 0
+	}
+	p.spillRead = read
+	if err := q.log(p, entry{Add: added, Spill: &read}); err != nil {
+		logger.Error("Error journaling deliveries", "peer", p.peer, "err", err)
+		return
+	}
+	if drained {
+		// Truncated only once the journal no longer needs it, a crash in
+		// between reads it back again, which only delivers values twice
+		if err := p.spill.Truncate(0); err != nil {
+			logger.Error("Error emptying spill file", "peer", p.peer, "err", err)
+		}
+	}
+}
+
+// log appends e to p's journal, or starts the journal over when that is
+// shorter, q.mu must be held.
+func (q *Queues) log(p *queue, e entry) error {
+	if p.journal == nil {
+		return nil
+	}
+	if (len(p.values) == 0 && p.spilled == 0) || (p.lines > compactLines && p.lines > 2*len(p.values)) {
+		return q.compact(p)
+	}
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := p.journal.Write(append(buf, '\n')); err != nil {
+		return err
+	}
+	p.lines++
+	if q.opts.Sync {
+		return p.journal.Sync()
+	}
+	return nil
+}
+
+// compact rewrites p's journal to the values still pending.
+func (q *Queues) compact(p *queue) error {
+	if err := p.journal.Truncate(0); err != nil {
+		return err
+	}
+	p.lines = 0
+	if len(p.values) > 0 || p.spilled > 0 {
+		e := entry{Add: p.values}
+		if p.spill != nil {
+			e.Spill = &p.spillRead
+		}
+		buf, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if _, err := p.journal.Write(append(buf, '\n')); err != nil {
+			return err
+		}
+		p.lines = 1
+	}
+	return p.journal.Sync()
+}
+
+// unseen returns the values, and their traces, neither pending in memory nor
+// earlier in values.
+func (p *queue) unseen(values []store.Value, traces []tracing.SpanContext) ([]store.Value, []tracing.SpanContext) {
+	seen := make(map[store.Value]struct{}, len(values))
+	var outValues []store.Value
+	var outTraces []tracing.SpanContext
+	for i, v := range values {
+		if _, ok := p.pending[v]; ok {
+			continue
+		}
+		if _, ok := seen[v]; ok {
+			continue
+		}
+		seen[v] = struct{}{}
+		var sc tracing.SpanContext
+		if i < len(traces) {
+			sc = traces[i]
+		}
+		outValues = append(outValues, v)
+		outTraces = append(outTraces, sc)
+	}
+	return outValues, outTraces
+}
+
+// insert adds the values not pending yet and returns them.
+func (p *queue) insert(values []store.Value, traces []tracing.SpanContext) []store.Value {
+	var added []store.Value
+	for i, v := range values {
+		if _, ok := p.pending[v]; ok {
+			continue
+		}
+		p.pending[v] = struct{}{}
+		p.values = append(p.values, v)
+		var sc tracing.SpanContext
+		if i < len(traces) {
+			sc = traces[i]
+		}
+		p.traces = append(p.traces, sc)
+		added = append(added, v)
+	}
+	return added
+}
+
+func (p *queue) remove(values []store.Value) {
+	gone := make(map[store.Value]struct{}, len(values))
+	for _, v := range values {
+		if _, ok := p.pending[v]; ok {
+			delete(p.pending, v)
+			gone[v] = struct{}{}
+		}
+	}
+	if len(gone) == 0 {
+		return
+	}
+	values, traces := p.values[:0:0], p.traces[:0:0]
+	for i, v := range p.values {
+		if _, ok := gone[v]; !ok {
+			values = append(values, v)
+			traces = append(traces, p.traces[i])
+		}
+	}
+	p.values, p.traces = values, traces
+}
+
+func (p *queue) signal() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// backoff is the wait after the given number of failures in a row, between
+// half and all of the doubled backoff so peers retrying together spread out.
+func backoff(opts Options, failures int) time.Duration {
+	d := max(opts.Backoff, time.Millisecond)
+	for i := 1; i < failures && d < opts.MaxBackoff; i++ {
+		d *= 2
+	}
+	d = min(d, max(opts.MaxBackoff, opts.Backoff))
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
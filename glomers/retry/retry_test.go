@@ -0,0 +1,178 @@
+package retry
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"glomers/store"
+	"glomers/tracing"
+)
+
+var errDown = errors.New("peer down")
+
+// peer takes the first budget values sent to it one at a time and fails
+// after that, remembering what it took.
+type peer struct {
+	mu     sync.Mutex
+	budget int
+	took   []store.Value
+}
+
+func (p *peer) send(_ string, values []store.Value, _ []tracing.SpanContext) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.budget < len(values) {
+		return errDown
+	}
+	p.budget -= len(values)
+	p.took = append(p.took, values...)
+	return nil
+}
+
+func (p *peer) taken() []store.Value {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return slices.Clone(p.took)
+}
+
+func testOptions(dir string, maxQueued int) Options {
+	return Options{
+		Dir:        dir,
+		Backoff:    time.Millisecond,
+		MaxBackoff: 5 * time.Millisecond,
+		MaxBatch:   1,
+		MaxQueued:  maxQueued,
+	}
+}
+
+func numbers(from, n int) []store.Value {
+	out := make([]store.Value, n)
+	for i := range out {
+		out[i] = store.Int(int64(from + i))
+	}
+	return out
+}
+
+// waitPending waits for n values to be pending for "n1".
+func waitPending(t *testing.T, q *Queues, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for q.Pending("n1") != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d values pending, want %d", q.Pending("n1"), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// journalLines counts the lines of the journal of "n1".
+func journalLines(t *testing.T, dir string) int {
+	t.Helper()
+	f, err := os.Open(filepath.Join(dir, "n1.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	lines := 0
+	for s := bufio.NewScanner(f); s.Scan(); {
+		lines++
+	}
+	return lines
+}
+
+// A restarted node delivers what it had pending, in the order it was added,
+// spilled values included, and nothing it had delivered already.
+func TestRecoverPending(t *testing.T) {
+	tests := []struct {
+		name      string
+		values    int
+		maxQueued int // 0 for no limit
+		delivered int // Before the restart
+	}{
+		{"nothing delivered", 20, 0, 0},
+		{"some delivered", 20, 0, 7},
+		{"all delivered", 20, 0, 20},
+		{"spilled", 35, 10, 0},
+		{"spilled, some delivered", 35, 10, 4},
+		{"spilled, read back partly", 35, 10, 18},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			values := numbers(0, tt.values)
+			before := &peer{budget: tt.delivered}
+			q, err := Open(testOptions(dir, tt.maxQueued), before.send)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < len(values); i += 5 {
+				if err := q.Add("n1", values[i:i+5], nil); err != nil {
+					t.Fatalf("Add: %v", err)
+				}
+			}
+			waitPending(t, q, tt.values-tt.delivered)
+			if err := q.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+
+			after := &peer{budget: tt.values}
+			q, err = Open(testOptions(dir, tt.maxQueued), after.send)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer q.Close()
+			waitPending(t, q, 0)
+			if got := before.taken(); !slices.Equal(got, values[:tt.delivered]) {
+				t.Errorf("took %v before the restart, want %v", got, values[:tt.delivered])
+			}
+			if got := after.taken(); !slices.Equal(got, values[tt.delivered:]) {
+				t.Errorf("took %v after the restart, want %v", got, values[tt.delivered:])
+			}
+			if lines := journalLines(t, dir); lines != 0 {
+				t.Errorf("journal has %d lines with nothing pending, want none", lines)
+			}
+		})
+	}
+}
+
+// A journal whose queue drains slowly is rewritten once it is long, and what
+// it holds then is exactly what is pending.
+func TestJournalCompacts(t *testing.T) {
+	dir := t.TempDir()
+	const added, delivered = 2 * compactLines, 3 * compactLines / 2
+	p := &peer{budget: delivered}
+	q, err := Open(testOptions(dir, 0), p.send)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range numbers(0, added) {
+		if err := q.Add("n1", []store.Value{v}, nil); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+	waitPending(t, q, added-delivered)
+	if err := q.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A line per add and per delivery, 3584 of them, without compacting
+	if lines := journalLines(t, dir); lines > compactLines+1 {
+		t.Errorf("journal has %d lines for %d pending values", lines, added-delivered)
+	}
+	after := &peer{budget: added}
+	q, err = Open(testOptions(dir, 0), after.send)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	waitPending(t, q, 0)
+	if got, want := after.taken(), numbers(delivered, added-delivered); !slices.Equal(got, want) {
+		t.Errorf("took %d values after the restart, want the %d from %d on", len(got), len(want), delivered)
+	}
+}
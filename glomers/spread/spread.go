@@ -0,0 +1,37 @@
+// Package spread makes batches of integers spread a few ways values can be,
+// for cmd/batchbench and the batch benchmarks to size the same batches.
+package spread
+
+import (
+	"math/rand"
+	"slices"
+
+	"glomers/bitmap"
+)
+
+// A Spread returns the i-th value to try, duplicates are skipped.
+type Spread struct {
+	Name string
+	Next func(r *rand.Rand, i int) int64
+}
+
+var All = []Spread{
+	{"consecutive", func(_ *rand.Rand, i int) int64 { return int64(i) }},
+	{"every 5th", func(_ *rand.Rand, i int) int64 { return int64(5 * i) }},
+	{"random below 1e6", func(r *rand.Rand, _ int) int64 { return r.Int63n(1e6) }},
+	{"random below 1e12", func(r *rand.Rand, _ int) int64 { return r.Int63n(1e12) }},
+	{"random int64", func(r *rand.Rand, _ int) int64 { return int64(r.Uint64()) }},
+}
+
+// Batch returns n distinct values of s sorted, and in the order they arrived,
+// which for random ones isn't sorted.
+func (s Spread) Batch(r *rand.Rand, n int) (sorted, arrived []int64) {
+	b := &bitmap.Bitmap{}
+	for i := 0; b.Len() < n; i++ {
+		b.Add(s.Next(r, i))
+	}
+	sorted = b.Values()
+	arrived = slices.Clone(sorted)
+	r.Shuffle(len(arrived), func(i, j int) { arrived[i], arrived[j] = arrived[j], arrived[i] })
+	return sorted, arrived
+}
@@ -0,0 +1,423 @@
+// Package store keeps the set of broadcast values a node knows about, and
+// optionally makes it durable with a write-ahead log and snapshots.
+//
+// On disk a store is a directory holding
+//
+//	snapshot.json   every value as of the last snapshot, a JSON array
+//	wal.jsonl       one JSON array per Add since that snapshot
+//
+// Both hold values in their canonical encoding, see Value, which for integers
+// is the number itself.
+//
+// Recovery loads the snapshot then replays the log, ignoring a torn last line.
+// Values are a set, so replaying something the snapshot already has is fine.
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"glomers/bitmap"
+	"glomers/clock"
+	"glomers/logging"
+)
+
+// Fsync policies
+const (
+	// Sync the log before Add returns, an acknowledged value is never lost
+	FsyncAlways = "always"
+	// Sync the log every FsyncInterval, a crash loses at most that window
+	FsyncInterval = "interval"
+	// Leave it to the OS, only survives the process crashing
+	FsyncNever = "never"
+)
+
+const (
+	snapshotFile = "snapshot.json"
+	walFile      = "wal.jsonl"
+)
+
+var logger = logging.Component("store")
+
+type Options struct {
+	// Where the log and snapshots go, the store is memory only when empty
+	Dir              string
+	Fsync            string
+	FsyncInterval    time.Duration
+	SnapshotInterval time.Duration
+}
+
+// Messages is a set of values remembering the order they were added in.
+// Integers are kept in a compressed bitmap, a few bytes each, and readers
+// share the order through a View rather than copying it.
+type Messages struct {
+	mu     sync.RWMutex
+	ints   *bitmap.Bitmap
+	others map[Value]struct{}
+	order  log
+	// Told about every value added after they started watching
+	watchers []func(added []Value)
+
+	// Only set for durable stores
+	opts    Options
+	wal     *os.File
+	walSize int64 // What was written without error, a failed write is cut off
+	dirty   bool  // Appended to since the last sync
+	stop    chan struct{}
+	ticker  struct{ fsync, snapshot clock.Ticker }
+}
+
+// NewMemory returns a store that doesn't survive a restart.
+func NewMemory() *Messages {
+	return &Messages{ints: &bitmap.Bitmap{}, others: make(map[Value]struct{})}
+}
+
+// Open recovers the store in opts.Dir, creating it if needed, and starts the
+// background syncing and snapshotting. It is NewMemory when opts.Dir is empty.
+func Open(opts Options) (*Messages, error) {
+	m := NewMemory()
+	if opts.Dir == "" {
+		return m, nil
+	}
+	if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	size, err := m.recover(opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+	wal, err := os.OpenFile(filepath.Join(opts.Dir, walFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	// Whatever recovery couldn't read would hide what comes after it
+	if err := wal.Truncate(size); err != nil {
+		wal.Close()
+		return nil, err
+	}
+	m.opts = opts
+	m.wal = wal
+	m.walSize = size
+	m.stop = make(chan struct{})
+	m.ticker.fsync = clock.NewTicker(positive(opts.FsyncInterval))
+	m.ticker.snapshot = clock.NewTicker(positive(opts.SnapshotInterval))
+	go m.background()
+
+	logger.Info("Recovered store", "dir", opts.Dir, "values", m.order.len())
+	return m, nil
+}
+
+// recover loads the snapshot and log in dir, and returns how much of the log
+// it could read.
+func (m *Messages) recover(dir string) (int64, error) {
+	buf, err := os.ReadFile(filepath.Join(dir, snapshotFile))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return 0, err
+	default:
+		var values []Value
+		if err := json.Unmarshal(buf, &values); err != nil {
+			return 0, fmt.Errorf("corrupt snapshot: %w", err)
+		}
+		m.insert(values)
+	}
+
+	f, err := os.Open(filepath.Join(dir, walFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var size int64
+	r := bufio.NewReader(f)
+	for line := 1; ; line++ {
+		buf, err := r.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			if len(buf) > 0 {
+				// Only the last write can be torn, and it was never acknowledged
+				logger.Warn("Stopping recovery at unterminated log entry", "line", line)
+			}
+			return size, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		var values []Value
+		if err := json.Unmarshal(buf, &values); err != nil {
+			logger.Warn("Stopping recovery at unreadable log entry", "line", line, "err", err)
+			return size, nil
+		}
+		m.insert(values)
+		size += int64(len(buf))
+	}
+}
+
+// Add stores the values and returns the ones that weren't there yet. With a
+// durable store they are in the log, and synced as the fsync policy says,
+// before anyone sees them: when writing fails the store is left as it was, so
+// a retry doesn't find the values there and report them stored.
+func (m *Messages) Add(values ...Value) ([]Value, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fresh := m.fresh(values)
+	if len(fresh) == 0 {
+		return nil, nil
+	}
+	if err := m.persist(fresh); err != nil {
+		return nil, err
+	}
+	added := m.insert(fresh)
+	for _, watch := range m.watchers {
+		watch(added)
+	}
+	return added, nil
+}
+
+// fresh returns the values not in the set yet, each once, caller must hold
+// m.mu.
+func (m *Messages) fresh(values []Value) []Value {
+	var out []Value
+	seen := make(map[Value]struct{}, len(values))
+	for _, v := range values {
+		if _, dup := seen[v]; dup || m.has(v) {
+			continue
+		}
+		seen[v] = struct{}{}
+		out = append(out, v)
+	}
+	return out
+}
+
+// persist appends values to the log of a durable store, caller must hold m.mu.
+func (m *Messages) persist(values []Value) error {
+	if m.wal == nil {
+		return nil
+	}
+	buf, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	if _, err := m.wal.Write(append(buf, '\n')); err != nil {
+		// Recovery stops at the first torn line, cut it off so the next
+		// entries aren't lost behind it
+		if cut := m.wal.Truncate(m.walSize); cut != nil {
+			logger.Error("Error cutting off a failed log write", "err", cut)
+		}
+		return err
+	}
+	m.walSize += int64(len(buf) + 1)
+	m.dirty = true
+	if m.opts.Fsync == FsyncAlways {
+		if err := m.wal.Sync(); err != nil {
+			return err
+		}
+		m.dirty = false
+	}
+	return nil
+}
+
+// insert adds to the in memory set, caller must hold m.mu or own m.
+func (m *Messages) insert(values []Value) []Value {
+	var added []Value
+	for _, v := range values {
+		if i, ok := v.Int64(); ok {
+			if !m.ints.Add(i) {
+				continue
+			}
+		} else {
+			if _, exists := m.others[v]; exists {
+				continue
+			}
+			m.others[v] = struct{}{}
+		}
+		m.order.append(v)
+		added = append(added, v)
+	}
+	return added
+}
+
+// Watch calls fn with the new values of every later Add, and returns the
+// values already there, so together they see everything exactly once. fn is
+// called with the store locked and must not call back into it.
+func (m *Messages) Watch(fn func(added []Value)) []Value {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.watchers = append(m.watchers, fn)
+	return m.order.view().All()
+}
+
+func (m *Messages) Has(v Value) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.has(v)
+}
+
+func (m *Messages) has(v Value) bool {
+	if i, ok := v.Int64(); ok {
+		return m.ints.Contains(i)
+	}
+	_, exists := m.others[v]
+	return exists
+}
+
+func (m *Messages) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.order.len()
+}
+
+// View returns the values as they are now, for reading without copying them.
+func (m *Messages) View() View {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.order.view()
+}
+
+// All returns a copy of every value, in the order they were added.
+func (m *Messages) All() []Value {
+	return m.View().All()
+}
+
+// Since returns a copy of the values added after the first "from" ones.
+func (m *Messages) Since(from int) []Value {
+	return m.View().Since(from)
+}
+
+// IntBytes estimates the memory the bitmap of integer values takes.
+func (m *Messages) IntBytes() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.ints.Size()
+}
+
+// Reconfigure applies new sync and snapshot settings to a durable store, the
+// directory can't be changed.
+func (m *Messages) Reconfigure(opts Options) {
+	if m.wal == nil {
+		return
+	}
+	m.mu.Lock()
+	m.opts.Fsync = opts.Fsync
+	m.opts.FsyncInterval = opts.FsyncInterval
+	m.opts.SnapshotInterval = opts.SnapshotInterval
+	m.mu.Unlock()
+	m.ticker.fsync.Reset(positive(opts.FsyncInterval))
+	m.ticker.snapshot.Reset(positive(opts.SnapshotInterval))
+}
+
+// Snapshot writes every value to a new snapshot and empties the log.
+func (m *Messages) Snapshot() error {
+	if m.wal == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	buf, err := json.Marshal(m.order.view())
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(m.opts.Dir, snapshotFile+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(m.opts.Dir, snapshotFile)); err != nil {
+		return err
+	}
+	// The rename is only durable once the directory is, until then a crash
+	// can bring the old snapshot back, and the log must still be there
+	if err := syncDir(m.opts.Dir); err != nil {
+		return err
+	}
+	// Crashing before this only means replaying values the snapshot has
+	if err := m.wal.Truncate(0); err != nil {
+		return err
+	}
+	m.walSize = 0
+	m.dirty = false
+	return nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Close syncs and closes a durable store.
+func (m *Messages) Close() error {
+	if m.wal == nil {
+		return nil
+	}
+	close(m.stop)
+	m.ticker.fsync.Stop()
+	m.ticker.snapshot.Stop()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.wal.Sync(); err != nil {
+		return err
+	}
+	return m.wal.Close()
+}
+
+func (m *Messages) background() {
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-m.ticker.fsync.C():
+			m.mu.Lock()
+			var err error
+			if m.dirty && m.opts.Fsync == FsyncInterval {
+				err = m.wal.Sync()
+				m.dirty = err != nil
+			}
+			m.mu.Unlock()
+			if err != nil {
+				logger.Error("Error syncing the log", "err", err)
+			}
+		case <-m.ticker.snapshot.C():
+			if err := m.Snapshot(); err != nil {
+				logger.Error("Error writing snapshot", "err", err)
+			}
+		}
+	}
+}
+
+// Tickers panic on non-positive durations, validation should prevent them
+// but a store must never take the node down.
+func positive(d time.Duration) time.Duration {
+	if d <= 0 {
+		return time.Hour
+	}
+	return d
+}
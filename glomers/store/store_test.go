@@ -0,0 +1,140 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func openIn(t *testing.T, dir string) *Messages {
+	t.Helper()
+	m, err := Open(Options{Dir: dir, Fsync: FsyncAlways, FsyncInterval: time.Hour, SnapshotInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	return m
+}
+
+func add(t *testing.T, m *Messages, values ...Value) {
+	t.Helper()
+	if _, err := m.Add(values...); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+}
+
+func appendFile(t *testing.T, path, text string) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(text); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A reopened store holds what was added before, from the snapshot and the log,
+// and a log entry it can't read is cut off so what is added next survives
+// the restart after.
+func TestRecover(t *testing.T) {
+	tests := []struct {
+		name    string
+		prepare func(t *testing.T, dir string)
+		want    []Value // nil when Open must fail
+	}{
+		{"empty", func(*testing.T, string) {}, []Value{}},
+		{"log only", func(t *testing.T, dir string) {
+			m := openIn(t, dir)
+			add(t, m, "1", `"a"`)
+			add(t, m, "2", "1")
+			m.Close()
+		}, []Value{"1", `"a"`, "2"}},
+		{"snapshot then log", func(t *testing.T, dir string) {
+			m := openIn(t, dir)
+			add(t, m, "1", "2")
+			if err := m.Snapshot(); err != nil {
+				t.Fatal(err)
+			}
+			add(t, m, "3")
+			m.Close()
+		}, []Value{"1", "2", "3"}},
+		{"log repeating the snapshot", func(t *testing.T, dir string) {
+			// A crash after the snapshot's rename, before the log was emptied
+			m := openIn(t, dir)
+			add(t, m, "1", "2")
+			m.Close()
+			appendFile(t, filepath.Join(dir, snapshotFile), `[1,2]`)
+		}, []Value{"1", "2"}},
+		{"torn last entry", func(t *testing.T, dir string) {
+			m := openIn(t, dir)
+			add(t, m, "1")
+			m.Close()
+			appendFile(t, filepath.Join(dir, walFile), `[2,`)
+		}, []Value{"1"}},
+		{"unreadable entry", func(t *testing.T, dir string) {
+			m := openIn(t, dir)
+			add(t, m, "1")
+			m.Close()
+			appendFile(t, filepath.Join(dir, walFile), "garbage\n[5]\n")
+		}, []Value{"1"}},
+		{"corrupt snapshot", func(t *testing.T, dir string) {
+			appendFile(t, filepath.Join(dir, snapshotFile), `[1,`)
+		}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			tt.prepare(t, dir)
+
+			m, err := Open(Options{Dir: dir, Fsync: FsyncAlways, FsyncInterval: time.Hour, SnapshotInterval: time.Hour})
+			if tt.want == nil {
+				if err == nil {
+					m.Close()
+					t.Fatal("Open succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Open: %v", err)
+			}
+			if got := m.All(); !slices.Equal(got, tt.want) && len(got)+len(tt.want) > 0 {
+				t.Fatalf("recovered %v, want %v", got, tt.want)
+			}
+			add(t, m, "100")
+			m.Close()
+
+			m = openIn(t, dir)
+			defer m.Close()
+			if got, want := m.All(), append(slices.Clone(tt.want), "100"); !slices.Equal(got, want) {
+				t.Errorf("after adding and reopening got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// A snapshot empties the log, and the values come back from it alone.
+func TestSnapshotEmptiesLog(t *testing.T) {
+	dir := t.TempDir()
+	m := openIn(t, dir)
+	add(t, m, "1", `{"a":1}`, "-5")
+	if err := m.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	m.Close()
+
+	info, err := os.Stat(filepath.Join(dir, walFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 0 {
+		t.Errorf("log has %d bytes after a snapshot, want none", info.Size())
+	}
+	m = openIn(t, dir)
+	defer m.Close()
+	if got, want := m.All(), []Value{"1", `{"a":1}`, "-5"}; !slices.Equal(got, want) {
+		t.Errorf("recovered %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,69 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// Value is a broadcast value held as its canonical JSON encoding: compact,
+// object keys sorted, strings escaped the same way whatever way they were
+// sent, and numbers exactly as written so integers of any size survive. Two
+// values are the same when their encodings are, so 1 and 1.0 are different
+// values while {"a":1,"b":2} and { "b": 2, "a": 1 } are one.
+type Value string
+
+// Int returns the value of a canonical integer.
+func Int(i int64) Value {
+	return Value(strconv.FormatInt(i, 10))
+}
+
+// ParseValue canonicalises a single JSON document.
+func ParseValue(data []byte) (Value, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return "", err
+	}
+	if dec.More() {
+		return "", fmt.Errorf("more than one value in %q", data)
+	}
+	return canonical(v)
+}
+
+// canonical encodes a value decoded with UseNumber. Maps are encoded with
+// sorted keys and json.Number as is.
+func canonical(v any) (Value, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return "", err
+	}
+	return Value(bytes.TrimSuffix(buf.Bytes(), []byte("\n"))), nil
+}
+
+// Int64 returns the value as an integer, when it is one that fits in 64 bits
+// written the way Int writes it.
+func (v Value) Int64() (int64, bool) {
+	i, err := strconv.ParseInt(string(v), 10, 64)
+	return i, err == nil && Int(i) == v
+}
+
+func (v Value) MarshalJSON() ([]byte, error) {
+	if v == "" {
+		return nil, fmt.Errorf("empty value")
+	}
+	return []byte(v), nil
+}
+
+func (v *Value) UnmarshalJSON(data []byte) error {
+	parsed, err := ParseValue(data)
+	if err != nil {
+		return err
+	}
+	*v = parsed
+	return nil
+}
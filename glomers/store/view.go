@@ -0,0 +1,193 @@
+package store
+
+import (
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+// Integers go in chunks of chunkInts. A full chunk is packed as the varint
+// difference of each from the one before, which takes a byte or two apiece
+// for values added about in order, unless that is bigger than the 8 bytes of
+// keeping them as they are, as for random 64-bit values.
+const chunkInts = 1024
+
+type chunk struct {
+	packed []byte
+	raw    []int64 // When packing doesn't pay
+}
+
+func pack(ints []int64) chunk {
+	var buf []byte
+	var prev int64
+	for _, i := range ints {
+		buf = binary.AppendVarint(buf, i-prev)
+		prev = i
+	}
+	if len(buf) >= 8*len(ints) {
+		return chunk{raw: ints}
+	}
+	return chunk{packed: buf}
+}
+
+// log is every value in the order it was added. Integers are kept unboxed in
+// chunks, the last one filling up in tail, and the rest in others, along with
+// the position each of them took. All of them only ever grow, and a full
+// chunk never changes, so a View can share them with the store: the store
+// appends past the end of what the View sees.
+type log struct {
+	chunks []chunk
+	tail   []int64
+	others []Value
+	at     []int
+}
+
+func (l *log) append(v Value) {
+	if i, ok := v.Int64(); ok {
+		l.tail = append(l.tail, i)
+		if len(l.tail) == chunkInts {
+			// Views may still hold the old tail, start a new one
+			l.chunks = append(l.chunks, pack(l.tail))
+			l.tail = nil
+		}
+		return
+	}
+	l.at = append(l.at, l.len())
+	l.others = append(l.others, v)
+}
+
+func (l *log) ints() int {
+	return len(l.chunks)*chunkInts + len(l.tail)
+}
+
+func (l *log) len() int {
+	return l.ints() + len(l.others)
+}
+
+// intReader reads the integers of a log in order.
+type intReader struct {
+	l *log
+	i int // Index of the next one
+	// Where the next one is in its packed chunk, and the one before it
+	off  int
+	prev int64
+}
+
+// intsFrom returns a reader starting at the i-th integer.
+func (l *log) intsFrom(i int) *intReader {
+	r := &intReader{l: l, i: i - i%chunkInts}
+	for r.i < i {
+		r.next()
+	}
+	return r
+}
+
+func (r *intReader) next() int64 {
+	c, j := r.i/chunkInts, r.i%chunkInts
+	r.i++
+	if c == len(r.l.chunks) {
+		return r.l.tail[j]
+	}
+	ch := r.l.chunks[c]
+	if ch.packed == nil {
+		return ch.raw[j]
+	}
+	if j == 0 {
+		r.off, r.prev = 0, 0
+	}
+	d, n := binary.Varint(ch.packed[r.off:])
+	r.off += n
+	r.prev += d
+	return r.prev
+}
+
+// View is the values of a store as they were when it was taken, in the order
+// they were added. It doesn't change as the store does and is safe to use
+// without holding anything, taking one copies nothing.
+type View struct {
+	log log
+}
+
+func (l *log) view() View {
+	return View{log{
+		chunks: l.chunks[:len(l.chunks):len(l.chunks)],
+		tail:   l.tail[:len(l.tail):len(l.tail)],
+		others: l.others[:len(l.others):len(l.others)],
+		at:     l.at[:len(l.at):len(l.at)],
+	}}
+}
+
+func (v View) Len() int {
+	return v.log.len()
+}
+
+// Each calls fn with every value from position from on, in order.
+func (v View) Each(from int, fn func(Value)) {
+	v.each(from, v.Len(), func(i int64, other Value) {
+		if other == "" {
+			other = Int(i)
+		}
+		fn(other)
+	})
+}
+
+// each calls fn with the integer, or the other value when it isn't one, at
+// every position from from up to to.
+func (v View) each(from, to int, fn func(i int64, other Value)) {
+	l := &v.log
+	to = min(max(to, 0), l.len())
+	from = min(max(from, 0), to)
+	o := sort.SearchInts(l.at, from)
+	ints := l.intsFrom(from - o)
+	for pos := from; pos < to; pos++ {
+		if o < len(l.at) && l.at[o] == pos {
+			fn(0, l.others[o])
+			o++
+			continue
+		}
+		fn(ints.next(), "")
+	}
+}
+
+// Since returns the values after the first from ones.
+func (v View) Since(from int) []Value {
+	return v.Range(from, v.Len())
+}
+
+// Range returns the values at positions from up to to.
+func (v View) Range(from, to int) []Value {
+	var out []Value
+	v.each(from, to, func(i int64, other Value) {
+		if other == "" {
+			other = Int(i)
+		}
+		out = append(out, other)
+	})
+	return out
+}
+
+// All returns every value.
+func (v View) All() []Value {
+	out := make([]Value, 0, v.Len())
+	v.Each(0, func(value Value) {
+		out = append(out, value)
+	})
+	return out
+}
+
+// MarshalJSON writes the values as a JSON array without boxing the integers.
+func (v View) MarshalJSON() ([]byte, error) {
+	buf := make([]byte, 0, 8*v.Len()+2)
+	buf = append(buf, '[')
+	v.each(0, v.Len(), func(i int64, other Value) {
+		if len(buf) > 1 {
+			buf = append(buf, ',')
+		}
+		if other == "" {
+			buf = strconv.AppendInt(buf, i, 10)
+		} else {
+			buf = append(buf, other...)
+		}
+	})
+	return append(buf, ']'), nil
+}
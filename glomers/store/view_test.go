@@ -0,0 +1,103 @@
+package store
+
+import (
+	"encoding/json"
+	"math"
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+// logOf appends n values made by next to a fresh log.
+func logOf(n int, next func(i int) Value) (*log, []Value) {
+	l := &log{}
+	want := make([]Value, n)
+	for i := range want {
+		want[i] = next(i)
+		l.append(want[i])
+	}
+	return l, want
+}
+
+// Integers are read back in order across chunks, packed or raw, with other
+// values in between, from any position.
+func TestLogOrder(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	tests := []struct {
+		name       string
+		n          int
+		next       func(i int) Value
+		wantPacked bool // The first chunk
+	}{
+		{"empty", 0, nil, false},
+		{"within the tail", 10, func(i int) Value { return Int(int64(i)) }, false},
+		{"one full chunk", chunkInts, func(i int) Value { return Int(int64(i)) }, true},
+		{"consecutive", 3*chunkInts + 5, func(i int) Value { return Int(int64(i)) }, true},
+		{"descending", 2*chunkInts + 1, func(i int) Value { return Int(int64(-i)) }, true},
+		{"random int64", 2*chunkInts + 1, func(int) Value { return Int(int64(r.Uint64())) }, false},
+		// Differences wrap around, MaxInt64 is -1 after MinInt64
+		{"extremes", 2 * chunkInts, func(i int) Value {
+			if i%2 == 0 {
+				return Int(math.MinInt64)
+			}
+			return Int(math.MaxInt64)
+		}, true},
+		{"with others", 3 * chunkInts, func(i int) Value {
+			if i%7 == 0 {
+				return Value(`"s` + Int(int64(i)) + `"`)
+			}
+			return Int(int64(i))
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, want := logOf(tt.n, tt.next)
+			if len(l.chunks) > 0 && (l.chunks[0].packed != nil) != tt.wantPacked {
+				t.Errorf("first chunk packed = %v, want %v", l.chunks[0].packed != nil, tt.wantPacked)
+			}
+			v := l.view()
+			if v.Len() != tt.n {
+				t.Fatalf("Len = %d, want %d", v.Len(), tt.n)
+			}
+			if got := v.All(); !slices.Equal(got, want) && tt.n > 0 {
+				t.Fatalf("All lost the order, got %d values", len(got))
+			}
+			for _, from := range []int{1, chunkInts - 1, chunkInts, chunkInts + 1, tt.n - 1} {
+				if from < 0 || from > tt.n {
+					continue
+				}
+				if got := v.Since(from); !slices.Equal(got, want[from:]) {
+					t.Errorf("Since(%d) got %d values, want %d", from, len(got), tt.n-from)
+				}
+			}
+
+			buf, err := json.Marshal(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []Value
+			if err := json.Unmarshal(buf, &got); err != nil {
+				t.Fatalf("Unmarshal: %v", err)
+			}
+			if len(got) != tt.n || (tt.n > 0 && !slices.Equal(got, want)) {
+				t.Errorf("MarshalJSON got %d values, want %d", len(got), tt.n)
+			}
+		})
+	}
+}
+
+// A view doesn't see what is added after it was taken, as the tail it shares
+// fills up into a chunk and a new one starts.
+func TestViewUnchanged(t *testing.T) {
+	l, want := logOf(chunkInts-2, func(i int) Value { return Int(int64(i)) })
+	v := l.view()
+	for i := 0; i < 3*chunkInts; i++ {
+		l.append(Int(int64(-i)))
+	}
+	if got := v.All(); !slices.Equal(got, want) {
+		t.Errorf("view changed, got %d values, want %d", len(got), len(want))
+	}
+	if l.len() != len(want)+3*chunkInts {
+		t.Errorf("log has %d values, want %d", l.len(), len(want)+3*chunkInts)
+	}
+}
@@ -0,0 +1,467 @@
+// Package swim tells which nodes are up, with the SWIM failure detector (Das
+// et al., "SWIM: Scalable Weakly-consistent Infection-style Process Group
+// Membership Protocol").
+//
+// Every SwimInterval a node pings the next node of a shuffled round robin. If
+// it doesn't ack within SwimTimeout, SwimIndirect other nodes are asked to
+// ping it on our behalf, and if none of them gets an ack either it becomes
+// suspect. A suspect that doesn't refute within SuspicionTimeout is dead.
+// Nodes refute by bumping their incarnation number, which overrides the
+// suspicion everywhere it has spread. Changes travel piggybacked on the
+// pings and acks, no message is sent just for them.
+//
+//	{"type": "swim_ping", "updates": [...]}
+//	{"type": "swim_ping_req", "target": "n3", "updates": [...]}
+//	{"type": "swim_ack", "incarnation": 2, "updates": [...]}
+//
+// Dead nodes are still probed, so a partitioned node that comes back hears it
+// was declared dead and refutes.
+package swim
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+
+	"glomers/clock"
+	"glomers/config"
+	"glomers/logging"
+	"glomers/metrics"
+)
+
+const Enabled = "swim"
+
+// At most this many updates ride on each message
+const maxPiggyback = 8
+
+var logger = logging.Component("swim")
+
+type State int
+
+const (
+	Alive State = iota
+	Suspect
+	Dead
+)
+
+var stateNames = []string{"alive", "suspect", "dead"}
+
+func (s State) String() string {
+	if int(s) < len(stateNames) {
+		return stateNames[s]
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+func (s State) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *State) UnmarshalText(text []byte) error {
+	for i, name := range stateNames {
+		if name == string(text) {
+			*s = State(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown state %q", text)
+}
+
+type update struct {
+	Node        string `json:"node"`
+	State       State  `json:"state"`
+	Incarnation int    `json:"incarnation"`
+}
+
+// overrides tells whether u is newer news than what we know, cur.
+func (u update) overrides(cur update) bool {
+	switch u.State {
+	case Alive:
+		return u.Incarnation > cur.Incarnation
+	case Suspect:
+		return u.Incarnation > cur.Incarnation || (u.Incarnation == cur.Incarnation && cur.State == Alive)
+	default:
+		return u.Incarnation >= cur.Incarnation && cur.State != Dead
+	}
+}
+
+type member struct {
+	update
+	suspicion clock.Timer
+	// Closed when the member is next alive, nil while it is
+	revived chan struct{}
+}
+
+// Detector is the failure detector of one node. When disabled every node is
+// always alive.
+type Detector struct {
+	n   *maelstrom.Node
+	cfg *config.Store
+	// Read once, at startup
+	enabled bool
+
+	mu          sync.Mutex
+	incarnation int
+	members     map[string]*member
+	// Updates still to piggyback, and how many more times each
+	gossip   map[string]int
+	probes   []string // What's left of this round robin
+	watchers []func(peer string, state State)
+}
+
+// Register installs the handlers on n when the detector is enabled. Nothing
+// is sent until Start.
+func Register(n *maelstrom.Node, cfg *config.Store) *Detector {
+	d := &Detector{
+		n:       n,
+		cfg:     cfg,
+		enabled: cfg.Get().FailureDetector == Enabled,
+		members: make(map[string]*member),
+		gossip:  make(map[string]int),
+	}
+	if d.enabled {
+		n.Handle("swim_ping", d.pingHandler)
+		n.Handle("swim_ping_req", d.pingReqHandler)
+	}
+	return d
+}
+
+// Start begins probing, it has to run once the node knows the cluster.
+func (d *Detector) Start() {
+	if !d.enabled {
+		return
+	}
+	d.mu.Lock()
+	for _, id := range d.n.NodeIDs() {
+		if id != d.n.ID() {
+			d.members[id] = &member{update: update{Node: id}}
+		}
+	}
+	d.mu.Unlock()
+
+	ticker := clock.NewTicker(d.cfg.Get().SwimInterval)
+	d.cfg.Subscribe(func(old, cur config.Config) {
+		if cur.SwimInterval != old.SwimInterval {
+			ticker.Reset(cur.SwimInterval)
+		}
+	})
+	go func() {
+		for range ticker.C() {
+			d.probe()
+		}
+	}()
+}
+
+// State returns what we believe of peer, nodes we know nothing about are
+// alive.
+func (d *Detector) State(peer string) State {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if m, ok := d.members[peer]; ok {
+		return m.State
+	}
+	return Alive
+}
+
+// Usable tells whether peer is worth sending to, neither suspect nor dead.
+func (d *Detector) Usable(peer string) bool {
+	return d.State(peer) == Alive
+}
+
+// Filter returns the usable peers.
+func (d *Detector) Filter(peers []string) []string {
+	var out []string
+	for _, peer := range peers {
+		if d.Usable(peer) {
+			out = append(out, peer)
+		}
+	}
+	return out
+}
+
+// Alive returns a channel closed once peer is alive, already closed if it is.
+func (d *Detector) Alive(peer string) <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if m, ok := d.members[peer]; ok && m.revived != nil {
+		return m.revived
+	}
+	closed := make(chan struct{})
+	close(closed)
+	return closed
+}
+
+// Watch calls fn every time a peer changes state. fn is called with the
+// detector locked and must not call back into it.
+func (d *Detector) Watch(fn func(peer string, state State)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.watchers = append(d.watchers, fn)
+}
+
+// probe checks the next member, directly and then through others.
+func (d *Detector) probe() {
+	cfg := d.cfg.Get()
+	target, about := d.next()
+	if target == "" {
+		return
+	}
+
+	ctx, cancel := clock.WithTimeout(context.Background(), cfg.SwimTimeout)
+	incarnation, err := d.ping(ctx, target, about)
+	cancel()
+	if err != nil {
+		incarnation, err = d.pingIndirect(target, cfg)
+	}
+	if err != nil {
+		d.mu.Lock()
+		if m := d.members[target]; m.State == Alive {
+			d.apply(update{Node: target, State: Suspect, Incarnation: m.Incarnation})
+		}
+		d.mu.Unlock()
+		return
+	}
+	d.mu.Lock()
+	d.apply(update{Node: target, State: Alive, Incarnation: incarnation})
+	d.mu.Unlock()
+}
+
+// next pops the next member of the round robin, reshuffled every round, and
+// what we believe of it unless it's alive, so it can refute right away.
+func (d *Detector) next() (string, *update) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.probes) == 0 {
+		for id := range d.members {
+			d.probes = append(d.probes, id)
+		}
+		sort.Strings(d.probes)
+		rand.Shuffle(len(d.probes), func(i, j int) { d.probes[i], d.probes[j] = d.probes[j], d.probes[i] })
+	}
+	if len(d.probes) == 0 {
+		return "", nil
+	}
+	target := d.probes[0]
+	d.probes = d.probes[1:]
+	if m := d.members[target]; m.State != Alive {
+		about := m.update
+		return target, &about
+	}
+	return target, nil
+}
+
+// pingIndirect asks SwimIndirect random usable members to ping target, for
+// the rest of the protocol period.
+func (d *Detector) pingIndirect(target string, cfg config.Config) (int, error) {
+	d.mu.Lock()
+	var helpers []string
+	for id, m := range d.members {
+		if id != target && m.State == Alive {
+			helpers = append(helpers, id)
+		}
+	}
+	d.mu.Unlock()
+	sort.Strings(helpers)
+	rand.Shuffle(len(helpers), func(i, j int) { helpers[i], helpers[j] = helpers[j], helpers[i] })
+	helpers = helpers[:min(cfg.SwimIndirect, len(helpers))]
+	if len(helpers) == 0 {
+		return 0, fmt.Errorf("no ack from %s and nobody to ask", target)
+	}
+
+	ctx, cancel := clock.WithTimeout(context.Background(), max(cfg.SwimInterval-cfg.SwimTimeout, cfg.SwimTimeout))
+	defer cancel()
+	acks := make(chan int, len(helpers))
+	for _, helper := range helpers {
+		helper := helper
+		go func() {
+			var reply struct {
+				Incarnation int      `json:"incarnation"`
+				Updates     []update `json:"updates"`
+			}
+			if err := d.rpc(ctx, helper, map[string]any{
+				"type":    "swim_ping_req",
+				"target":  target,
+				"updates": d.piggyback(),
+			}, &reply); err != nil {
+				return
+			}
+			d.receive(reply.Updates)
+			acks <- reply.Incarnation
+		}()
+	}
+	select {
+	case incarnation := <-acks:
+		return incarnation, nil
+	case <-ctx.Done():
+		return 0, fmt.Errorf("no ack from %s, directly or through %v", target, helpers)
+	}
+}
+
+// ping returns target's incarnation from its ack.
+func (d *Detector) ping(ctx context.Context, target string, about *update) (int, error) {
+	updates := d.piggyback()
+	if about != nil {
+		updates = append(updates, *about)
+	}
+	var reply struct {
+		Incarnation int      `json:"incarnation"`
+		Updates     []update `json:"updates"`
+	}
+	if err := d.rpc(ctx, target, map[string]any{
+		"type":    "swim_ping",
+		"updates": updates,
+	}, &reply); err != nil {
+		return 0, err
+	}
+	d.receive(reply.Updates)
+	return reply.Incarnation, nil
+}
+
+func (d *Detector) pingHandler(msg maelstrom.Message) error {
+	var body struct {
+		Updates []update `json:"updates"`
+	}
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+	d.receive(body.Updates)
+
+	d.mu.Lock()
+	incarnation := d.incarnation
+	d.mu.Unlock()
+	return d.n.Reply(msg, map[string]any{
+		"type":        "swim_ack",
+		"incarnation": incarnation,
+		"updates":     d.piggyback(),
+	})
+}
+
+func (d *Detector) pingReqHandler(msg maelstrom.Message) error {
+	var body struct {
+		Target  string   `json:"target"`
+		Updates []update `json:"updates"`
+	}
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+	d.receive(body.Updates)
+
+	ctx, cancel := clock.WithTimeout(context.Background(), d.cfg.Get().SwimTimeout)
+	defer cancel()
+	incarnation, err := d.ping(ctx, body.Target, nil)
+	if err != nil {
+		return maelstrom.NewRPCError(maelstrom.Timeout, fmt.Sprintf("no ack from %s", body.Target))
+	}
+	return d.n.Reply(msg, map[string]any{
+		"type":        "swim_ack",
+		"incarnation": incarnation,
+		"updates":     d.piggyback(),
+	})
+}
+
+// receive applies updates that came piggybacked, refuting those about us.
+func (d *Detector) receive(updates []update) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, u := range updates {
+		if u.Node != d.n.ID() {
+			d.apply(u)
+			continue
+		}
+		if u.State != Alive && u.Incarnation >= d.incarnation {
+			d.incarnation = u.Incarnation + 1
+			logger.Info("Refuting", "state", u.State, "incarnation", d.incarnation)
+			d.spread(update{Node: d.n.ID(), State: Alive, Incarnation: d.incarnation})
+		}
+	}
+}
+
+// apply must be called with d.mu held.
+func (d *Detector) apply(u update) {
+	m, ok := d.members[u.Node]
+	if !ok || !u.overrides(m.update) {
+		return
+	}
+	was := m.State
+	m.update = u
+	d.spread(u)
+
+	if m.suspicion != nil {
+		m.suspicion.Stop()
+		m.suspicion = nil
+	}
+	if u.State == Suspect {
+		m.suspicion = clock.AfterFunc(d.cfg.Get().SuspicionTimeout, func() {
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			if cur := d.members[u.Node]; cur.update == u {
+				d.apply(update{Node: u.Node, State: Dead, Incarnation: u.Incarnation})
+			}
+		})
+	}
+	switch {
+	case u.State == Alive && m.revived != nil:
+		close(m.revived)
+		m.revived = nil
+	case u.State != Alive && m.revived == nil:
+		m.revived = make(chan struct{})
+	}
+
+	if was != u.State {
+		logger.Info("Peer changed state", "peer", u.Node, "from", was, "to", u.State, "incarnation", u.Incarnation)
+		for _, fn := range d.watchers {
+			fn(u.Node, u.State)
+		}
+	}
+}
+
+// spread queues u to be piggybacked about 3 log(n) times, which reaches
+// everyone with high probability. d.mu must be held.
+func (d *Detector) spread(u update) {
+	d.gossip[u.Node] = 3 * int(math.Ceil(math.Log2(float64(len(d.n.NodeIDs())+1))))
+}
+
+// piggyback returns the updates to send along, freshest first.
+func (d *Detector) piggyback() []update {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	nodes := make([]string, 0, len(d.gossip))
+	for node := range d.gossip {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		if d.gossip[nodes[i]] != d.gossip[nodes[j]] {
+			return d.gossip[nodes[i]] > d.gossip[nodes[j]]
+		}
+		return nodes[i] < nodes[j]
+	})
+
+	updates := []update{}
+	for _, node := range nodes[:min(maxPiggyback, len(nodes))] {
+		if node == d.n.ID() {
+			updates = append(updates, update{Node: node, State: Alive, Incarnation: d.incarnation})
+		} else {
+			updates = append(updates, d.members[node].update)
+		}
+		if d.gossip[node]--; d.gossip[node] <= 0 {
+			delete(d.gossip, node)
+		}
+	}
+	return updates
+}
+
+func (d *Detector) rpc(ctx context.Context, peer string, body map[string]any, reply any) error {
+	start := clock.Now()
+	msg, err := d.n.SyncRPC(ctx, peer, body)
+	metrics.RPC(body["type"].(string), start, err)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(msg.Body, reply)
+}
@@ -0,0 +1,309 @@
+// Package tracing follows an operation across gossip hops.
+//
+// The span context travels in the message body under "trace" (or "traces"
+// for batches, one per value) and every node writes the spans it records to
+// <GLOMERS_TRACE_DIR>/<node-id>.spans.jsonl, one OTLP/JSON
+// ExportTraceServiceRequest per line, so they can be loaded by anything that
+// understands OpenTelemetry file exports.
+//
+// Tracing is disabled, and every call a no-op, when GLOMERS_TRACE_DIR is unset.
+package tracing
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+
+	"glomers/clock"
+	"glomers/logging"
+)
+
+const EnvDir = "GLOMERS_TRACE_DIR"
+
+// Span kinds, as numbered by OTLP
+const (
+	KindInternal = 1
+	KindServer   = 2
+	KindClient   = 3
+)
+
+var logger = logging.Component("tracing")
+
+var (
+	mu      sync.Mutex
+	node    *maelstrom.Node
+	dir     string
+	file    *os.File
+	randGen = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// Init enables tracing for n when GLOMERS_TRACE_DIR is set.
+func Init(n *maelstrom.Node) {
+	mu.Lock()
+	defer mu.Unlock()
+	node = n
+	dir = os.Getenv(EnvDir)
+}
+
+func enabled() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return dir != ""
+}
+
+// SpanContext identifies a span, it is what travels between nodes.
+type SpanContext struct {
+	TraceID string `json:"trace_id"`
+	SpanID  string `json:"span_id"`
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != "" && sc.SpanID != ""
+}
+
+// FromBody extracts the span context a peer attached to body.
+func FromBody(body map[string]any) SpanContext {
+	return parse(body["trace"])
+}
+
+// FromBatch extracts the span contexts attached to a batch of values, index i
+// belongs to the i-th value. Missing entries are invalid span contexts.
+func FromBatch(body map[string]any, size int) []SpanContext {
+	contexts := make([]SpanContext, size)
+	raw, _ := body["traces"].([]any)
+	for i := 0; i < len(raw) && i < size; i++ {
+		contexts[i] = parse(raw[i])
+	}
+	return contexts
+}
+
+func parse(v any) SpanContext {
+	m, ok := v.(map[string]any)
+	if !ok {
+		return SpanContext{}
+	}
+	traceID, _ := m["trace_id"].(string)
+	spanID, _ := m["span_id"].(string)
+	return SpanContext{TraceID: traceID, SpanID: spanID}
+}
+
+// Inject attaches sc to body, if there is anything to attach.
+func Inject(body map[string]any, sc SpanContext) {
+	if sc.IsValid() {
+		body["trace"] = sc
+	}
+}
+
+// InjectBatch attaches one span context per value of a batch.
+func InjectBatch(body map[string]any, contexts []SpanContext) {
+	for _, sc := range contexts {
+		if sc.IsValid() {
+			body["traces"] = contexts
+			return
+		}
+	}
+}
+
+// Span is a timed operation on this node.
+type Span struct {
+	ctx        SpanContext
+	parent     string
+	name       string
+	kind       int
+	start      time.Time
+	attributes map[string]any
+	links      []SpanContext
+
+	once sync.Once
+}
+
+// Start begins a span. An invalid parent starts a new trace.
+func Start(name string, kind int, parent SpanContext) *Span {
+	if !enabled() {
+		return nil
+	}
+	traceID := parent.TraceID
+	if !parent.IsValid() {
+		traceID = newID(16)
+	}
+	return &Span{
+		ctx:        SpanContext{TraceID: traceID, SpanID: newID(8)},
+		parent:     parent.SpanID,
+		name:       name,
+		kind:       kind,
+		start:      clock.Now(),
+		attributes: make(map[string]any),
+	}
+}
+
+// Context returns what a child span, possibly on another node, needs.
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.ctx
+}
+
+// SetAttribute records a string, bool or numeric attribute on the span.
+func (s *Span) SetAttribute(key string, value any) {
+	if s == nil {
+		return
+	}
+	mu.Lock()
+	s.attributes[key] = value
+	mu.Unlock()
+}
+
+// Link relates the span to others it isn't a child of, like a batch RPC to
+// the values it carries.
+func (s *Span) Link(contexts ...SpanContext) {
+	if s == nil {
+		return
+	}
+	mu.Lock()
+	for _, sc := range contexts {
+		if sc.IsValid() {
+			s.links = append(s.links, sc)
+		}
+	}
+	mu.Unlock()
+}
+
+// End finishes the span and writes it out, only the first call counts.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.once.Do(func() {
+		export(s, clock.Now())
+	})
+}
+
+func newID(bytes int) string {
+	buf := make([]byte, bytes)
+	mu.Lock()
+	randGen.Read(buf)
+	mu.Unlock()
+	return hex.EncodeToString(buf)
+}
+
+// OTLP/JSON, see opentelemetry-proto's trace.proto
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Links             []otlpLink      `json:"links,omitempty"`
+}
+
+type otlpLink struct {
+	TraceID string `json:"traceId"`
+	SpanID  string `json:"spanId"`
+}
+
+type otlpAttribute struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+func attribute(key string, value any) otlpAttribute {
+	switch v := value.(type) {
+	case bool:
+		return otlpAttribute{Key: key, Value: map[string]any{"boolValue": v}}
+	case int:
+		// int64 are strings in OTLP/JSON
+		return otlpAttribute{Key: key, Value: map[string]any{"intValue": strconv.Itoa(v)}}
+	case float64:
+		return otlpAttribute{Key: key, Value: map[string]any{"doubleValue": v}}
+	case string:
+		return otlpAttribute{Key: key, Value: map[string]any{"stringValue": v}}
+	default:
+		buf, _ := json.Marshal(v)
+		return otlpAttribute{Key: key, Value: map[string]any{"stringValue": string(buf)}}
+	}
+}
+
+func export(s *Span, end time.Time) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if file == nil {
+		f, err := os.Create(filepath.Join(dir, node.ID()+".spans.jsonl"))
+		if err != nil {
+			logger.Error("Disabling tracing", "err", err)
+			dir = ""
+			return
+		}
+		file = f
+	}
+
+	span := otlpSpan{
+		TraceID:           s.ctx.TraceID,
+		SpanID:            s.ctx.SpanID,
+		ParentSpanID:      s.parent,
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(end.UnixNano(), 10),
+	}
+	keys := make([]string, 0, len(s.attributes))
+	for key := range s.attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		span.Attributes = append(span.Attributes, attribute(key, s.attributes[key]))
+	}
+	for _, link := range s.links {
+		span.Links = append(span.Links, otlpLink{TraceID: link.TraceID, SpanID: link.SpanID})
+	}
+
+	scope := otlpScopeSpans{Spans: []otlpSpan{span}}
+	scope.Scope.Name = "glomers/tracing"
+	buf, err := json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: []otlpAttribute{
+			attribute("service.name", "glomers"),
+			attribute("service.instance.id", node.ID()),
+		}},
+		ScopeSpans: []otlpScopeSpans{scope},
+	}}})
+	if err != nil {
+		logger.Warn("Dropping span", "name", s.name, "err", err)
+		return
+	}
+	if _, err := file.Write(append(buf, '\n')); err != nil {
+		logger.Warn("Error writing span", "err", err)
+	}
+}
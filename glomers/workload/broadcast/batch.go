@@ -0,0 +1,196 @@
+package broadcast
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"glomers/bitmap"
+	"glomers/config"
+	"glomers/delta"
+	"glomers/store"
+	"glomers/tracing"
+)
+
+// The compact forms the integers of a batch can take besides a JSON array
+const (
+	encodingBitmap = "bitmap"
+	encodingVarint = "varint"
+)
+
+// batchEncodings is what this node reads. Every batch, and every
+// broadcast_ok to one, lists them in "encodings", and a peer only gets
+// compact batches once it listed the form, so nodes that don't know about
+// them keep getting JSON arrays.
+var batchEncodings = []string{encodingBitmap, encodingVarint}
+
+// peerEncodings is what each peer said it reads.
+type peerEncodings struct {
+	mu     sync.Mutex
+	byPeer map[string][]string
+}
+
+// learn remembers the encodings peer listed in body, if it listed any.
+func (p *peerEncodings) learn(peer string, body json.RawMessage) {
+	var listed struct {
+		Encodings []string `json:"encodings"`
+	}
+	if json.Unmarshal(body, &listed) != nil || listed.Encodings == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.byPeer == nil {
+		p.byPeer = make(map[string][]string)
+	}
+	p.byPeer[peer] = listed.Encodings
+}
+
+// usable returns the encodings enabled in c that peer reads.
+func (p *peerEncodings) usable(peer string, c config.Config) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	enabled := map[string]bool{
+		encodingBitmap: c.BatchBitmaps,
+		encodingVarint: c.BatchVarints,
+	}
+	var out []string
+	for _, encoding := range batchEncodings {
+		if enabled[encoding] && slices.Contains(p.byPeer[peer], encoding) {
+			out = append(out, encoding)
+		}
+	}
+	return out
+}
+
+// encodeBatch puts messages in a batched broadcast body. With encodings the
+// integers among them go, in whichever of those forms is the smallest, as a
+// serialised bitmap in "bitmap" or as varint deltas (see package delta) in
+// "packed", base64 encoded, and only the rest in "messages":
+//
+//	{"type": "broadcast", "packed": "ZAEBAQ==", "messages": ["a"], "encodings": ["bitmap", "varint"]}
+//
+// The values of a batch are then the integers in ascending order followed by
+// the messages, traces are reordered to match.
+func encodeBatch(body map[string]any, messages []store.Value, traces []tracing.SpanContext, encodings []string) error {
+	body["encodings"] = batchEncodings
+	if len(encodings) == 0 {
+		body["messages"] = messages
+		tracing.InjectBatch(body, traces)
+		return nil
+	}
+
+	ints := &bitmap.Bitmap{}
+	traceOf := make(map[int64]tracing.SpanContext)
+	var others []store.Value
+	var otherTraces []tracing.SpanContext
+	for i, message := range messages {
+		var sc tracing.SpanContext
+		if i < len(traces) {
+			sc = traces[i]
+		}
+		if v, ok := message.Int64(); ok {
+			ints.Add(v)
+			traceOf[v] = sc
+			continue
+		}
+		others = append(others, message)
+		otherTraces = append(otherTraces, sc)
+	}
+
+	ordered := make([]tracing.SpanContext, 0, len(messages))
+	if ints.Len() > 0 {
+		field, packed, err := packInts(ints, encodings)
+		if err != nil {
+			return err
+		}
+		body[field] = packed
+		ints.Each(func(v int64) bool {
+			ordered = append(ordered, traceOf[v])
+			return true
+		})
+	}
+	if len(others) > 0 {
+		body["messages"] = others
+	}
+	tracing.InjectBatch(body, append(ordered, otherTraces...))
+	return nil
+}
+
+// packInts encodes ints in the smallest of encodings, and returns the body
+// field it goes in.
+func packInts(ints *bitmap.Bitmap, encodings []string) (string, string, error) {
+	var field string
+	var smallest []byte
+	for _, encoding := range encodings {
+		var f string
+		var buf []byte
+		switch encoding {
+		case encodingBitmap:
+			var err error
+			if buf, err = ints.MarshalBinary(); err != nil {
+				return "", "", err
+			}
+			f = "bitmap"
+		case encodingVarint:
+			buf, f = delta.Encode(ints.Values()), "packed"
+		default:
+			continue
+		}
+		if smallest == nil || len(buf) < len(smallest) {
+			field, smallest = f, buf
+		}
+	}
+	if smallest == nil {
+		return "", "", fmt.Errorf("no known encoding in %v", encodings)
+	}
+	return field, base64.StdEncoding.EncodeToString(smallest), nil
+}
+
+// decodeBatch returns the values of a batched broadcast in the order
+// encodeBatch put them in.
+func decodeBatch(raw json.RawMessage) ([]store.Value, error) {
+	var batch struct {
+		Bitmap   string        `json:"bitmap"`
+		Packed   string        `json:"packed"`
+		Messages []store.Value `json:"messages"`
+	}
+	if err := json.Unmarshal(raw, &batch); err != nil {
+		return nil, err
+	}
+
+	var ints []int64
+	switch {
+	case batch.Bitmap != "" && batch.Packed != "":
+		return nil, errors.New("a batch holds either a bitmap or packed values")
+	case batch.Bitmap != "":
+		buf, err := base64.StdEncoding.DecodeString(batch.Bitmap)
+		if err != nil {
+			return nil, fmt.Errorf("bitmap: %w", err)
+		}
+		var b bitmap.Bitmap
+		if err := b.UnmarshalBinary(buf); err != nil {
+			return nil, err
+		}
+		ints = b.Values()
+	case batch.Packed != "":
+		buf, err := base64.StdEncoding.DecodeString(batch.Packed)
+		if err != nil {
+			return nil, fmt.Errorf("packed: %w", err)
+		}
+		if ints, err = delta.Decode(buf); err != nil {
+			return nil, err
+		}
+	default:
+		return batch.Messages, nil
+	}
+
+	values := make([]store.Value, 0, len(ints)+len(batch.Messages))
+	for _, v := range ints {
+		values = append(values, store.Int(v))
+	}
+	return append(values, batch.Messages...), nil
+}
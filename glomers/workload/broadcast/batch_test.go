@@ -0,0 +1,93 @@
+package broadcast
+
+import (
+	"encoding/json"
+	"math/rand"
+	"testing"
+
+	"glomers/spread"
+	"glomers/store"
+)
+
+// The batch_size batches are cut at by default
+const benchBatch = 100
+
+// The encodings a peer can list, the last what two new nodes agree on
+var benchEncodings = []struct {
+	name      string
+	encodings []string
+}{
+	{"json", nil},
+	{"bitmap", []string{encodingBitmap}},
+	{"varint", []string{encodingVarint}},
+	{"smallest", batchEncodings},
+}
+
+// benchBatches returns a batch of each spread, in the order its values
+// arrived.
+func benchBatches() map[string][]store.Value {
+	r := rand.New(rand.NewSource(1))
+	batches := make(map[string][]store.Value)
+	for _, s := range spread.All {
+		_, arrived := s.Batch(r, benchBatch)
+		messages := make([]store.Value, len(arrived))
+		for i, v := range arrived {
+			messages[i] = store.Int(v)
+		}
+		batches[s.Name] = messages
+	}
+	return batches
+}
+
+// encodeBody is the broadcast a batch goes out as.
+func encodeBody(b *testing.B, messages []store.Value, encodings []string) []byte {
+	body := map[string]any{"type": "broadcast"}
+	if err := encodeBatch(body, messages, nil, encodings); err != nil {
+		b.Fatal(err)
+	}
+	buf, err := json.Marshal(body)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return buf
+}
+
+// BenchmarkEncodeBatch times putting a batch in a broadcast body and
+// reports the bytes every value takes of the whole body, as cmd/batchbench
+// does for the values alone.
+func BenchmarkEncodeBatch(b *testing.B) {
+	batches := benchBatches()
+	for _, s := range spread.All {
+		for _, e := range benchEncodings {
+			b.Run(s.Name+"/"+e.name, func(b *testing.B) {
+				var size int
+				for i := 0; i < b.N; i++ {
+					size = len(encodeBody(b, batches[s.Name], e.encodings))
+				}
+				b.ReportMetric(float64(size)/benchBatch, "bytes/value")
+			})
+		}
+	}
+}
+
+// BenchmarkDecodeBatch times reading the values back out of a body.
+func BenchmarkDecodeBatch(b *testing.B) {
+	batches := benchBatches()
+	for _, s := range spread.All {
+		for _, e := range benchEncodings {
+			b.Run(s.Name+"/"+e.name, func(b *testing.B) {
+				body := encodeBody(b, batches[s.Name], e.encodings)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					values, err := decodeBatch(body)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if len(values) != benchBatch {
+						b.Fatalf("decoded %d values, want %d", len(values), benchBatch)
+					}
+				}
+			})
+		}
+	}
+}
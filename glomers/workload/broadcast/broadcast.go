@@ -0,0 +1,332 @@
+// Package broadcast holds every solution to the broadcast challenges (#3a to
+// #3e), along with later protocols like Plumtree, selectable at runtime as
+// strategies.
+package broadcast
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+
+	"glomers/breaker"
+	"glomers/config"
+	"glomers/delivery"
+	"glomers/lag"
+	"glomers/logging"
+	"glomers/membership"
+	"glomers/metrics"
+	"glomers/outbound"
+	"glomers/repair"
+	"glomers/store"
+	"glomers/swim"
+)
+
+var (
+	logger         = logging.Component("broadcast")
+	peerCopyLogger = logging.Component("peerCopy")
+)
+
+// Each strategy only looks at the parts of the config it cares about, and
+// starts svc through openStore
+var strategies = map[string]func(n *maelstrom.Node, cfg *config.Store, svc *services){
+	"single":   registerSingle,  // #3a
+	"flood":    registerFlood,   // #3b
+	"gossip":   registerGossip,  // #3c
+	"tree":     registerTree,    // #3d
+	"batched":  registerBatched, // #3e
+	"plumtree": registerPlumtree,
+}
+
+// Strategies lists the names Register accepts.
+func Strategies() []string {
+	names := make([]string, 0, len(strategies))
+	for name := range strategies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Register installs the handlers of the given strategy on n, along with
+// update_config to tune it at runtime, the membership protocol, the failure
+// detector, lag and delivery tracking and the anti-entropy of the repair
+// package.
+func Register(n *maelstrom.Node, strategy string, cfg *config.Store) error {
+	register, ok := strategies[strategy]
+	if !ok {
+		return fmt.Errorf("unknown broadcast strategy %q, expected one of %s",
+			strategy, strings.Join(Strategies(), "|"))
+	}
+	logger.Info("Registering broadcast", "strategy", strategy)
+	svc := &services{
+		members:  membership.Register(n, cfg),
+		failures: swim.Register(n, cfg),
+		outbound: outbound.New(outboundOptions(cfg.Get())),
+		breakers: breaker.Register(n, cfg),
+	}
+	svc.lag = lag.Register(n, svc.members)
+	svc.delivery = delivery.Register(n, cfg)
+	svc.quorum = newQuorum(n, cfg, svc)
+	cfg.Subscribe(func(_, cur config.Config) {
+		svc.outbound.Reconfigure(outboundOptions(cur))
+	})
+	svc.repair = repair.Register(n, cfg, svc)
+	register(n, cfg, svc)
+	cfg.Handle(n)
+	return nil
+}
+
+// services are what every strategy shares, set up by Register before the
+// node runs and started by openStore once it knows who it is.
+type services struct {
+	members  *membership.Membership
+	failures *swim.Detector
+	repair   *repair.Repairer
+	outbound *outbound.Scheduler
+	breakers *breaker.Breakers
+	lag      *lag.Tracker
+	delivery *delivery.Tracker
+	quorum   *quorum
+
+	// Who the strategy sends values to, set before the node runs
+	neighbours func() []string
+}
+
+// setNeighbours tells lag tracking and write quorums who the strategy sends
+// values to.
+func (svc *services) setNeighbours(fn func() []string) {
+	svc.neighbours = fn
+	svc.lag.Neighbours(fn)
+}
+
+func outboundOptions(c config.Config) outbound.Options {
+	return outbound.Options{
+		Workers:  c.OutboundWorkers,
+		InFlight: c.OutboundInFlight,
+		PerPeer:  c.OutboundPerPeer,
+		Queue:    c.OutboundQueue,
+	}
+}
+
+// Peers returns the peers of the membership the failure detector thinks are
+// up.
+func (svc *services) Peers() []string {
+	return svc.failures.Filter(svc.members.Peers())
+}
+
+// Unacked and Acked hand the lag tracker to the repair, which favours the
+// peers furthest behind.
+func (svc *services) Unacked(peer string) int {
+	return svc.lag.Unacked(peer)
+}
+
+func (svc *services) Acked(peer string, values []store.Value) {
+	svc.lag.Acked(peer, values)
+}
+
+// Received hands the values a repair pulled in to delivery tracking, which
+// acknowledges them to the peer they came from.
+func (svc *services) Received(peer string, values []store.Value) {
+	svc.delivery.Received(peer, values)
+}
+
+// confirms tells whether the reply to a client broadcast has to wait for
+// confirm.
+func (svc *services) confirms(body map[string]any) bool {
+	_, wait := body["wait_for"]
+	return wait || svc.quorum.cfg.Get().WriteQuorum > 1
+}
+
+// confirm holds back the reply to a client broadcast until message is stored
+// on the write quorum, and as many nodes hold it as its wait_for asks, if it
+// asks. Strategies that pass values on from replicas replicate themselves,
+// then await.
+func (svc *services) confirm(body map[string]any, message store.Value) error {
+	if _, err := svc.quorum.replicate(message); err != nil {
+		return err
+	}
+	return svc.await(body, message)
+}
+
+// await holds back the reply to a client broadcast until as many nodes hold
+// message as its wait_for asks, if it asks.
+func (svc *services) await(body map[string]any, message store.Value) error {
+	waitFor, ok := body["wait_for"]
+	if !ok {
+		return nil
+	}
+	s, _ := waitFor.(string)
+	return svc.delivery.Await(message, s)
+}
+
+// waitUsable blocks while the failure detector thinks peer is down, so retry
+// loops stop hammering it.
+func (svc *services) waitUsable(peer string) {
+	alive := svc.failures.Alive(peer)
+	select {
+	case <-alive:
+		return
+	default:
+	}
+	peerCopyLogger.Debug("Holding off until peer is back", "peer", peer, "state", svc.failures.State(peer))
+	<-alive
+}
+
+// openStore recovers the values of this node, joins the membership and
+// starts repairing the values. It has to run in the init handler so nothing
+// is answered before recovery is done.
+func openStore(n *maelstrom.Node, cfg *config.Store, svc *services) (*store.Messages, error) {
+	c := cfg.Get()
+	dir := nodeDir(n, c)
+	messages, err := store.Open(storeOptions(c, dir))
+	if err != nil {
+		return nil, err
+	}
+	cfg.Subscribe(func(_, cur config.Config) {
+		messages.Reconfigure(storeOptions(cur, dir))
+	})
+	metrics.Gauge("messages_stored", func() float64 { return float64(messages.Len()) })
+	metrics.Gauge("messages_bitmap_bytes", func() float64 { return float64(messages.IntBytes()) })
+	svc.lag.Known(messages.Watch(svc.lag.Known))
+	svc.quorum.start(messages)
+	svc.members.Start()
+	svc.failures.Start()
+	svc.repair.Start(messages)
+	return messages, nil
+}
+
+// nodeDir is where the node keeps its data, empty when it keeps none.
+func nodeDir(n *maelstrom.Node, c config.Config) string {
+	if c.DataDir == "" {
+		return ""
+	}
+	return filepath.Join(c.DataDir, n.ID())
+}
+
+func storeOptions(c config.Config, dir string) store.Options {
+	return store.Options{
+		Dir:              dir,
+		Fsync:            c.Fsync,
+		FsyncInterval:    c.FsyncInterval,
+		SnapshotInterval: c.SnapshotInterval,
+	}
+}
+
+// DeepCloneMap creates a deep copy of a map[string]interface{}.
+func DeepCloneMap(originalMap map[string]interface{}) map[string]interface{} {
+	// Marshal the original map into JSON
+	mapJSON, err := json.Marshal(originalMap)
+	if err != nil {
+		log.Fatalf("Error marshalling map: %v", err)
+	}
+
+	// Unmarshal the JSON back into a new map
+	var clonedMap map[string]interface{}
+	err = json.Unmarshal(mapJSON, &clonedMap)
+	if err != nil {
+		log.Fatalf("Error unmarshalling map: %v", err)
+	}
+
+	return clonedMap
+}
+
+// messageOf decodes the "message" of a broadcast exactly, as a number in a
+// map[string]any it is a float64 and integers past 2^53 lose their low bits.
+func messageOf(msg maelstrom.Message) (store.Value, error) {
+	var body struct {
+		Message store.Value `json:"message"`
+	}
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return "", maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
+	}
+	if body.Message == "" {
+		return "", maelstrom.NewRPCError(maelstrom.MalformedRequest, "broadcast needs a message")
+	}
+	return body.Message, nil
+}
+
+// readReply answers a read. Without since or limit it is every value, as
+// Maelstrom expects. since is a cursor, the number of values already read in
+// the order this node added them, and limit caps how many come back; the
+// reply then tells where to read from next:
+//
+//	Request
+//	{
+//	  "type": "read",
+//	  "since": 120,
+//	  "limit": 50
+//	}
+//
+//	Response
+//	{
+//	  "type": "read_ok",
+//	  "messages": [9, 4, 31],
+//	  "next_cursor": 123
+//	}
+//
+// Cursors are only good on the node that handed them out, and across its
+// restarts only with a data_dir. One past what the node holds is refused
+// with precondition-failed.
+func readReply(msg maelstrom.Message, messages *store.Messages) (map[string]any, error) {
+	var body struct {
+		Since *int `json:"since"`
+		Limit *int `json:"limit"`
+	}
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return nil, maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
+	}
+	view := messages.View()
+	if body.Since == nil && body.Limit == nil {
+		return map[string]any{
+			"type":     "read_ok",
+			"messages": view,
+		}, nil
+	}
+
+	from, to := 0, view.Len()
+	if body.Since != nil {
+		from = *body.Since
+	}
+	if from < 0 {
+		return nil, maelstrom.NewRPCError(maelstrom.MalformedRequest, fmt.Sprintf("since can't be negative, got %d", from))
+	}
+	if from > to {
+		return nil, maelstrom.NewRPCError(maelstrom.PreconditionFailed,
+			fmt.Sprintf("cursor %d is past the %d values here", from, to))
+	}
+	if body.Limit != nil {
+		if *body.Limit < 1 {
+			return nil, maelstrom.NewRPCError(maelstrom.MalformedRequest, fmt.Sprintf("limit must be at least 1, got %d", *body.Limit))
+		}
+		to = min(to, from+*body.Limit)
+	}
+	return map[string]any{
+		"type":        "read_ok",
+		"messages":    append([]store.Value{}, view.Range(from, to)...),
+		"next_cursor": to,
+	}, nil
+}
+
+// peerNames returns the peers of a topology set, sorted.
+func peerNames(peers map[interface{}]interface{}) []string {
+	names := make([]string, 0, len(peers))
+	for peer := range peers {
+		names = append(names, peer.(string))
+	}
+	sort.Strings(names)
+	return names
+}
+
+func addIfNotPresent(messagesMap map[interface{}]interface{}, message interface{}) bool {
+	var exists struct{}
+	if _, found := messagesMap[message]; !found {
+		messagesMap[message] = exists
+		return true
+	}
+	return false
+}
@@ -0,0 +1,181 @@
+package broadcast
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+
+	"glomers/config"
+	"glomers/logging"
+	"glomers/node"
+	"glomers/store"
+)
+
+// registerFlood is #3b, every broadcast is copied to every peer in the topology
+func registerFlood(n *maelstrom.Node, cfg *config.Store, svc *services) {
+	logger.Info("Inside MultiNode Brodcast Main")
+	// Recover whatever we had stored before answering anything
+	var messages *store.Messages
+	n.Handle("init", func(_ maelstrom.Message) error {
+		var err error
+		messages, err = openStore(n, cfg, svc)
+		return err
+	})
+	var peersMu sync.Mutex
+	peers := make(map[interface{}]interface{})
+	// The topology handler adds to peers, read them through this
+	neighbours := func() []string {
+		peersMu.Lock()
+		defer peersMu.Unlock()
+		return peerNames(peers)
+	}
+	svc.setNeighbours(neighbours)
+
+	// Register the broadcast handler
+	/**
+	// Sample
+	{
+	  "type": "broadcast",
+	  "message": 1000
+	}
+	**/
+	n.Handle("broadcast", func(msg maelstrom.Message) error {
+		var body map[string]any
+
+		if err := json.Unmarshal(msg.Body, &body); err != nil {
+			return err
+		}
+
+		logging.WithMsg(logger, msg).Debug("Received broadcast", "message", body["message"])
+
+		// Persist the data
+		message, err := messageOf(msg)
+		if err != nil {
+			return err
+		}
+		if _, err := messages.Add(message); err != nil {
+			return err
+		}
+		svc.delivery.Originated(message)
+
+		// Do the peerCopy
+		go floodPeerCopy(message, neighbours(), n, svc)
+
+		if err := svc.confirm(body, message); err != nil {
+			return err
+		}
+
+		// Do the cleanup
+		body["type"] = "broadcast_ok"
+		delete(body, "message")
+		delete(body, "wait_for")
+		return n.Reply(msg, body)
+	})
+
+	n.Handle("peerCopy", func(msg maelstrom.Message) error {
+		message, err := messageOf(msg)
+		if err != nil {
+			return err
+		}
+		logging.WithMsg(logger, msg).Debug("Received peerCopy", "message", message)
+		added, err := messages.Add(message)
+		if err != nil {
+			return err
+		}
+		svc.delivery.Received(msg.Src, added)
+		svc.lag.Acked(msg.Src, []store.Value{message})
+
+		return node.Reply(n, msg, map[string]any{
+			"type":    "peerCopyOk",
+			"message": message,
+		})
+	})
+
+	// Handle Read operation
+	/**
+	Request
+	{
+		"type": "read"
+	}
+
+	Response
+	{
+	  "type": "read_ok",
+	  "messages": [1, 8, 72, 25]
+	}
+
+	Or a page of them, see readReply
+	**/
+
+	n.Handle("read", func(msg maelstrom.Message) error {
+		reply, err := readReply(msg, messages)
+		if err != nil {
+			return err
+		}
+		return node.Reply(n, msg, reply)
+	})
+
+	// Handle the topology request
+	n.Handle("topology", func(msg maelstrom.Message) error {
+		var body map[string]any
+
+		if err := json.Unmarshal(msg.Body, &body); err != nil {
+			return err
+		}
+
+		logger := logging.WithMsg(logger, msg)
+
+		body["type"] = "topology_ok"
+
+		// Persist the topology as well
+		topology := body["topology"].(map[string]interface{})
+
+		logger.Debug("Received topology", "topology", topology)
+
+		// Iterate over topology Interface
+		for _, connectionsInterface := range topology {
+			// Type assertion for connections
+			connections, ok := connectionsInterface.([]interface{})
+			if !ok {
+				log.Fatal("Tpe assertion Failed for Connections interface")
+				panic(nil)
+			}
+			for _, connection := range connections {
+				connectionStr, ok := connection.(string)
+				if !ok {
+					log.Fatal("Type assertion failed for connection ")
+					panic(nil)
+				}
+				if connectionStr != n.ID() {
+					peersMu.Lock()
+					addIfNotPresent(peers, connectionStr)
+					peersMu.Unlock()
+				}
+			}
+		}
+
+		delete(body, "topology")
+		logger.Info("Complete topology", "peers", neighbours())
+		return n.Reply(msg, body)
+	})
+}
+
+// floodPeerCopy sends the value to every peer, whose peerCopyOk is all the
+// lag tracker hears of it.
+func floodPeerCopy(message store.Value, peers []string, n *maelstrom.Node, svc *services) {
+	peerCopyMessage := map[string]interface{}{
+		"type":    "peerCopy",
+		"message": message,
+	}
+	for _, peer := range peers {
+		err := node.RPC(n, peer, peerCopyMessage, func(msg maelstrom.Message) error {
+			svc.lag.Acked(msg.Src, []store.Value{message})
+			return nil
+		})
+		if err != nil {
+			peerCopyLogger.Warn("Error sending peerCopy", "peer", peer, "err", err)
+		}
+	}
+}
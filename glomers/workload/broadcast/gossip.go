@@ -0,0 +1,249 @@
+package broadcast
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+	"golang.org/x/exp/maps"
+
+	"glomers/clock"
+	"glomers/config"
+	"glomers/logging"
+	"glomers/node"
+	"glomers/store"
+)
+
+var gossipMu sync.Mutex
+
+// registerGossip is #3c, peers are periodically sent whatever they haven't
+// acknowledged yet, which survives partitions
+func registerGossip(n *maelstrom.Node, cfg *config.Store, svc *services) {
+	logger.Info("Inside Fault Tolerant MultiNode Brodcast Main")
+	ticker := clock.NewTicker(cfg.Get().GossipInterval)
+	cfg.Subscribe(func(old, cur config.Config) {
+		if cur.GossipInterval != old.GossipInterval {
+			ticker.Reset(cur.GossipInterval)
+		}
+	})
+	peers := make(map[interface{}]interface{})
+	svc.setNeighbours(func() []string {
+		gossipMu.Lock()
+		defer gossipMu.Unlock()
+		return peerNames(peers)
+	})
+
+	// We should also maintain a map that for every peer, how much we have already peer-copied to them
+	peersCheckPoint := make(map[interface{}]map[interface{}]interface{})
+
+	// Recover whatever we had stored before answering anything, and only
+	// then start peer-copying it
+	var messages *store.Messages
+	n.Handle("init", func(_ maelstrom.Message) error {
+		var err error
+		if messages, err = openStore(n, cfg, svc); err != nil {
+			return err
+		}
+
+		// Ticks several times a second, so only keep a sample of them
+		tickLogger := logging.Sampled(peerCopyLogger, 25)
+		go func() {
+			for t := range ticker.C() {
+				// Anti-entropy supersedes the checkpoints, which go wrong as
+				// soon as values arrive in a different order on different nodes
+				if cfg.Get().Repair != "" {
+					continue
+				}
+				tickLogger.Debug("Initiating PeerCopy", "at", t)
+				gossipPeerCopy(peers, n, svc, peersCheckPoint, messages.All())
+			}
+		}()
+		return nil
+	})
+
+	// Register the broadcast handler
+	/**
+	// Sample
+	{
+	  "type": "broadcast",
+	  "message": 1000
+	}
+	**/
+	n.Handle("broadcast", func(msg maelstrom.Message) error {
+		var body map[string]any
+
+		if err := json.Unmarshal(msg.Body, &body); err != nil {
+			return err
+		}
+
+		logging.WithMsg(logger, msg).Debug("Received broadcast", "message", body["message"])
+
+		// Persist the data
+		message, err := messageOf(msg)
+		if err != nil {
+			return err
+		}
+		if _, err := messages.Add(message); err != nil {
+			return err
+		}
+		svc.delivery.Originated(message)
+		if err := svc.confirm(body, message); err != nil {
+			return err
+		}
+
+		// Do the cleanup
+		body["type"] = "broadcast_ok"
+		delete(body, "message")
+		delete(body, "wait_for")
+		return n.Reply(msg, body)
+	})
+
+	n.Handle("peerCopy", func(msg maelstrom.Message) error {
+		var body map[string]any
+
+		if err := json.Unmarshal(msg.Body, &body); err != nil {
+			return err
+		}
+
+		var values struct {
+			Message []store.Value `json:"message"`
+		}
+		if err := json.Unmarshal(msg.Body, &values); err != nil {
+			return err
+		}
+		received := values.Message
+
+		logger := logging.WithMsg(peerCopyLogger, msg)
+		logger.Debug("Received peerCopy", "count", len(received))
+		added, err := messages.Add(received...)
+		if err != nil {
+			return err
+		}
+		svc.delivery.Received(msg.Src, added)
+		svc.lag.Acked(msg.Src, received)
+		if skipped := len(received) - len(added); skipped > 0 {
+			logger.Debug("Skipping messages we already had from peerCopy", "count", skipped)
+		}
+
+		// Echoed exactly, the sender checkpoints what comes back
+		body["type"] = "peerCopyOk"
+		body["message"] = received
+		return node.Reply(n, msg, body)
+	})
+
+	// Handle Read operation
+	/**
+	Request
+	{
+		"type": "read"
+	}
+
+	Response
+	{
+	  "type": "read_ok",
+	  "messages": [1, 8, 72, 25]
+	}
+
+	Or a page of them, see readReply
+	**/
+
+	n.Handle("read", func(msg maelstrom.Message) error {
+		reply, err := readReply(msg, messages)
+		if err != nil {
+			return err
+		}
+		return node.Reply(n, msg, reply)
+	})
+
+	// Handle the topology request
+	n.Handle("topology", func(msg maelstrom.Message) error {
+		var body map[string]any
+
+		if err := json.Unmarshal(msg.Body, &body); err != nil {
+			return err
+		}
+
+		logger := logging.WithMsg(logger, msg)
+
+		body["type"] = "topology_ok"
+
+		// Persist the topology as well
+		topology := body["topology"].(map[string]interface{})
+
+		logger.Debug("Received topology", "topology", topology)
+
+		// Iterate over topology Interface, for this Node
+		for _, connection := range topology[n.ID()].([]interface{}) {
+			connectionStr, ok := connection.(string)
+			if !ok {
+				log.Fatal("Type assertion failed for connection ")
+				panic(nil)
+			}
+			if connectionStr != n.ID() {
+				gossipMu.Lock()
+				addIfNotPresent(peers, connectionStr)
+				gossipMu.Unlock()
+			}
+		}
+
+		delete(body, "topology")
+		logger.Info("Topology of this node", "peers", maps.Keys(peers))
+
+		// Set the checkpoint for all peers
+		for _, peer := range peers {
+			peersCheckPoint[peer] = make(map[interface{}]interface{})
+		}
+		return n.Reply(msg, body)
+	})
+}
+
+func gossipPeerCopy(peers map[interface{}]interface{}, n *maelstrom.Node, svc *services,
+	peersCheckPoint map[interface{}]map[interface{}]interface{}, messagesTillNow []store.Value) {
+	peerCopyMessage := map[string]interface{}{
+		"type":    "peerCopy",
+		"message": []store.Value{},
+	}
+	for _, peer := range maps.Keys(peers) {
+
+		// Find the difference between last checkPoint and current length
+		if (len(messagesTillNow) - len(peersCheckPoint[peer])) > 0 {
+			// Take the sub-slice and send to peer
+			peerCopyMessage["message"] = messagesTillNow[len(peersCheckPoint[peer]):]
+
+			if len(peerCopyMessage["message"].([]store.Value)) == 0 {
+				return
+			}
+
+			peerCopyLogger.Debug("Peer is lagging behind, sending remaining messages in one shot",
+				"peer", peer, "checkpoint", len(peersCheckPoint[peer]), "count", len(peerCopyMessage["message"].([]store.Value)))
+
+			err := node.RPC(n, peer.(string), peerCopyMessage, func(msg maelstrom.Message) error {
+				var body struct {
+					Message []store.Value `json:"message"`
+				}
+
+				if err := json.Unmarshal(msg.Body, &body); err != nil {
+					return err
+				}
+
+				// Let's add whatever we sent till now
+				gossipMu.Lock()
+				from := len(peersCheckPoint[msg.Src])
+				for _, message := range body.Message {
+					if peersCheckPoint[msg.Src] == nil {
+						peersCheckPoint[msg.Src] = make(map[interface{}]interface{})
+					}
+					peersCheckPoint[msg.Src][message] = struct{}{}
+				}
+				svc.lag.Acked(msg.Src, body.Message)
+				peerCopyLogger.Debug("Updated PeerCheckPoint", "peer", msg.Src, "from", from, "to", len(peersCheckPoint[msg.Src]))
+				gossipMu.Unlock()
+				return nil
+			})
+			if err != nil {
+				peerCopyLogger.Warn("Error while sending RPC to peer", "peer", peer, "err", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package broadcast
+
+import (
+	"slices"
+	"sync"
+
+	"glomers/clock"
+	"glomers/config"
+	"glomers/metrics"
+	"glomers/store"
+	"glomers/tracing"
+)
+
+// outbox holds the values waiting to be forwarded to each peer. A peer's
+// values go out, to its retry queue, once BatchSize of them are waiting or
+// the first has waited BatchFrequency, whichever comes first. A value
+// already waiting isn't queued twice, and adding to a peer that has
+// OutboxLimit values waiting flushes them and waits for room, so a slow peer
+// slows down the broadcasts forwarded to it instead of losing their values.
+type outbox struct {
+	cfg *config.Store
+	// Delivers a batch, retrying as it sees fit
+	send func(dst string, messages []store.Value, traces []tracing.SpanContext)
+
+	mu    sync.Mutex
+	peers map[string]*peerOutbox
+	// Signalled whenever a batch leaves an outbox
+	room *sync.Cond
+}
+
+type peerOutbox struct {
+	messages []store.Value
+	// Span context of every value in messages, index for index
+	traces []tracing.SpanContext
+	queued map[store.Value]struct{}
+	// Flushes BatchFrequency after the first value of a batch
+	timer clock.Timer
+	// A batch is in flight, and the next one should follow it right away
+	sending bool
+	due     bool
+}
+
+func newOutbox(cfg *config.Store, send func(dst string, messages []store.Value, traces []tracing.SpanContext)) *outbox {
+	o := &outbox{cfg: cfg, send: send, peers: make(map[string]*peerOutbox)}
+	o.room = sync.NewCond(&o.mu)
+	metrics.Gauge("outbox_waiting", func() float64 {
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		waiting := 0
+		for _, p := range o.peers {
+			waiting += len(p.messages)
+		}
+		return float64(waiting)
+	})
+	return o
+}
+
+func (o *outbox) add(dst string, messages []store.Value, traces []tracing.SpanContext) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	p, ok := o.peers[dst]
+	if !ok {
+		p = &peerOutbox{queued: make(map[store.Value]struct{})}
+		o.peers[dst] = p
+	}
+	for i, message := range messages {
+		if _, ok := p.queued[message]; ok {
+			continue
+		}
+		o.waitRoom(dst, p)
+		p.queued[message] = struct{}{}
+		p.messages = append(p.messages, message)
+		p.traces = append(p.traces, traces[i])
+	}
+
+	if len(p.messages) >= o.cfg.Get().BatchSize {
+		o.flushLocked(dst, p)
+		return
+	}
+	o.arm(dst, p)
+}
+
+// waitRoom returns once dst has less than OutboxLimit values waiting,
+// flushing them if it has to, o.mu must be held.
+func (o *outbox) waitRoom(dst string, p *peerOutbox) {
+	for waited := false; len(p.messages) >= o.cfg.Get().OutboxLimit; waited = true {
+		if !waited {
+			metrics.Inc("outbox_full_total", "peer", dst)
+			peerCopyLogger.Warn("Outbox full, waiting for room", "dst", dst, "limit", o.cfg.Get().OutboxLimit)
+		}
+		if o.flushLocked(dst, p) == 0 {
+			o.room.Wait()
+		}
+	}
+}
+
+// arm starts the clock on a batch that has values and no timer yet.
+func (o *outbox) arm(dst string, p *peerOutbox) {
+	if p.timer == nil && len(p.messages) > 0 {
+		p.timer = clock.AfterFunc(o.cfg.Get().BatchFrequency, func() {
+			o.mu.Lock()
+			defer o.mu.Unlock()
+			p.timer = nil
+			o.flushLocked(dst, p)
+		})
+	}
+}
+
+// flushAll sends what is waiting for every peer without waiting for the
+// triggers, and returns how many values went out. Values behind a batch still
+// in flight follow as soon as it is done.
+func (o *outbox) flushAll() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	flushed := 0
+	for dst, p := range o.peers {
+		flushed += o.flushLocked(dst, p)
+	}
+	return flushed
+}
+
+// flushLocked sends up to BatchSize of dst's values, o.mu must be held.
+func (o *outbox) flushLocked(dst string, p *peerOutbox) int {
+	if p.timer != nil {
+		p.timer.Stop()
+		p.timer = nil
+	}
+	if len(p.messages) == 0 {
+		return 0
+	}
+	if p.sending {
+		p.due = true
+		return 0
+	}
+
+	n := min(len(p.messages), o.cfg.Get().BatchSize)
+	messages, traces := p.messages[:n], p.traces[:n]
+	p.messages, p.traces = slices.Clone(p.messages[n:]), slices.Clone(p.traces[n:])
+	for _, message := range messages {
+		delete(p.queued, message)
+	}
+	p.sending, p.due = true, false
+	o.room.Broadcast()
+
+	go func() {
+		o.send(dst, messages, traces)
+
+		o.mu.Lock()
+		defer o.mu.Unlock()
+		p.sending = false
+		if p.due || len(p.messages) >= o.cfg.Get().BatchSize {
+			o.flushLocked(dst, p)
+			return
+		}
+		o.arm(dst, p)
+	}()
+	return n
+}
@@ -0,0 +1,147 @@
+package broadcast
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"glomers/clock"
+	"glomers/config"
+	"glomers/store"
+	"glomers/tracing"
+)
+
+const testFrequency = 100 * time.Millisecond
+
+// testOutbox returns an outbox whose batches go to the returned channel once
+// release lets them, and runs its timers on a virtual clock.
+func testOutbox(t *testing.T, batchSize, limit int, release <-chan struct{}) (*outbox, <-chan []store.Value, *clock.Virtual) {
+	v := clock.NewVirtual(time.Unix(0, 0))
+	clock.Set(v)
+	t.Cleanup(func() { clock.Set(clock.Real{}) })
+
+	cfg := config.Default()
+	cfg.BatchSize, cfg.BatchFrequency, cfg.OutboxLimit = batchSize, testFrequency, limit
+	batches := make(chan []store.Value, 100)
+	o := newOutbox(config.NewStore(cfg), func(_ string, messages []store.Value, _ []tracing.SpanContext) {
+		batches <- messages
+		if release != nil {
+			<-release
+		}
+	})
+	return o, batches, v
+}
+
+func ints(values ...int64) []store.Value {
+	out := make([]store.Value, len(values))
+	for i, v := range values {
+		out[i] = store.Int(v)
+	}
+	return out
+}
+
+func addTo(o *outbox, values []store.Value) {
+	o.add("n1", values, make([]tracing.SpanContext, len(values)))
+}
+
+// receive takes n batches, advancing the clock while waiting when it may.
+func receive(t *testing.T, batches <-chan []store.Value, n int, v *clock.Virtual) [][]store.Value {
+	t.Helper()
+	var got [][]store.Value
+	deadline := time.After(2 * time.Second)
+	for len(got) < n {
+		if v != nil {
+			v.Advance(v.Now().Add(testFrequency))
+		}
+		select {
+		case batch := <-batches:
+			got = append(got, batch)
+		case <-time.After(10 * time.Millisecond):
+		case <-deadline:
+			t.Fatalf("got %d batches, want %d", len(got), n)
+		}
+	}
+	select {
+	case batch := <-batches:
+		t.Fatalf("unexpected batch %v", batch)
+	case <-time.After(30 * time.Millisecond):
+	}
+	return got
+}
+
+// A batch leaves once BatchSize values are waiting, and what is left once
+// the first of them has waited BatchFrequency. A value waiting already isn't
+// added again.
+func TestOutboxFlushes(t *testing.T) {
+	tests := []struct {
+		name      string
+		batchSize int
+		adds      [][]int64
+		full      [][]int64 // Without time passing
+		timed     [][]int64 // As it passes
+	}{
+		{"full batch", 3, [][]int64{{1, 2, 3}}, [][]int64{{1, 2, 3}}, nil},
+		{"below batch size", 10, [][]int64{{1, 2}}, nil, [][]int64{{1, 2}}},
+		{"over batch size", 2, [][]int64{{1, 2, 3}}, [][]int64{{1, 2}}, [][]int64{{3}}},
+		{"two batches over", 2, [][]int64{{1, 2, 3, 4, 5}}, [][]int64{{1, 2}, {3, 4}}, [][]int64{{5}}},
+		{"filled across adds", 3, [][]int64{{1}, {2}, {3, 4}}, [][]int64{{1, 2, 3}}, [][]int64{{4}}},
+		{"duplicates waiting", 10, [][]int64{{1, 2}, {2, 1, 3}}, nil, [][]int64{{1, 2, 3}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, batches, v := testOutbox(t, tt.batchSize, 1000, nil)
+			for _, add := range tt.adds {
+				addTo(o, ints(add...))
+			}
+			check := func(got [][]store.Value, want [][]int64) {
+				t.Helper()
+				for i := range want {
+					if !slices.Equal(got[i], ints(want[i]...)) {
+						t.Errorf("batch %d is %v, want %v", i, got[i], want[i])
+					}
+				}
+			}
+			check(receive(t, batches, len(tt.full), nil), tt.full)
+			check(receive(t, batches, len(tt.timed), v), tt.timed)
+		})
+	}
+}
+
+// Adding to a peer with OutboxLimit values waiting blocks until a batch
+// leaves, and no value is lost or reordered.
+func TestOutboxBackPressure(t *testing.T) {
+	release := make(chan struct{})
+	o, batches, _ := testOutbox(t, 2, 4, release)
+
+	values := ints(1, 2, 3, 4, 5, 6, 7, 8, 9, 10)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for _, v := range values {
+			addTo(o, []store.Value{v})
+		}
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("added everything while the first batch was stuck")
+	case <-time.After(50 * time.Millisecond):
+	}
+	o.mu.Lock()
+	waiting := len(o.peers["n1"].messages)
+	o.mu.Unlock()
+	if waiting != 4 {
+		t.Errorf("%d values waiting, want the limit of 4", waiting)
+	}
+
+	close(release)
+	<-done
+	o.flushAll()
+	var got []store.Value
+	for _, batch := range receive(t, batches, 5, nil) {
+		got = append(got, batch...)
+	}
+	if !slices.Equal(got, values) {
+		t.Errorf("delivered %v, want %v", got, values)
+	}
+}
@@ -0,0 +1,500 @@
+package broadcast
+
+import (
+	"encoding/json"
+	"maps"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+
+	"glomers/clock"
+	"glomers/config"
+	"glomers/logging"
+	"glomers/node"
+	"glomers/store"
+	"glomers/tracing"
+)
+
+const (
+	// Values announced again to a peer per GraftTimeout at most
+	plumtreeReannounceMax = 1000
+	// Bytes of values per ihave, Maelstrom's Go node can't read a line over
+	// 64KB
+	plumtreeIhaveBytes = 48 << 10
+)
+
+// registerPlumtree is an epidemic broadcast tree (Leitão et al., "Epidemic
+// Broadcast Trees"). Values are pushed eagerly to some neighbours and only
+// announced, in batches of ihave, to the others. Whoever sends us a value we
+// already had is pruned to lazy, so the eager links settle into a spanning
+// tree, and an announcement of a value we still don't have after
+// GraftTimeout grafts the announcer back in, which is how the tree heals
+// around failed nodes.
+//
+//	{"type": "gossip", "message": 7, "round": 2}          eager push
+//	{"type": "ihave", "messages": [7, 8]}                 lazy announcement
+//	{"type": "ihave", "messages": [7], "again": true}     announcement of values not acknowledged
+//	{"type": "graft", "messages": [7]}                    make the link eager and send these
+//	{"type": "prune"}                                     make the link lazy
+//
+// None of them are replied to. Every new value is sent or announced to every
+// neighbour, which is how they learn we have it. Since any of those can be
+// lost, a neighbour that hasn't acknowledged a value after GraftTimeout gets
+// it announced again, and answers by announcing it back if it had it, or by
+// grafting it if it didn't.
+func registerPlumtree(n *maelstrom.Node, cfg *config.Store, svc *services) {
+	s := &plumtreeServer{
+		n:        n,
+		cfg:      cfg,
+		svc:      svc,
+		eager:    make(map[string]struct{}),
+		lazy:     make(map[string]struct{}),
+		announce: make(map[string][]store.Value),
+		missing:  make(map[store.Value]*missingValue),
+
+		reannounced: make(map[string]time.Time),
+	}
+
+	n.Handle("init", s.initHandler)
+	n.Handle("broadcast", s.broadcastHandler)
+	n.Handle("read", s.readHandler)
+	n.Handle("topology", s.topologyHandler)
+	n.Handle("gossip", s.gossipHandler)
+	n.Handle("ihave", s.ihaveHandler)
+	n.Handle("graft", s.graftHandler)
+	n.Handle("prune", s.pruneHandler)
+	svc.setNeighbours(s.neighbours)
+	svc.quorum.onReplicated(func(src string, values []store.Value) {
+		for _, message := range values {
+			s.forward(message, 1, src, tracing.SpanContext{})
+		}
+	})
+
+	// With a dynamic membership the active view is the neighbourhood, new
+	// peers start eager like the topology's do
+	svc.members.Watch(func(peer string, up bool) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if up {
+			s.makeEager(peer)
+			return
+		}
+		delete(s.eager, peer)
+		delete(s.lazy, peer)
+		delete(s.announce, peer)
+	})
+
+	// Announcements are batched, sent every IhaveInterval
+	ticker := clock.NewTicker(cfg.Get().IhaveInterval)
+	cfg.Subscribe(func(old, cur config.Config) {
+		if cur.IhaveInterval != old.IhaveInterval {
+			ticker.Reset(cur.IhaveInterval)
+		}
+	})
+	go func() {
+		for range ticker.C() {
+			s.flushAnnouncements()
+		}
+	}()
+}
+
+type plumtreeServer struct {
+	n   *maelstrom.Node
+	cfg *config.Store
+	svc *services
+
+	// Opened in initHandler, once we know where our data lives
+	messages *store.Messages
+
+	mu sync.Mutex
+	// Every neighbour is in exactly one of eager and lazy
+	eager map[string]struct{}
+	lazy  map[string]struct{}
+	// Values to announce to each lazy peer at the next flush
+	announce map[string][]store.Value
+	// Values we were told of but haven't received yet
+	missing map[store.Value]*missingValue
+	// When each peer last got values announced again, only touched by the
+	// flushes
+	reannounced map[string]time.Time
+}
+
+type missingValue struct {
+	// Who announced it, grafted in turn
+	announcers []string
+	next       int
+	timer      clock.Timer
+}
+
+func (s *plumtreeServer) initHandler(_ maelstrom.Message) error {
+	// Recover whatever we had stored before answering anything
+	var err error
+	s.messages, err = openStore(s.n, s.cfg, s.svc)
+	return err
+}
+
+func (s *plumtreeServer) broadcastHandler(msg maelstrom.Message) error {
+	var body map[string]any
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+	message, err := messageOf(msg)
+	if err != nil {
+		return err
+	}
+
+	span := tracing.Start("broadcast", tracing.KindServer, tracing.FromBody(body))
+	span.SetAttribute("message", message)
+	span.SetAttribute("src", msg.Src)
+	defer span.End()
+
+	added, err := s.messages.Add(message)
+	if err != nil {
+		return err
+	}
+	logging.WithMsg(logger, msg).Debug("Received broadcast", "message", message)
+	s.svc.delivery.Originated(message)
+	// Replicas among our neighbours pass the value on themselves
+	replicas, quorumErr := s.svc.quorum.replicate(message)
+	if len(added) > 0 {
+		s.forward(message, 0, "", span.Context(), replicas...)
+	}
+	if quorumErr != nil {
+		return quorumErr
+	}
+	if err := s.svc.await(body, message); err != nil {
+		return err
+	}
+	return s.n.Reply(msg, map[string]any{
+		"type": "broadcast_ok",
+	})
+}
+
+func (s *plumtreeServer) gossipHandler(msg maelstrom.Message) error {
+	var body map[string]any
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+	message, err := messageOf(msg)
+	if err != nil {
+		return err
+	}
+	var gossip struct {
+		Round *int `json:"round"`
+	}
+	if err := json.Unmarshal(msg.Body, &gossip); err != nil {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
+	}
+	if gossip.Round == nil {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, "gossip needs a round")
+	}
+	round := *gossip.Round
+	logger := logging.WithMsg(peerCopyLogger, msg)
+
+	added, err := s.messages.Add(message)
+	if err != nil {
+		return err
+	}
+	s.svc.lag.Acked(msg.Src, []store.Value{message})
+	s.svc.delivery.Received(msg.Src, added)
+
+	s.mu.Lock()
+	if len(added) == 0 {
+		// Someone else got it to us first, this link isn't in the tree
+		s.makeLazy(msg.Src)
+		s.mu.Unlock()
+		logger.Debug("Pruning duplicate sender", "message", message, "peer", msg.Src)
+		return s.n.Send(msg.Src, map[string]any{"type": "prune"})
+	}
+	if m, ok := s.missing[message]; ok {
+		m.timer.Stop()
+		delete(s.missing, message)
+	}
+	s.makeEager(msg.Src)
+	s.mu.Unlock()
+
+	span := tracing.Start("gossip", tracing.KindServer, tracing.FromBody(body))
+	span.SetAttribute("message", message)
+	span.SetAttribute("src", msg.Src)
+	span.SetAttribute("round", round)
+	defer span.End()
+
+	logger.Debug("Received gossip", "message", message, "round", round)
+	s.forward(message, round+1, msg.Src, span.Context())
+	return nil
+}
+
+// forward pushes message to the eager peers and queues its announcement to
+// the lazy ones, except for from which sent it to us and skip which pass it on
+// themselves. Eager peers that look down only get the announcement, to graft
+// once they are back.
+func (s *plumtreeServer) forward(message store.Value, round int, from string, sc tracing.SpanContext, skip ...string) {
+	s.mu.Lock()
+	var eager []string
+	for peer := range s.eager {
+		switch {
+		case peer == from || slices.Contains(skip, peer):
+		case !s.svc.failures.Usable(peer):
+			s.announce[peer] = append(s.announce[peer], message)
+		default:
+			eager = append(eager, peer)
+		}
+	}
+	for peer := range s.lazy {
+		if peer != from && !slices.Contains(skip, peer) {
+			s.announce[peer] = append(s.announce[peer], message)
+		}
+	}
+	if from != "" {
+		s.announce[from] = append(s.announce[from], message)
+	}
+	s.mu.Unlock()
+
+	body := map[string]any{
+		"type":    "gossip",
+		"message": message,
+		"round":   round,
+	}
+	for _, peer := range eager {
+		span := tracing.Start("gossip", tracing.KindClient, sc)
+		span.SetAttribute("dst", peer)
+		body := maps.Clone(body)
+		tracing.Inject(body, span.Context())
+		if err := s.n.Send(peer, body); err != nil {
+			peerCopyLogger.Warn("Error sending gossip", "dst", peer, "err", err)
+		}
+		span.End()
+	}
+}
+
+func (s *plumtreeServer) flushAnnouncements() {
+	s.mu.Lock()
+	announce := s.announce
+	s.announce = make(map[string][]store.Value)
+	s.mu.Unlock()
+
+	for peer, messages := range announce {
+		s.sendIhave(peer, messages, false)
+	}
+	for peer, messages := range s.unacknowledged() {
+		peerCopyLogger.Debug("Announcing again", "dst", peer, "count", len(messages))
+		s.sendIhave(peer, messages, true)
+	}
+}
+
+// unacknowledged returns, for every neighbour that looks up and wasn't
+// announced to again in the last GraftTimeout, the values it hasn't
+// acknowledged in that long.
+func (s *plumtreeServer) unacknowledged() map[string][]store.Value {
+	timeout := s.cfg.Get().GraftTimeout
+	now := clock.Now()
+	out := make(map[string][]store.Value)
+	for _, peer := range s.neighbours() {
+		if now.Sub(s.reannounced[peer]) < timeout || !s.svc.failures.Usable(peer) {
+			continue
+		}
+		if messages := s.svc.lag.Pending(peer, timeout, plumtreeReannounceMax); len(messages) > 0 {
+			s.reannounced[peer] = now
+			out[peer] = messages
+		}
+	}
+	return out
+}
+
+// sendIhave announces messages to peer, in as many ihaves as it takes to keep
+// each under plumtreeIhaveBytes.
+func (s *plumtreeServer) sendIhave(peer string, messages []store.Value, again bool) {
+	for len(messages) > 0 {
+		n, size := 0, 0
+		for n < len(messages) && (n == 0 || size+len(messages[n])+1 <= plumtreeIhaveBytes) {
+			size += len(messages[n]) + 1
+			n++
+		}
+		body := map[string]any{
+			"type":     "ihave",
+			"messages": messages[:n],
+		}
+		if again {
+			body["again"] = true
+		}
+		if err := s.n.Send(peer, body); err != nil {
+			peerCopyLogger.Warn("Error sending ihave", "dst", peer, "err", err)
+		}
+		messages = messages[n:]
+	}
+}
+
+func (s *plumtreeServer) ihaveHandler(msg maelstrom.Message) error {
+	var body struct {
+		Messages []store.Value `json:"messages"`
+		Again    bool          `json:"again"`
+	}
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+	s.svc.lag.Acked(msg.Src, body.Messages)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, message := range body.Messages {
+		if s.messages.Has(message) {
+			if body.Again {
+				// Our own announcement of it must have been lost
+				s.announce[msg.Src] = append(s.announce[msg.Src], message)
+			}
+			continue
+		}
+		m, ok := s.missing[message]
+		if !ok {
+			// Give the eager push a chance to arrive before grafting
+			message := message
+			m = &missingValue{}
+			m.timer = clock.AfterFunc(s.cfg.Get().GraftTimeout, func() { s.graftMissing(message) })
+			s.missing[message] = m
+		}
+		if !slices.Contains(m.announcers, msg.Src) {
+			m.announcers = append(m.announcers, msg.Src)
+		}
+	}
+	return nil
+}
+
+// graftMissing asks an announcer of a value that never came to send it, and
+// to keep the link eager from now on. Grafts and the gossip answering them are
+// never acknowledged, so every GraftTimeout the next announcer, round and
+// round, is asked again until the value is here.
+func (s *plumtreeServer) graftMissing(message store.Value) {
+	s.mu.Lock()
+	m, ok := s.missing[message]
+	if !ok || len(m.announcers) == 0 || s.messages.Has(message) {
+		delete(s.missing, message)
+		s.mu.Unlock()
+		return
+	}
+	peer := m.announcers[m.next%len(m.announcers)]
+	m.next++
+	m.timer = clock.AfterFunc(s.cfg.Get().GraftTimeout, func() { s.graftMissing(message) })
+	s.makeEager(peer)
+	s.mu.Unlock()
+
+	peerCopyLogger.Debug("Grafting", "message", message, "peer", peer)
+	if err := s.n.Send(peer, map[string]any{
+		"type":     "graft",
+		"messages": []store.Value{message},
+	}); err != nil {
+		peerCopyLogger.Warn("Error sending graft", "dst", peer, "err", err)
+	}
+}
+
+func (s *plumtreeServer) graftHandler(msg maelstrom.Message) error {
+	var body struct {
+		Messages []store.Value `json:"messages"`
+	}
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.makeEager(msg.Src)
+	s.mu.Unlock()
+
+	for _, message := range body.Messages {
+		if !s.messages.Has(message) {
+			continue
+		}
+		if err := s.n.Send(msg.Src, map[string]any{
+			"type":    "gossip",
+			"message": message,
+			"round":   0,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *plumtreeServer) pruneHandler(msg maelstrom.Message) error {
+	s.mu.Lock()
+	s.makeLazy(msg.Src)
+	s.mu.Unlock()
+	logging.WithMsg(peerCopyLogger, msg).Debug("Pruned", "peer", msg.Src)
+	return nil
+}
+
+// neighbours returns the eager and lazy peers.
+func (s *plumtreeServer) neighbours() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peers := make([]string, 0, len(s.eager)+len(s.lazy))
+	for peer := range s.eager {
+		peers = append(peers, peer)
+	}
+	for peer := range s.lazy {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+// makeEager and makeLazy move peer between the sets, s.mu must be held.
+func (s *plumtreeServer) makeEager(peer string) {
+	delete(s.lazy, peer)
+	s.eager[peer] = struct{}{}
+}
+
+func (s *plumtreeServer) makeLazy(peer string) {
+	delete(s.eager, peer)
+	s.lazy[peer] = struct{}{}
+}
+
+func (s *plumtreeServer) readHandler(msg maelstrom.Message) error {
+	reply, err := readReply(msg, s.messages)
+	if err != nil {
+		return err
+	}
+	return node.Reply(s.n, msg, reply)
+}
+
+// topologyHandler starts with every neighbour eager, pruning trims that down
+// to a tree as the first broadcasts go through. A dynamic membership has the
+// final say on who the neighbours are, so the topology is ignored then.
+func (s *plumtreeServer) topologyHandler(msg maelstrom.Message) error {
+	if s.svc.members.Dynamic() {
+		logging.WithMsg(logger, msg).Info("Ignoring topology, neighbours come from membership")
+		return s.n.Reply(msg, map[string]any{
+			"type": "topology_ok",
+		})
+	}
+
+	var body struct {
+		Topology map[string][]string `json:"topology"`
+	}
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+
+	neighbours, ok := body.Topology[s.n.ID()]
+	if !ok {
+		neighbours = s.svc.members.Peers()
+	}
+	s.mu.Lock()
+	for _, peer := range neighbours {
+		if peer != s.n.ID() {
+			s.makeEager(peer)
+		}
+	}
+	eager := make([]string, 0, len(s.eager))
+	for peer := range s.eager {
+		eager = append(eager, peer)
+	}
+	s.mu.Unlock()
+	sort.Strings(eager)
+
+	logging.WithMsg(logger, msg).Info("Topology of this node", "eager", eager)
+	return s.n.Reply(msg, map[string]any{
+		"type": "topology_ok",
+	})
+}
@@ -0,0 +1,218 @@
+package broadcast
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sync"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+
+	"glomers/breaker"
+	"glomers/clock"
+	"glomers/config"
+	"glomers/logging"
+	"glomers/metrics"
+	"glomers/node"
+	"glomers/store"
+)
+
+// quorum holds back the reply to a client broadcast until the value is
+// stored on WriteQuorum nodes, this one included, so a crash right after the
+// reply can't lose it. The value goes to as many peers at once as are
+// needed, neighbours first, and a peer that fails is replaced by the next one
+// until QuorumTimeout runs out. Failing is indefinite, with crash rather
+// than timeout as Maelstrom's Go node drops a zero error code: the value is
+// stored here, and maybe on some replicas, by then.
+//
+//	{"type": "replicate", "messages": [7], "forward": true}  stored before replicate_ok
+//
+// A neighbour is asked to pass values new to it on like the strategy would,
+// and left out when we pass the value on ourselves, so it travels every link
+// once either way. Other replicas only store it, the value reaches them down
+// the usual path.
+type quorum struct {
+	n   *maelstrom.Node
+	cfg *config.Store
+	svc *services
+
+	mu sync.Mutex
+	// Set by openStore, replicate is refused until then
+	messages *store.Messages
+	// How the strategy passes values from src on, if it has to
+	forward func(src string, values []store.Value)
+}
+
+func newQuorum(n *maelstrom.Node, cfg *config.Store, svc *services) *quorum {
+	q := &quorum{n: n, cfg: cfg, svc: svc}
+	n.Handle("replicate", q.replicateHandler)
+	return q
+}
+
+// start hands over the store, once recovered.
+func (q *quorum) start(messages *store.Messages) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.messages = messages
+}
+
+// onReplicated sets how the strategy passes on values a replica didn't have.
+func (q *quorum) onReplicated(forward func(src string, values []store.Value)) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.forward = forward
+}
+
+// replicate returns once message is stored on WriteQuorum-1 peers, or a
+// crash error once that can't happen in time. forwarding are the neighbours that
+// stored it and pass it on, the strategy leaves them out.
+func (q *quorum) replicate(message store.Value) (forwarding []string, err error) {
+	c := q.cfg.Get()
+	need := c.WriteQuorum - 1
+	if need <= 0 {
+		return nil, nil
+	}
+	q.mu.Lock()
+	forwards := q.forward != nil
+	q.mu.Unlock()
+	var neighbours []string
+	if forwards && q.svc.neighbours != nil {
+		neighbours = q.svc.neighbours()
+	}
+	candidates := q.svc.replicaCandidates()
+	if len(candidates) < need {
+		return nil, maelstrom.NewRPCError(maelstrom.Crash,
+			fmt.Sprintf("%d peers up, a write quorum of %d needs %d, %s may still be stored",
+				len(candidates), c.WriteQuorum, need, message))
+	}
+
+	ctx, cancel := clock.WithTimeout(context.Background(), c.QuorumTimeout)
+	defer cancel()
+	type result struct {
+		peer string
+		err  error
+	}
+	results := make(chan result, len(candidates))
+	next, running := 0, 0
+	start := func() {
+		peer := candidates[next]
+		next++
+		running++
+		forward := slices.Contains(neighbours, peer)
+		go func() {
+			results <- result{peer, q.call(ctx, peer, message, forward)}
+		}()
+	}
+	for next < need {
+		start()
+	}
+
+	acked := 0
+	for acked < need {
+		if acked+running < need {
+			metrics.Inc("quorum_failures_total")
+			return forwarding, maelstrom.NewRPCError(maelstrom.Crash,
+				fmt.Sprintf("%s stored on %d of the %d nodes of the write quorum", message, acked+1, c.WriteQuorum))
+		}
+		r := <-results
+		running--
+		if r.err == nil {
+			acked++
+			if slices.Contains(neighbours, r.peer) {
+				forwarding = append(forwarding, r.peer)
+			}
+			continue
+		}
+		peerCopyLogger.Debug("Replica failed", "peer", r.peer, "message", message, "err", r.err)
+		if ctx.Err() == nil && next < len(candidates) {
+			start()
+		}
+	}
+	return forwarding, nil
+}
+
+// call stores message on peer before ctx runs out, asking it to pass the
+// value on if forward.
+func (q *quorum) call(ctx context.Context, peer string, message store.Value, forward bool) error {
+	err := q.svc.breakers.Call(peer, func() error {
+		start := clock.Now()
+		body := map[string]any{
+			"type":     "replicate",
+			"messages": []store.Value{message},
+		}
+		if forward {
+			body["forward"] = true
+		}
+		_, err := node.SyncRPC(ctx, q.n, peer, body)
+		metrics.RPC("replicate", start, err)
+		return err
+	})
+	if err == nil {
+		q.svc.lag.Acked(peer, []store.Value{message})
+	}
+	return err
+}
+
+// replicaCandidates returns the peers a value can be replicated to, the
+// strategy's neighbours first. Peers that look down or whose breaker is
+// open are left out.
+func (svc *services) replicaCandidates() []string {
+	var candidates []string
+	if svc.neighbours != nil {
+		candidates = svc.neighbours()
+	}
+	for _, peer := range svc.Peers() {
+		if !slices.Contains(candidates, peer) {
+			candidates = append(candidates, peer)
+		}
+	}
+	return slices.DeleteFunc(candidates, func(peer string) bool {
+		return !svc.failures.Usable(peer) || svc.breakers.State(peer) == breaker.Open
+	})
+}
+
+// replicateHandler stores values for a node that needs a write quorum, and
+// passes on those new to us when asked to.
+//
+//	Request
+//	{
+//	  "type": "replicate",
+//	  "messages": [7],
+//	  "forward": true
+//	}
+//
+//	Response
+//	{
+//	  "type": "replicate_ok"
+//	}
+func (q *quorum) replicateHandler(msg maelstrom.Message) error {
+	q.mu.Lock()
+	messages, forward := q.messages, q.forward
+	q.mu.Unlock()
+	if messages == nil {
+		return maelstrom.NewRPCError(maelstrom.TemporarilyUnavailable, "not initialised yet")
+	}
+
+	var body struct {
+		Messages []store.Value `json:"messages"`
+		Forward  bool          `json:"forward"`
+	}
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
+	}
+	added, err := messages.Add(body.Messages...)
+	if err != nil {
+		return err
+	}
+	logging.WithMsg(peerCopyLogger, msg).Debug("Received replica", "messages", body.Messages, "added", len(added))
+	q.svc.lag.Acked(msg.Src, body.Messages)
+	q.svc.delivery.Received(msg.Src, added)
+	if err := q.n.Reply(msg, map[string]any{"type": "replicate_ok"}); err != nil {
+		return err
+	}
+	if body.Forward && forward != nil && len(added) > 0 {
+		forward(msg.Src, added)
+	}
+	return nil
+}
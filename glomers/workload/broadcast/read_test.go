@@ -0,0 +1,134 @@
+package broadcast
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+
+	"glomers/store"
+)
+
+type readResult struct {
+	Messages   []store.Value `json:"messages"`
+	NextCursor *int          `json:"next_cursor"`
+}
+
+// read answers body from s as the read handlers do, through JSON.
+func read(t *testing.T, s *store.Messages, body string) (readResult, error) {
+	t.Helper()
+	reply, err := readReply(maelstrom.Message{Body: json.RawMessage(body)}, s)
+	if err != nil {
+		return readResult{}, err
+	}
+	buf, err := json.Marshal(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got readResult
+	if err := json.Unmarshal(buf, &got); err != nil {
+		t.Fatal(err)
+	}
+	return got, nil
+}
+
+func TestReadCursors(t *testing.T) {
+	s := store.NewMemory()
+	values := append(ints(5, 3, 9, 1, 7, 2), `"a"`, store.Int(4))
+	if _, err := s.Add(values...); err != nil {
+		t.Fatal(err)
+	}
+	next := func(i int) *int { return &i }
+	tests := []struct {
+		name     string
+		body     string
+		want     []store.Value
+		wantNext *int
+		wantCode int // Of the error, -1 for none
+	}{
+		{"everything", `{"type": "read"}`, values, nil, -1},
+		{"since", `{"type": "read", "since": 3}`, values[3:], next(8), -1},
+		{"limit", `{"type": "read", "limit": 4}`, values[:4], next(4), -1},
+		{"since and limit", `{"type": "read", "since": 5, "limit": 2}`, values[5:7], next(7), -1},
+		{"limit past the end", `{"type": "read", "since": 6, "limit": 10}`, values[6:], next(8), -1},
+		{"at the end", `{"type": "read", "since": 8}`, []store.Value{}, next(8), -1},
+		{"past the end", `{"type": "read", "since": 9}`, nil, nil, maelstrom.PreconditionFailed},
+		{"negative since", `{"type": "read", "since": -1}`, nil, nil, maelstrom.MalformedRequest},
+		{"zero limit", `{"type": "read", "limit": 0}`, nil, nil, maelstrom.MalformedRequest},
+		{"not a number", `{"type": "read", "since": "3"}`, nil, nil, maelstrom.MalformedRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := read(t, s, tt.body)
+			if tt.wantCode >= 0 {
+				var rpcErr *maelstrom.RPCError
+				if !errors.As(err, &rpcErr) || rpcErr.Code != tt.wantCode {
+					t.Fatalf("got %v, want error code %d", err, tt.wantCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readReply: %v", err)
+			}
+			if !slices.Equal(got.Messages, tt.want) || (got.Messages == nil) != (tt.want == nil) {
+				t.Errorf("messages %v, want %v", got.Messages, tt.want)
+			}
+			if (got.NextCursor == nil) != (tt.wantNext == nil) || (got.NextCursor != nil && *got.NextCursor != *tt.wantNext) {
+				t.Errorf("next_cursor %v, want %v", got.NextCursor, tt.wantNext)
+			}
+		})
+	}
+}
+
+// Paging with the cursor each read hands back sees every value once, in the
+// order they were added, while values keep arriving, and a durable store
+// keeps the cursors good across a restart.
+func TestReadPaging(t *testing.T) {
+	dir := t.TempDir()
+	open := func() *store.Messages {
+		s, err := store.Open(store.Options{Dir: dir, Fsync: store.FsyncNever, FsyncInterval: time.Hour, SnapshotInterval: time.Hour})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	s := open()
+	var added, seen []store.Value
+	cursor := 0
+	for page := 0; page < 12; page++ {
+		fresh := ints(int64(3*page), int64(3*page+1))
+		if _, err := s.Add(fresh...); err != nil {
+			t.Fatal(err)
+		}
+		added = append(added, fresh...)
+		if page == 6 {
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+			s = open()
+		}
+
+		got, err := read(t, s, fmt.Sprintf(`{"type": "read", "since": %d, "limit": 3}`, cursor))
+		if err != nil {
+			t.Fatalf("page %d: %v", page, err)
+		}
+		seen = append(seen, got.Messages...)
+		cursor = *got.NextCursor
+	}
+	defer s.Close()
+	for cursor < len(added) {
+		got, err := read(t, s, fmt.Sprintf(`{"type": "read", "since": %d, "limit": 3}`, cursor))
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen = append(seen, got.Messages...)
+		cursor = *got.NextCursor
+	}
+	if !slices.Equal(seen, added) {
+		t.Errorf("paged through %v, want %v", seen, added)
+	}
+}
@@ -0,0 +1,129 @@
+package broadcast
+
+import (
+	"slices"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+
+	"glomers/clock"
+	"glomers/store"
+	"glomers/tracing"
+)
+
+// The tree strategies send everything a leaf learns to its parent, the root,
+// so a root that can't be reached would leave the leaves unable to reach each
+// other. A relay, the parent or whoever stands in for it, that doesn't answer
+// is marked unreachable and values go up another way:
+//
+//   - to the first node in id order, other than the parent, that we can still
+//     reach. It either reaches the root itself or, standing in for it, sends
+//     to everyone.
+//   - to every peer directly when we are that node, or there is no one left.
+//
+// Unreachable relays are probed every ParentProbeInterval and the node rejoins
+// the preferred tree as soon as one answers. With a failure detector, nodes it
+// thinks are down are treated as unreachable too.
+
+// upstream returns how values get above us when parent is our parent, either
+// a single relay or a fan-out to every peer.
+func (s *treeServer) upstream(parent string) (fanout []string, relay string) {
+	if s.reachable(parent) {
+		return nil, parent
+	}
+	for _, id := range s.n.NodeIDs() {
+		if id == parent || !s.reachable(id) {
+			continue
+		}
+		if id != s.nodeId {
+			return nil, id
+		}
+		break // We stand in for the parent
+	}
+	for _, id := range s.n.NodeIDs() {
+		if id != s.nodeId && id != parent {
+			fanout = append(fanout, id)
+		}
+	}
+	return fanout, ""
+}
+
+func (s *treeServer) reachable(peer string) bool {
+	s.routeMutex.Lock()
+	defer s.routeMutex.Unlock()
+	return !s.unreachable[peer] && s.svc.failures.Usable(peer)
+}
+
+// lostTouch marks relay unreachable and probes it until it is back.
+func (s *treeServer) lostTouch(relay string, err error) {
+	s.routeMutex.Lock()
+	if s.unreachable[relay] {
+		s.routeMutex.Unlock()
+		return
+	}
+	s.unreachable[relay] = true
+	s.routeMutex.Unlock()
+	peerCopyLogger.Warn("Relay unreachable, re-routing around it", "relay", relay, "err", err)
+
+	go func() {
+		for {
+			clock.Sleep(s.cfg.Get().ParentProbeInterval)
+			if _, err := s.call(relay, map[string]any{"type": "tree_probe"}); err != nil {
+				continue
+			}
+			s.routeMutex.Lock()
+			delete(s.unreachable, relay)
+			s.routeMutex.Unlock()
+			peerCopyLogger.Info("Relay is back, rejoining the tree", "relay", relay)
+			return
+		}
+	}()
+}
+
+// relayCopy sends messages up the tree through relay. When relay doesn't
+// answer they go up another way at once, and relay gets them through its
+// retry queue so it has them when it is back.
+func (s *treeServer) relayCopy(src, relay string, messages []store.Value, traces []tracing.SpanContext) {
+	err := s.batchRPC(relay, messages, traces, s.call)
+	if err == nil {
+		return
+	}
+
+	s.lostTouch(relay, err)
+	fanout, next := s.upstream(s.parent())
+	if err := s.queue(append(without(fanout, src), relay), messages, traces); err != nil {
+		peerCopyLogger.Error("Error queueing values", "count", len(messages), "err", err)
+	}
+	if next != "" && next != src && next != relay {
+		s.relayCopy(src, next, messages, traces)
+	}
+}
+
+// isRelay reports whether dst currently carries values up the tree for us.
+func (s *treeServer) isRelay(dst string) bool {
+	_, relay := s.neighbours()
+	return dst == relay
+}
+
+// probeHandler tells a child that lost touch with us that we are back.
+//
+//	Request
+//	{
+//	  "type": "tree_probe"
+//	}
+//
+//	Response
+//	{
+//	  "type": "tree_probe_ok"
+//	}
+func (s *treeServer) probeHandler(msg maelstrom.Message) error {
+	return s.n.Reply(msg, map[string]any{
+		"type": "tree_probe_ok",
+	})
+}
+
+// without returns peers minus the ones in skip.
+func without(peers []string, skip ...string) []string {
+	return slices.DeleteFunc(slices.Clone(peers), func(p string) bool {
+		return slices.Contains(skip, p)
+	})
+}
@@ -0,0 +1,100 @@
+package broadcast
+
+import (
+	"encoding/json"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+
+	"glomers/config"
+	"glomers/logging"
+	"glomers/node"
+	"glomers/store"
+)
+
+// registerSingle is #3a, a single node keeping everything it was sent
+func registerSingle(n *maelstrom.Node, cfg *config.Store, svc *services) {
+	logger.Info("Inside Single Node Broadcast Main")
+
+	// Recover whatever we had stored before answering anything
+	var messages *store.Messages
+	n.Handle("init", func(_ maelstrom.Message) error {
+		var err error
+		messages, err = openStore(n, cfg, svc)
+		return err
+	})
+
+	// Register the broadcast handler
+	/**
+	// Sample
+	{
+	  "type": "broadcast",
+	  "message": 1000
+	}
+	**/
+	n.Handle("broadcast", func(msg maelstrom.Message) error {
+		var body map[string]any
+
+		if err := json.Unmarshal(msg.Body, &body); err != nil {
+			return err
+		}
+
+		// Persist the data
+		message, err := messageOf(msg)
+		if err != nil {
+			return err
+		}
+		if _, err := messages.Add(message); err != nil {
+			return err
+		}
+		svc.delivery.Originated(message)
+		if err := svc.confirm(body, message); err != nil {
+			return err
+		}
+		// Store whatever we got into in-memory storage to be read later by caller
+		body["type"] = "broadcast_ok"
+		delete(body, "message")
+		delete(body, "wait_for")
+
+		return n.Reply(msg, body)
+	})
+
+	// Handle Read operation
+	/**
+	Request
+	{
+		"type": "read"
+	}
+
+	Response
+	{
+	  "type": "read_ok",
+	  "messages": [1, 8, 72, 25]
+	}
+
+	Or a page of them, see readReply
+	**/
+
+	n.Handle("read", func(msg maelstrom.Message) error {
+		reply, err := readReply(msg, messages)
+		if err != nil {
+			return err
+		}
+		return node.Reply(n, msg, reply)
+	})
+
+	// Handle the topology request
+	n.Handle("topology", func(msg maelstrom.Message) error {
+		var body map[string]any
+
+		if err := json.Unmarshal(msg.Body, &body); err != nil {
+			return err
+		}
+
+		logging.WithMsg(logger, msg).Debug("Received topology", "topology", body["topology"])
+
+		body["type"] = "topology_ok"
+		delete(body, "topology")
+
+		return n.Reply(msg, body)
+	})
+}
@@ -0,0 +1,476 @@
+package broadcast
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/emirpasic/gods/trees/btree"
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+
+	"glomers/breaker"
+	"glomers/clock"
+	"glomers/config"
+	"glomers/logging"
+	"glomers/metrics"
+	"glomers/node"
+	"glomers/retry"
+	"glomers/store"
+	"glomers/tracing"
+)
+
+// registerTree is #3d, broadcasts travel along a two level btree of the nodes
+// to keep msgs-per-op low
+func registerTree(n *maelstrom.Node, cfg *config.Store, svc *services) {
+	newTreeServer(n, cfg, svc)
+}
+
+// registerBatched is #3e, the tree of #3d where values are forwarded in
+// batches, see outbox
+func registerBatched(n *maelstrom.Node, cfg *config.Store, svc *services) {
+	s := newTreeServer(n, cfg, svc)
+	s.batched = true
+	n.Handle("flush", s.flushHandler)
+}
+
+func newTreeServer(n *maelstrom.Node, cfg *config.Store, svc *services) *treeServer {
+	s := &treeServer{
+		n:           n,
+		cfg:         cfg,
+		svc:         svc,
+		unreachable: make(map[string]bool),
+	}
+	s.outbox = newOutbox(cfg, s.sendBatch)
+
+	n.Handle("init", s.initHandler)
+	n.Handle("broadcast", s.broadcastHandler)
+	n.Handle("read", s.readHandler)
+	n.Handle("topology", s.topologyHandler)
+	n.Handle("tree_probe", s.probeHandler)
+	svc.setNeighbours(func() []string {
+		s.nodesMutex.RLock()
+		ready := s.topology != nil
+		s.nodesMutex.RUnlock()
+		if !ready {
+			return nil
+		}
+		peers, relay := s.neighbours()
+		if relay != "" {
+			// The next hop up goes first, a replica there is on the way
+			peers = append([]string{relay}, without(peers, relay)...)
+		}
+		return peers
+	})
+	svc.quorum.onReplicated(func(src string, values []store.Value) {
+		if err := s.peerCopy(src, values, make([]tracing.SpanContext, len(values))); err != nil {
+			peerCopyLogger.Error("Error forwarding replicated values", "count", len(values), "err", err)
+		}
+	})
+	return s
+}
+
+type treeServer struct {
+	n      *maelstrom.Node
+	cfg    *config.Store
+	svc    *services
+	nodeId string
+	id     int
+
+	// Opened in initHandler, once we know where our data lives
+	messages *store.Messages
+
+	nodesMutex sync.RWMutex
+	topology   *btree.Tree
+
+	// Client broadcasts are forwarded in batches too, not just the values
+	// that came in one
+	batched bool
+	outbox  *outbox
+	// Opened in initHandler, holds what peers haven't taken yet
+	retries *retry.Queues
+
+	// Relays that stopped answering, see reparent.go
+	routeMutex  sync.Mutex
+	unreachable map[string]bool
+
+	// How each peer takes its batches, see batch.go
+	encodings peerEncodings
+}
+
+func (s *treeServer) initHandler(_ maelstrom.Message) error {
+	s.nodeId = s.n.ID()
+	// Get the numeric part from the Id
+	// So if the nodes are named as n1, n2, n3
+	// let's fetch 1, 2, and 3 respectively
+	id, err := strconv.Atoi(s.nodeId[1:])
+	if err != nil {
+		return err
+	}
+	s.id = id
+	logger.Info("Initializing node", "nodeId", s.nodeId, "id", id)
+
+	// Recover whatever we had stored, and still had to deliver, before
+	// answering anything
+	if s.messages, err = openStore(s.n, s.cfg, s.svc); err != nil {
+		return err
+	}
+	return s.openRetries()
+}
+
+// openRetries recovers the deliveries pending before a restart, journaled
+// next to the store.
+func (s *treeServer) openRetries() error {
+	options := func(c config.Config) retry.Options {
+		backoff := c.PeerCopyBackoff
+		if s.batched {
+			backoff = c.BatchRetryBackoff
+		}
+		dir := nodeDir(s.n, c)
+		if dir != "" {
+			dir = filepath.Join(dir, "retry")
+		}
+		return retry.Options{
+			Dir:        dir,
+			Sync:       c.Fsync == store.FsyncAlways,
+			Backoff:    backoff,
+			MaxBackoff: c.RetryBackoffMax,
+			MaxRetry:   c.MaxRetry,
+			MaxBatch:   c.BatchSize,
+			MaxQueued:  c.RetryQueueLimit,
+		}
+	}
+	var err error
+	if s.retries, err = retry.Open(options(s.cfg.Get()), s.deliver); err != nil {
+		return err
+	}
+	s.cfg.Subscribe(func(_, cur config.Config) {
+		s.retries.Reconfigure(options(cur))
+	})
+	return nil
+}
+
+func (s *treeServer) broadcastHandler(msg maelstrom.Message) error {
+	var body map[string]any
+
+	if err := json.Unmarshal(msg.Body, &body); err != nil {
+		return err
+	}
+
+	// Only acknowledge once the values are stored, so a durable store never
+	// loses a broadcast we said was done
+	ack := func() {
+		reply := map[string]any{
+			"type": "broadcast_ok",
+		}
+		if _, single := body["message"]; !single {
+			reply["encodings"] = batchEncodings
+		}
+		go func() {
+			_ = s.n.Reply(msg, reply)
+			logging.WithMsg(logger, msg).Debug("Received broadcast", "message", body["message"], "messages", body["messages"])
+		}()
+	}
+
+	// Check if we got single message  or batched peerCopy broadcast
+	if _, contains := body["message"]; contains {
+		message, err := messageOf(msg)
+		if err != nil {
+			return err
+		}
+		// Client broadcasts carry no trace and start a new one
+		span := tracing.Start("broadcast", tracing.KindServer, tracing.FromBody(body))
+		span.SetAttribute("message", message)
+		span.SetAttribute("src", msg.Src)
+		defer span.End()
+
+		added, err := s.messages.Add(message)
+		if err != nil {
+			return err
+		}
+		s.svc.delivery.Originated(message)
+		traces := []tracing.SpanContext{span.Context()}
+		if len(added) == 0 {
+			span.SetAttribute("duplicate", true)
+		}
+		if !s.svc.confirms(body) {
+			ack()
+			if len(added) == 0 {
+				return nil
+			}
+			if err := s.peerCopy(msg.Src, added, traces); err != nil {
+				// Already acknowledged, returning it would send a second reply
+				logging.WithMsg(peerCopyLogger, msg).Error("Error forwarding broadcast", "message", message, "err", err)
+			}
+			return nil
+		}
+
+		// Replicas among our neighbours pass the value on themselves
+		replicas, quorumErr := s.svc.quorum.replicate(message)
+		if len(added) > 0 {
+			if err := s.peerCopy(msg.Src, added, traces, replicas...); err != nil {
+				return err
+			}
+		}
+		if quorumErr != nil {
+			return quorumErr
+		}
+		if err := s.svc.await(body, message); err != nil {
+			return err
+		}
+		return s.n.Reply(msg, map[string]any{
+			"type": "broadcast_ok",
+		})
+	}
+
+	// Here we are sure we got a batch messages
+	received, err := decodeBatch(msg.Body)
+	if err != nil {
+		return maelstrom.NewRPCError(maelstrom.MalformedRequest, err.Error())
+	}
+	s.encodings.learn(msg.Src, msg.Body)
+	parents := tracing.FromBatch(body, len(received))
+	parentOf := make(map[store.Value]tracing.SpanContext, len(received))
+	for i, message := range received {
+		parentOf[message] = parents[i]
+	}
+	// Skips those which we already have
+	messages, err := s.messages.Add(received...)
+	if err != nil {
+		return err
+	}
+	ack()
+	s.svc.lag.Acked(msg.Src, received)
+	s.svc.delivery.Received(msg.Src, messages)
+
+	traces := make([]tracing.SpanContext, 0, len(messages))
+	for _, message := range messages {
+		// Each value keeps following its own trace through the batch
+		span := tracing.Start("broadcast", tracing.KindServer, parentOf[message])
+		span.SetAttribute("message", message)
+		span.SetAttribute("src", msg.Src)
+		span.SetAttribute("batched", true)
+		span.End()
+		traces = append(traces, span.Context())
+	}
+	if err := s.peerCopy(msg.Src, messages, traces); err != nil {
+		// Already acknowledged, returning it would send a second reply
+		logging.WithMsg(peerCopyLogger, msg).Error("Error forwarding batch", "count", len(messages), "err", err)
+	}
+	return nil
+}
+
+// parent returns our parent in the tree, empty on the root.
+func (s *treeServer) parent() string {
+	s.nodesMutex.RLock()
+	n := s.topology.GetNode(s.id)
+	s.nodesMutex.RUnlock()
+	if n.Parent == nil {
+		return ""
+	}
+	return n.Parent.Entries[0].Value.(string)
+}
+
+// neighbours returns who a value goes to: peers are copied to until they
+// take it, relay, when set, carries it up the tree and is re-routed around
+// if it doesn't answer.
+//
+// Since we are only keeping 2 level of tree, So for a topology of 5 nodes
+// Here is how are btree will look like
+//
+//	    [3]  --------------> Root
+//	   //  \\
+//	[0, 1] [4, 5] ------------> Leaf
+//
+// All leaf will only peer-copy to parent
+// Only parent will peer-copy to child
+func (s *treeServer) neighbours() (peers []string, relay string) {
+	s.nodesMutex.RLock()
+	n := s.topology.GetNode(s.id)
+	s.nodesMutex.RUnlock()
+
+	for _, children := range n.Children {
+		for _, entry := range children.Entries {
+			peers = append(peers, entry.Value.(string))
+		}
+	}
+	if n.Parent == nil {
+		return peers, ""
+	}
+	parent := n.Parent.Entries[0].Value.(string)
+	fanout, relay := s.upstream(parent)
+	if relay != parent {
+		// Still owed everything, for when it is back
+		fanout = append(fanout, parent)
+	}
+	return append(peers, fanout...), relay
+}
+
+// peerCopy forwards messages to every neighbour but src and skip, through the
+// outbox for the batched strategy and straight to the retry queues otherwise.
+func (s *treeServer) peerCopy(src string, messages []store.Value, traces []tracing.SpanContext, skip ...string) error {
+	if len(messages) == 0 {
+		return nil // A batch of values we all had already
+	}
+	peers, relay := s.neighbours()
+	peerCopyLogger.Debug("Neighbours of node", "neighbours", peers, "relay", relay)
+
+	// Skip PeerCopy to self or from the node where message came from
+	peers = without(without(peers, skip...), src, s.nodeId)
+	if relay == src || slices.Contains(skip, relay) {
+		relay = ""
+	}
+	if s.batched {
+		// We will just append it will automatically be sent by the outbox
+		if relay != "" {
+			peers = append(peers, relay)
+		}
+		for _, dst := range peers {
+			s.outbox.add(dst, messages, traces)
+		}
+		return nil
+	}
+	if err := s.queue(peers, messages, traces); err != nil {
+		return err
+	}
+	if relay != "" {
+		s.svc.outbound.Go(relay, func() { s.relayCopy(src, relay, messages, traces) })
+	}
+	return nil
+}
+
+// queue hands messages to the retry queue of every peer, which delivers them
+// until they are taken.
+func (s *treeServer) queue(peers []string, messages []store.Value, traces []tracing.SpanContext) error {
+	for _, dst := range peers {
+		if err := s.retries.Add(dst, messages, traces); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendBatch is how the outbox hands over a batch for dst.
+func (s *treeServer) sendBatch(dst string, messages []store.Value, traces []tracing.SpanContext) {
+	if s.isRelay(dst) {
+		s.svc.outbound.Go(dst, func() { s.relayCopy("", dst, messages, traces) })
+		return
+	}
+	if err := s.queue([]string{dst}, messages, traces); err != nil {
+		peerCopyLogger.Error("Error queueing batch", "dst", dst, "count", len(messages), "err", err)
+	}
+}
+
+// deliver is how the retry queues send dst what is pending for it. A peer
+// that looks down, or whose breaker is open, is waited out before taking a
+// worker, its values stay parked in its queue meanwhile.
+func (s *treeServer) deliver(dst string, messages []store.Value, traces []tracing.SpanContext) error {
+	for {
+		s.svc.waitUsable(dst)
+		<-s.svc.breakers.Ready(dst)
+		err := s.svc.outbound.Call(dst, func() error {
+			return s.batchRPC(dst, messages, traces, s.call)
+		})
+		if !errors.Is(err, breaker.ErrOpen) {
+			return err
+		}
+	}
+}
+
+// batchRPC sends messages to dst in one broadcast with call, each value
+// carrying its own trace.
+func (s *treeServer) batchRPC(dst string, messages []store.Value, traces []tracing.SpanContext,
+	call func(dst string, body map[string]any) (maelstrom.Message, error)) error {
+	span := tracing.Start("broadcast.batch", tracing.KindClient, tracing.SpanContext{})
+	span.SetAttribute("dst", dst)
+	span.SetAttribute("count", len(messages))
+	span.Link(traces...)
+	defer span.End()
+	metrics.Observe("batch_size", float64(len(messages)))
+
+	body := map[string]any{
+		"type": "broadcast",
+	}
+	if err := encodeBatch(body, messages, traces, s.encodings.usable(dst, s.cfg.Get())); err != nil {
+		return err
+	}
+	reply, err := call(dst, body)
+	if err != nil {
+		span.SetAttribute("error", err.Error())
+		return err
+	}
+	s.encodings.learn(dst, reply.Body)
+	s.svc.lag.Acked(dst, messages)
+	return nil
+}
+
+// flushHandler sends every peer what is waiting for it in the outbox without
+// waiting for the batch to fill up or age. flushed counts the values sent,
+// those behind a batch still in flight go as soon as it is done.
+//
+//	Request
+//	{
+//	  "type": "flush"
+//	}
+//
+//	Response
+//	{
+//	  "type": "flush_ok",
+//	  "flushed": 42
+//	}
+func (s *treeServer) flushHandler(msg maelstrom.Message) error {
+	flushed := s.outbox.flushAll()
+	logging.WithMsg(logger, msg).Info("Flushed outbox", "flushed", flushed)
+	return s.n.Reply(msg, map[string]any{
+		"type":    "flush_ok",
+		"flushed": flushed,
+	})
+}
+
+// call is a single RPC to dst, without waiting for it to look up. It fails
+// at once with breaker.ErrOpen while dst's breaker is open.
+func (s *treeServer) call(dst string, body map[string]any) (maelstrom.Message, error) {
+	var reply maelstrom.Message
+	err := s.svc.breakers.Call(dst, func() error {
+		// Cancel after RPCTimeout, 1 second by default
+		ctx, cancel := clock.WithTimeout(context.Background(), s.cfg.Get().RPCTimeout)
+		defer cancel()
+		start := clock.Now()
+		var err error
+		reply, err = node.SyncRPC(ctx, s.n, dst, body)
+		metrics.RPC(body["type"].(string), start, err)
+		return err
+	})
+	return reply, err
+}
+
+func (s *treeServer) readHandler(msg maelstrom.Message) error {
+	// A view doesn't change, safe to marshal while broadcasts keep coming
+	reply, err := readReply(msg, s.messages)
+	if err != nil {
+		return err
+	}
+	return node.Reply(s.n, msg, reply)
+}
+
+func (s *treeServer) topologyHandler(msg maelstrom.Message) error {
+	// In Btree if the order is 't'
+	// Then any node can have max t children and t-1 keys
+	// So for 25 node cluster
+	// There will be 1 root node with 1 key
+	// and remaining 1 child with 24 keys
+	topologyTree := btree.NewWithIntComparator(len(s.n.NodeIDs()))
+	for i := 0; i < len(s.n.NodeIDs()); i++ {
+		topologyTree.Put(i, fmt.Sprintf("n%d", i))
+	}
+	s.nodesMutex.Lock()
+	s.topology = topologyTree
+	s.nodesMutex.Unlock()
+	return s.n.Reply(msg, map[string]any{
+		"type": "topology_ok",
+	})
+}
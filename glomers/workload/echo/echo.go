@@ -0,0 +1,34 @@
+// Package echo is the solution to challenge #1, it replies with whatever it
+// received.
+package echo
+
+import (
+	"encoding/json"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+
+	"glomers/logging"
+)
+
+var logger = logging.Component("echo")
+
+// Register installs the echo handler on n.
+func Register(n *maelstrom.Node) {
+	logger.Info("Inside Echo Main")
+
+	// Register the echo  handler
+	n.Handle("echo", func(msg maelstrom.Message) error {
+		// Unmarshal the message body as loosely-typed map
+		var body map[string]any
+		if err := json.Unmarshal(msg.Body, &body); err != nil {
+			return err
+		}
+		logging.WithMsg(logger, msg).Debug("Echoing back")
+
+		// Update the message type to return back
+		body["type"] = "echo_ok"
+
+		// Echo the original message back with the updated message type
+		return n.Reply(msg, body)
+	})
+}
@@ -0,0 +1,41 @@
+// Package uniqueids is the solution to challenge #2, globally unique ids
+// without any coordination.
+package uniqueids
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+
+	maelstrom "github.com/jepsen-io/maelstrom/demo/go"
+
+	"glomers/logging"
+)
+
+var logger = logging.Component("unique-ids")
+
+// Register installs the generate handler on n.
+func Register(n *maelstrom.Node) {
+	rand.Seed(time.Now().UnixNano()) // Seed the random generator
+	logger.Info("Inside UniqueID Generation main")
+	processId := os.Getpid()
+
+	// Register the Unique Id generate handler
+	n.Handle("generate", func(msg maelstrom.Message) error {
+		// Unmarshal the message body as loosely typed map
+		var body map[string]any
+		if err := json.Unmarshal(msg.Body, &body); err != nil {
+			return err
+		}
+
+		// Updating the response message type
+		body["type"] = "generate_ok"
+
+		body["id"] = fmt.Sprintf("%d-%d", rand.Int63(), processId)
+		logging.WithMsg(logger, msg).Debug("Generated id", "id", body["id"])
+
+		return n.Reply(msg, body)
+	})
+}